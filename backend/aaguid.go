@@ -0,0 +1,117 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// bundledAAGUIDs is a snapshot of the community passkey provider list
+// (github.com/passkeydeveloper/passkey-authenticator-aaguids), trimmed to
+// names.
+//
+//go:embed data/aaguid.json
+var bundledAAGUIDs []byte
+
+// aaguidEntry is one value of the community aaguid.json format. The icon
+// fields are accepted but not used.
+type aaguidEntry struct {
+	Name      string `json:"name"`
+	IconDark  string `json:"icon_dark,omitempty"`
+	IconLight string `json:"icon_light,omitempty"`
+}
+
+// AAGUIDRegistry maps authenticator AAGUIDs to human-readable names such as
+// "iCloud Keychain" or "YubiKey 5 Series". It is safe for concurrent use.
+type AAGUIDRegistry struct {
+	mu    sync.RWMutex
+	names map[uuid.UUID]string
+}
+
+// NewAAGUIDRegistry returns a registry holding the bundled list.
+func NewAAGUIDRegistry() *AAGUIDRegistry {
+	r := &AAGUIDRegistry{names: make(map[uuid.UUID]string)}
+	if err := r.Load(bundledAAGUIDs); err != nil {
+		panic(fmt.Sprintf("bundled aaguid.json: %v", err))
+	}
+	return r
+}
+
+// Load adds the entries of an aaguid.json document, replacing the names of
+// AAGUIDs already known. The document is applied only if it parses fully.
+func (r *AAGUIDRegistry) Load(data []byte) error {
+	var doc map[string]aaguidEntry
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	names := make(map[uuid.UUID]string, len(doc))
+	for key, entry := range doc {
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return fmt.Errorf("AAGUID %q: %w", key, err)
+		}
+		if entry.Name != "" {
+			names[id] = entry.Name
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, name := range names {
+		r.names[id] = name
+	}
+	return nil
+}
+
+// LoadFile adds the entries of the aaguid.json file at path, so deployments
+// can pick up newer authenticators than the bundled list knows.
+func (r *AAGUIDRegistry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := r.Load(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Name returns the name registered for aaguid. The all-zero AAGUID, sent by
+// authenticators that do not identify themselves, is never registered, and a
+// nil registry knows no names.
+func (r *AAGUIDRegistry) Name(aaguid []byte) (string, bool) {
+	id, err := uuid.FromBytes(aaguid)
+	if r == nil || err != nil || id == uuid.Nil {
+		return "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.names[id]
+	return name, ok
+}
+
+// authenticatorName names the authenticator that holds cred: its registered
+// name if the AAGUID is known, otherwise a description derived from its
+// transports and attachment.
+func (a *App) authenticatorName(cred webauthn.Credential) string {
+	if name, ok := a.aaguids.Name(cred.Authenticator.AAGUID); ok {
+		return name
+	}
+	return fallbackAuthenticatorName(cred)
+}
+
+// storedAuthenticatorName returns the authenticator name saved with cred,
+// naming it now if it was stored before names were saved.
+func (a *App) storedAuthenticatorName(cred webauthn.Credential) string {
+	var name string
+	err := a.db.QueryRow("SELECT authenticator_name FROM credentials WHERE credential_id = ?", cred.ID).Scan(&name)
+	if err != nil || name == "" {
+		return a.authenticatorName(cred)
+	}
+	return name
+}
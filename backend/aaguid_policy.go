@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// AAGUIDPolicy restricts which authenticator models may hold passkeys, by
+// the AAGUID they report. It is checked when a passkey is registered and
+// again on every login, so tightening it also shuts out passkeys that are
+// already registered.
+type AAGUIDPolicy struct {
+	// Allow, if not empty, is the only set of AAGUIDs accepted. Authenticators
+	// that report the all-zero AAGUID are accepted only if it is listed.
+	Allow []uuid.UUID
+	// Deny lists AAGUIDs that are refused even if Allow lists them.
+	Deny []uuid.UUID
+}
+
+// ErrAAGUIDNotAllowed is returned for authenticators the AAGUID policy refuses.
+var ErrAAGUIDNotAllowed = errors.New("authenticator model not allowed")
+
+// ParseAAGUIDList parses a comma-separated list of AAGUIDs.
+func ParseAAGUIDList(s string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, item := range splitList(s) {
+		id, err := uuid.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("AAGUID %q: %w", item, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Check returns ErrAAGUIDNotAllowed if the authenticator with aaguid may not
+// be used. A missing or malformed AAGUID counts as the all-zero one.
+func (p AAGUIDPolicy) Check(aaguid []byte) error {
+	id, err := uuid.FromBytes(aaguid)
+	if err != nil {
+		id = uuid.Nil
+	}
+	if slices.Contains(p.Deny, id) {
+		return ErrAAGUIDNotAllowed
+	}
+	if len(p.Allow) > 0 && !slices.Contains(p.Allow, id) {
+		return ErrAAGUIDNotAllowed
+	}
+	return nil
+}
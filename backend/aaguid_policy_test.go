@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func TestAAGUIDPolicyCheck(t *testing.T) {
+	yubikey := uuid.MustParse("cb69481e-8ff7-4039-93ec-0a2729a154a8")
+	icloud := uuid.MustParse("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")
+	other := uuid.MustParse("11111111-2222-3333-4444-555555555555")
+
+	tests := []struct {
+		name   string
+		policy AAGUIDPolicy
+		aaguid []byte
+		ok     bool
+	}{
+		{"no policy", AAGUIDPolicy{}, icloud[:], true},
+		{"no policy, zero AAGUID", AAGUIDPolicy{}, uuid.Nil[:], true},
+		{"denied", AAGUIDPolicy{Deny: []uuid.UUID{icloud}}, icloud[:], false},
+		{"not denied", AAGUIDPolicy{Deny: []uuid.UUID{icloud}}, other[:], true},
+		{"allowed", AAGUIDPolicy{Allow: []uuid.UUID{yubikey}}, yubikey[:], true},
+		{"not allowed", AAGUIDPolicy{Allow: []uuid.UUID{yubikey}}, icloud[:], false},
+		{"allowlist, zero AAGUID", AAGUIDPolicy{Allow: []uuid.UUID{yubikey}}, uuid.Nil[:], false},
+		{"allowlist, missing AAGUID", AAGUIDPolicy{Allow: []uuid.UUID{yubikey}}, nil, false},
+		{"zero AAGUID allowed", AAGUIDPolicy{Allow: []uuid.UUID{uuid.Nil}}, nil, true},
+		{"deny wins", AAGUIDPolicy{Allow: []uuid.UUID{yubikey}, Deny: []uuid.UUID{yubikey}}, yubikey[:], false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Check(tt.aaguid)
+		if tt.ok && err != nil {
+			t.Errorf("%s: expected ok, got %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrAAGUIDNotAllowed) {
+			t.Errorf("%s: expected ErrAAGUIDNotAllowed, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseAAGUIDList(t *testing.T) {
+	ids, err := ParseAAGUIDList(" cb69481e-8ff7-4039-93ec-0a2729a154a8, fbfc3007-154e-4ecc-8c0b-6e020557d7bd ,")
+	if err != nil {
+		t.Fatalf("ParseAAGUIDList: %v", err)
+	}
+	if len(ids) != 2 || ids[1] != uuid.MustParse("fbfc3007-154e-4ecc-8c0b-6e020557d7bd") {
+		t.Fatalf("unexpected AAGUIDs %v", ids)
+	}
+	if ids, err := ParseAAGUIDList(""); err != nil || ids != nil {
+		t.Fatalf("expected an empty list, got %v, %v", ids, err)
+	}
+	if _, err := ParseAAGUIDList("yubikey"); err == nil {
+		t.Fatal("expected an error for a malformed AAGUID")
+	}
+}
+
+func TestRejectCredentialRecordsAudit(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	aaguid := uuid.MustParse("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")
+	cred := &webauthn.Credential{
+		ID:            []byte("cred-1"),
+		Authenticator: webauthn.Authenticator{AAGUID: aaguid[:]},
+	}
+
+	req := httptest.NewRequest("POST", "/api/auth/login/finish", nil)
+	req.RemoteAddr = "203.0.113.7:4321"
+	req.Header.Set("User-Agent", "test-agent")
+	w := httptest.NewRecorder()
+	app.rejectCredential(w, req, auditLoginRejected, user.ID, user.Name, cred, ErrAAGUIDNotAllowed, http.StatusUnauthorized)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["code"] != codeAAGUIDNotAllowed || body["error"] == "" {
+		t.Fatalf("unexpected response %v", body)
+	}
+
+	var (
+		event, reason, ip, userAgent string
+		userID                       sql.NullInt64
+		credID, storedAAGUID         []byte
+	)
+	err := app.db.QueryRow(`SELECT event, reason, user_id, credential_id, aaguid, ip, user_agent
+		FROM audit_events`).Scan(&event, &reason, &userID, &credID, &storedAAGUID, &ip, &userAgent)
+	if err != nil {
+		t.Fatalf("load audit event: %v", err)
+	}
+	if event != auditLoginRejected || reason != codeAAGUIDNotAllowed {
+		t.Fatalf("unexpected audit event %s/%s", event, reason)
+	}
+	if !userID.Valid || int(userID.Int64) != user.ID || string(credID) != "cred-1" || string(storedAAGUID) != string(aaguid[:]) {
+		t.Fatalf("audit event does not identify the credential: user %v credential %q", userID, credID)
+	}
+	if ip != "203.0.113.7" || userAgent != "test-agent" {
+		t.Fatalf("expected the client to be recorded, got %q %q", ip, userAgent)
+	}
+}
+
+func TestRejectCredentialForSignUp(t *testing.T) {
+	app := newTestApp(t)
+	cred := &webauthn.Credential{ID: []byte("cred-1")}
+
+	w := httptest.NewRecorder()
+	app.rejectCredential(w, httptest.NewRequest("POST", "/", nil), auditRegistrationRejected, 0, "bob", cred, ErrAttachmentNotAllowed, http.StatusBadRequest)
+
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusBadRequest || body["code"] != codeAttachmentNotAllowed {
+		t.Fatalf("unexpected response %d %v", w.Code, body)
+	}
+	var (
+		userID   sql.NullInt64
+		username string
+	)
+	if err := app.db.QueryRow("SELECT user_id, username FROM audit_events").Scan(&userID, &username); err != nil {
+		t.Fatalf("load audit event: %v", err)
+	}
+	if userID.Valid || username != "bob" {
+		t.Fatalf("expected a sign-up without user ID, got %v %q", userID, username)
+	}
+}
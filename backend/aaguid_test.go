@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func aaguidBytes(s string) []byte {
+	id := uuid.MustParse(s)
+	return id[:]
+}
+
+func TestAAGUIDRegistryBundled(t *testing.T) {
+	r := NewAAGUIDRegistry()
+
+	if name, ok := r.Name(aaguidBytes("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")); !ok || name != "iCloud Keychain" {
+		t.Fatalf("expected iCloud Keychain, got %q, %v", name, ok)
+	}
+	if _, ok := r.Name(make([]byte, 16)); ok {
+		t.Fatal("expected the zero AAGUID to be unknown")
+	}
+	if _, ok := r.Name([]byte("short")); ok {
+		t.Fatal("expected a malformed AAGUID to be unknown")
+	}
+}
+
+func TestAAGUIDRegistryLoadFile(t *testing.T) {
+	r := NewAAGUIDRegistry()
+	path := filepath.Join(t.TempDir(), "aaguid.json")
+	doc := `{
+		"11111111-2222-3333-4444-555555555555": {"name": "Example Key", "icon_light": "data:image/svg+xml;base64,AA=="},
+		"fbfc3007-154e-4ecc-8c0b-6e020557d7bd": {"name": "Apple Passwords"}
+	}`
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+
+	if name, _ := r.Name(aaguidBytes("11111111-2222-3333-4444-555555555555")); name != "Example Key" {
+		t.Fatalf("expected the new entry, got %q", name)
+	}
+	if name, _ := r.Name(aaguidBytes("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")); name != "Apple Passwords" {
+		t.Fatalf("expected the file to replace the bundled name, got %q", name)
+	}
+	if name, _ := r.Name(aaguidBytes("ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4")); name != "Google Password Manager" {
+		t.Fatalf("expected bundled entries to remain, got %q", name)
+	}
+
+	// A broken document changes nothing.
+	if err := r.Load([]byte(`{"66666666-6666-6666-6666-666666666666": {"name": "Half"}, "not-a-uuid": {"name": "Bad"}}`)); err == nil {
+		t.Fatal("expected an error for a malformed AAGUID")
+	}
+	if _, ok := r.Name(aaguidBytes("66666666-6666-6666-6666-666666666666")); ok {
+		t.Fatal("expected a failed load not to apply any entries")
+	}
+}
+
+func TestSaveCredentialStoresAuthenticatorName(t *testing.T) {
+	app := newTestApp(t)
+	user, err := app.saveUser("alice", "alice")
+	if err != nil {
+		t.Fatalf("saveUser: %v", err)
+	}
+
+	known := webauthn.Credential{
+		ID:            []byte("icloud"),
+		PublicKey:     []byte("key"),
+		Authenticator: webauthn.Authenticator{AAGUID: aaguidBytes("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")},
+	}
+	unknown := webauthn.Credential{
+		ID:            []byte("mystery-key"),
+		PublicKey:     []byte("key"),
+		Transport:     []protocol.AuthenticatorTransport{protocol.USB},
+		Authenticator: webauthn.Authenticator{AAGUID: aaguidBytes("11111111-2222-3333-4444-555555555555")},
+	}
+	for _, c := range []webauthn.Credential{known, unknown} {
+		if err := app.saveCredential(user.ID, c); err != nil {
+			t.Fatalf("saveCredential: %v", err)
+		}
+	}
+
+	passkeys, err := app.listPasskeys(user.ID)
+	if err != nil {
+		t.Fatalf("listPasskeys: %v", err)
+	}
+	if len(passkeys) != 2 {
+		t.Fatalf("expected 2 passkeys, got %d", len(passkeys))
+	}
+	if passkeys[0].AuthenticatorName != "iCloud Keychain" || passkeys[0].Name != "iCloud Keychain" {
+		t.Fatalf("expected the registry name, got %+v", passkeys[0])
+	}
+	if passkeys[1].AuthenticatorName != "Security key" {
+		t.Fatalf("expected a name derived from transports, got %+v", passkeys[1])
+	}
+
+	// Renaming changes the label, not the authenticator name.
+	if err := app.renamePasskey(user.ID, known.ID, "Work laptop"); err != nil {
+		t.Fatalf("renamePasskey: %v", err)
+	}
+	if name := app.storedAuthenticatorName(known); name != "iCloud Keychain" {
+		t.Fatalf("expected the stored authenticator name, got %q", name)
+	}
+}
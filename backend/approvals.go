@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// defaultApprovalTTL is how long a signed approval may be redeemed.
+	defaultApprovalTTL = 5 * time.Minute
+
+	// approvalTokenType is the typ header of signed approval records.
+	approvalTokenType = "approval+jwt"
+
+	// approvalHashPrefix separates approval hashes from any other use of
+	// SHA-256 over JSON.
+	approvalHashPrefix = "passkey-approval/v1\n"
+
+	maxApprovalRequestSize = 16 << 10
+	maxApprovalActionLen   = 64
+)
+
+var (
+	// ErrApprovalInvalid is returned for approval records that are malformed,
+	// forged, expired or for a different action.
+	ErrApprovalInvalid = errors.New("approval invalid")
+
+	// ErrApprovalUsed is returned when an approval was already redeemed, or
+	// its signature was already recorded.
+	ErrApprovalUsed = errors.New("approval already used")
+)
+
+// ApprovalDocument is what the user approves: an action, its payload, the
+// approving user and a server nonce naming this one approval. Its hash is
+// the WebAuthn challenge, so the passkey signature covers exactly this.
+type ApprovalDocument struct {
+	ID      string          `json:"nonce"`
+	Subject string          `json:"sub"`
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload"` // canonical JSON object
+}
+
+// canonicalJSON re-encodes a JSON value with object keys sorted, no
+// insignificant whitespace and numbers as written, so equal values always
+// hash the same.
+func canonicalJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Canonical returns the canonical JSON encoding of d.
+func (d *ApprovalDocument) Canonical() ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJSON(data)
+}
+
+// Hash returns the SHA-256 of the canonical document, which the user's
+// passkey signs as its challenge.
+func (d *ApprovalDocument) Hash() ([]byte, error) {
+	canonical, err := d.Canonical()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte(approvalHashPrefix), canonical...))
+	return sum[:], nil
+}
+
+// ApprovalClaims are the claims of a signed approval record. Services that
+// act on it verify the signature against the JWKS and redeem it once.
+type ApprovalClaims struct {
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload"`
+	// Hash (base64url) is the challenge the passkey signed, and
+	// CredentialID (base64url) the passkey that signed it.
+	Hash         string `json:"hash"`
+	CredentialID string `json:"cid"`
+	jwt.RegisteredClaims
+}
+
+// signApproval issues the signed record of an approval made at approvedAt.
+func (t *TokenService) signApproval(doc *ApprovalDocument, hash, credentialID []byte, approvedAt, expiresAt time.Time) (string, error) {
+	key, err := t.keys.signingKey(approvedAt)
+	if err != nil {
+		return "", err
+	}
+	return sign(key, approvalTokenType, &ApprovalClaims{
+		Action:       doc.Action,
+		Payload:      doc.Payload,
+		Hash:         base64.RawURLEncoding.EncodeToString(hash),
+		CredentialID: encodeCredentialID(credentialID),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.issuer,
+			Subject:   doc.Subject,
+			IssuedAt:  jwt.NewNumericDate(approvedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        doc.ID,
+		},
+	})
+}
+
+// verifyApproval checks the signature, issuer and expiry of an approval record.
+func (t *TokenService) verifyApproval(record string) (*ApprovalClaims, error) {
+	claims := &ApprovalClaims{}
+	_, err := jwt.ParseWithClaims(record, claims, t.keyFunc(approvalTokenType),
+		jwt.WithValidMethods([]string{string(SigningEdDSA), string(SigningES256)}),
+		jwt.WithIssuer(t.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// approvalOptions is the approvalBegin response: the WebAuthn request
+// options, the ceremony ID and the document the challenge was derived from.
+type approvalOptions struct {
+	*protocol.CredentialAssertion
+	CeremonyID string          `json:"ceremonyId"`
+	Approval   approvalPreview `json:"approval"`
+}
+
+type approvalPreview struct {
+	ID       string `json:"id"`
+	Document string `json:"document"` // canonical JSON of the ApprovalDocument
+	Hash     string `json:"hash"`     // base64url challenge
+}
+
+// approvalBegin starts an approval ceremony for {"action", "payload"}. The
+// response carries the assertion options, whose challenge is the hash of the
+// returned canonical document, so the client can show and check what the
+// user is about to sign.
+func (a *App) approvalBegin(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+
+	var req struct {
+		Action  string          `json:"action"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxApprovalRequestSize)).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" || len(req.Action) > maxApprovalActionLen {
+		jsonError(w, "Action required", http.StatusBadRequest)
+		return
+	}
+	payload, err := canonicalJSON(req.Payload)
+	if err != nil || payload[0] != '{' {
+		jsonError(w, "Payload must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	if len(user.Credentials) == 0 {
+		jsonError(w, "A passkey is required to approve actions", http.StatusBadRequest)
+		return
+	}
+
+	nonce, err := randomID(16)
+	if err != nil {
+		log.Printf("randomID error: %v", err)
+		jsonError(w, "Failed to start approval", http.StatusInternalServerError)
+		return
+	}
+	doc := &ApprovalDocument{ID: nonce, Subject: user.Subject(), Action: req.Action, Payload: payload}
+	canonical, err := doc.Canonical()
+	if err != nil {
+		log.Printf("canonical approval error: %v", err)
+		jsonError(w, "Failed to start approval", http.StatusInternalServerError)
+		return
+	}
+	hash, _ := doc.Hash()
+
+	options, session, err := a.webAuthn.BeginLogin(user,
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		webauthn.WithChallenge(hash))
+	if err != nil {
+		log.Printf("BeginLogin error: %v", err)
+		jsonError(w, "Failed to start approval", http.StatusInternalServerError)
+		return
+	}
+	ceremonyID, err := a.beginCeremony(&Ceremony{Kind: ceremonyApproval, Session: *session, Approval: doc}, a.ceremonyTTL)
+	if err != nil {
+		log.Printf("beginCeremony error: %v", err)
+		jsonError(w, "Failed to start ceremony", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, approvalOptions{
+		CredentialAssertion: options,
+		CeremonyID:          ceremonyID,
+		Approval: approvalPreview{
+			ID:       doc.ID,
+			Document: string(canonical),
+			Hash:     base64.RawURLEncoding.EncodeToString(hash),
+		},
+	})
+}
+
+// approvalFinish verifies the passkey assertion over the approval document,
+// records it and returns the signed approval record.
+func (a *App) approvalFinish(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+	ceremony := a.takeCeremony(w, r, ceremonyApproval)
+	if ceremony == nil {
+		return
+	}
+	doc := ceremony.Approval
+	if doc == nil || doc.Subject != user.Subject() || !bytes.Equal(ceremony.Session.UserID, user.Handle) {
+		jsonError(w, "Session not found", http.StatusBadRequest)
+		return
+	}
+	hash, err := doc.Hash()
+	if err != nil || base64.RawURLEncoding.EncodeToString(hash) != ceremony.Session.Challenge {
+		log.Printf("approval %s: challenge does not match its document", doc.ID)
+		jsonError(w, "Session not found", http.StatusBadRequest)
+		return
+	}
+
+	parsed, credential, err := a.validateAssertion(user, ceremony.Session, r)
+	if err != nil {
+		log.Printf("ValidateLogin error: %v", err)
+		jsonErrorCode(w, codeVerificationFailed, "Passkey verification failed", http.StatusUnauthorized)
+		return
+	}
+	if !a.acceptAssertion(w, r, user, credential) {
+		return
+	}
+
+	approvedAt := time.Now().UTC()
+	expiresAt := approvedAt.Add(a.approvalTTL)
+	assertion := parsed.Raw.AssertionResponse
+	_, err = a.db.Exec(`INSERT INTO approvals
+		(id, user_id, action, payload, payload_hash, credential_id, authenticator_data, client_data_json, signature, approved_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		doc.ID, user.ID, doc.Action, string(doc.Payload), hash, credential.ID,
+		[]byte(assertion.AuthenticatorData), []byte(assertion.ClientDataJSON), []byte(assertion.Signature), approvedAt, expiresAt)
+	if isUniqueViolation(err) {
+		jsonErrorCode(w, codeApprovalUsed, "Approval already recorded", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("insert approval error: %v", err)
+		jsonError(w, "Failed to record approval", http.StatusInternalServerError)
+		return
+	}
+
+	record, err := a.tokens.signApproval(doc, hash, credential.ID, approvedAt, expiresAt)
+	if err != nil {
+		log.Printf("signApproval error: %v", err)
+		jsonError(w, "Failed to sign approval", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]any{
+		"status":    "ok",
+		"id":        doc.ID,
+		"approval":  record,
+		"expiresAt": expiresAt,
+	})
+}
+
+// redeemApproval verifies an approval record for action and marks it used on
+// behalf of user, who must be the one that gave it. Each approval can be
+// redeemed once, before it expires.
+func (a *App) redeemApproval(user *User, record, action string) (*ApprovalClaims, error) {
+	claims, err := a.tokens.verifyApproval(record)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrApprovalInvalid, err)
+	}
+	if claims.Action != action {
+		return nil, fmt.Errorf("%w: approval is for %q", ErrApprovalInvalid, claims.Action)
+	}
+	if claims.Subject != user.Subject() {
+		return nil, fmt.Errorf("%w: approval belongs to another user", ErrApprovalInvalid)
+	}
+
+	now := time.Now().UTC()
+	res, err := a.db.Exec(`UPDATE approvals SET redeemed_at = ?
+		WHERE id = ? AND user_id = ? AND redeemed_at IS NULL AND expires_at > ?`,
+		now, claims.ID, user.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var redeemedAt sql.NullTime
+		err := a.db.QueryRow("SELECT redeemed_at FROM approvals WHERE id = ? AND user_id = ?", claims.ID, user.ID).Scan(&redeemedAt)
+		if err == nil && redeemedAt.Valid {
+			return nil, ErrApprovalUsed
+		}
+		return nil, ErrApprovalInvalid
+	}
+	return claims, nil
+}
+
+// redeemApprovalHandler redeems the current user's approval record for an
+// action ({"approval", "action"}) and returns what was approved. The service
+// performing the action calls it with the user's credentials, so a leaked
+// record cannot be spent by anyone else.
+func (a *App) redeemApprovalHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+
+	var req struct {
+		Approval string `json:"approval"`
+		Action   string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Approval == "" || req.Action == "" {
+		jsonError(w, "Approval and action required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := a.redeemApproval(user, req.Approval, req.Action)
+	switch {
+	case errors.Is(err, ErrApprovalUsed):
+		jsonErrorCode(w, codeApprovalUsed, "Approval already used", http.StatusConflict)
+		return
+	case errors.Is(err, ErrApprovalInvalid):
+		log.Printf("redeemApproval: %v", err)
+		jsonErrorCode(w, codeApprovalInvalid, "Invalid approval", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("redeemApproval error: %v", err)
+		jsonError(w, "Failed to redeem approval", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]any{
+		"status":       "ok",
+		"id":           claims.ID,
+		"sub":          claims.Subject,
+		"action":       claims.Action,
+		"payload":      claims.Payload,
+		"credentialId": claims.CredentialID,
+		"approvedAt":   claims.IssuedAt.Time,
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveApprovals routes the approval endpoints as main does.
+func serveApprovals(app *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/approvals/begin", app.RequireAuth(http.HandlerFunc(app.approvalBegin)))
+	mux.Handle("POST /api/approvals/finish", app.RequireAuth(http.HandlerFunc(app.approvalFinish)))
+	mux.Handle("POST /api/approvals/redeem", app.RequireAuth(http.HandlerFunc(app.redeemApprovalHandler)))
+	return mux
+}
+
+// beginApproval starts an approval of payload and returns the raw response
+// and its decoded form.
+func beginApproval(t *testing.T, h http.Handler, payload string, authorize func(*http.Request)) ([]byte, approvalOptions) {
+	t.Helper()
+	w := postWith(h, "/api/approvals/begin", []byte(`{"action": "payment", "payload": `+payload+`}`), authorize)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approval begin: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var opts approvalOptions
+	json.Unmarshal(w.Body.Bytes(), &opts)
+	return w.Body.Bytes(), opts
+}
+
+func redeemWith(t *testing.T, h http.Handler, record, action string, authorize func(*http.Request)) (int, map[string]any) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"approval": record, "action": action})
+	w := postWith(h, "/api/approvals/redeem", body, authorize)
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	got, err := canonicalJSON([]byte(` {"b": [1, 2.50, "x<y"], "a": {"d": true, "c": null}} `))
+	if err != nil {
+		t.Fatalf("canonicalJSON: %v", err)
+	}
+	if want := `{"a":{"c":null,"d":true},"b":[1,2.50,"x<y"]}`; string(got) != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if _, err := canonicalJSON([]byte(`{"a":1} {"b":2}`)); err == nil {
+		t.Fatal("expected an error for trailing data")
+	}
+}
+
+func TestApprovalFlow(t *testing.T) {
+	app := newTestApp(t)
+	h := serveApprovals(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	raw, opts := beginApproval(t, h, `{"recipient": "bob", "amount": "10.00", "currency": "EUR"}`, withCookie)
+	doc := `{"action":"payment","nonce":"` + opts.Approval.ID + `","payload":{"amount":"10.00","currency":"EUR","recipient":"bob"},"sub":"` + user.Subject() + `"}`
+	if opts.Approval.Document != doc {
+		t.Fatalf("unexpected document %s", opts.Approval.Document)
+	}
+	sum := sha256.Sum256([]byte(approvalHashPrefix + doc))
+	if challenge := base64.RawURLEncoding.EncodeToString(sum[:]); opts.Response.Challenge.String() != challenge || opts.Approval.Hash != challenge {
+		t.Fatalf("expected the challenge to be the document hash %s, got %s", challenge, opts.Response.Challenge)
+	}
+
+	w := postWith(h, "/api/approvals/finish?ceremony="+opts.CeremonyID, authenticator.assert(t, raw, user.Handle), withCookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approval finish: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	record := resp["approval"].(string)
+
+	claims, err := app.tokens.verifyApproval(record)
+	if err != nil {
+		t.Fatalf("verifyApproval: %v", err)
+	}
+	if claims.ID != opts.Approval.ID || claims.Subject != user.Subject() || claims.Hash != opts.Approval.Hash ||
+		string(claims.Payload) != `{"amount":"10.00","currency":"EUR","recipient":"bob"}` {
+		t.Fatalf("unexpected approval claims %+v", claims)
+	}
+	if _, err := app.tokens.Verify(record); err == nil {
+		t.Fatal("expected an approval record not to pass as an access token")
+	}
+
+	var signature []byte
+	app.db.QueryRow("SELECT signature FROM approvals WHERE id = ?", claims.ID).Scan(&signature)
+	if len(signature) == 0 {
+		t.Fatal("expected the assertion to be stored as evidence")
+	}
+
+	if code, resp := redeemWith(t, h, record, "transfer", withCookie); code != http.StatusBadRequest || resp["code"] != codeApprovalInvalid {
+		t.Fatalf("expected an approval for another action to be refused, got %d: %v", code, resp)
+	}
+	if code, resp := redeemWith(t, h, record, "payment", withCookie); code != http.StatusOK || resp["payload"].(map[string]any)["recipient"] != "bob" {
+		t.Fatalf("expected the approval to redeem, got %d: %v", code, resp)
+	}
+	if code, resp := redeemWith(t, h, record, "payment", withCookie); code != http.StatusConflict || resp["code"] != codeApprovalUsed {
+		t.Fatalf("expected a second redeem to be refused, got %d: %v", code, resp)
+	}
+}
+
+func TestApprovalRedeemedOnlyByItsOwner(t *testing.T) {
+	app := newTestApp(t)
+	h := serveApprovals(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+	mallory, _ := seedPasskeyUser(t, app, "mallory", "cred-m")
+	otherCookie, _ := sessionCookie(t, app, mallory, amrHardwareKey, 0)
+
+	raw, opts := beginApproval(t, h, `{"recipient": "bob", "amount": "10.00"}`, withCookie)
+	w := postWith(h, "/api/approvals/finish?ceremony="+opts.CeremonyID, authenticator.assert(t, raw, user.Handle), withCookie)
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	record := resp["approval"].(string)
+
+	if code, _ := redeemWith(t, h, record, "payment", func(*http.Request) {}); code != http.StatusUnauthorized {
+		t.Fatalf("expected an anonymous redeem to be refused, got %d", code)
+	}
+	if code, resp := redeemWith(t, h, record, "payment", func(r *http.Request) { r.AddCookie(otherCookie) }); code != http.StatusBadRequest || resp["code"] != codeApprovalInvalid {
+		t.Fatalf("expected another user's redeem to be refused, got %d: %v", code, resp)
+	}
+	if code, resp := redeemWith(t, h, record, "payment", withCookie); code != http.StatusOK {
+		t.Fatalf("expected the owner to redeem the approval, got %d: %v", code, resp)
+	}
+}
+
+func TestApprovalWithLegacyHandle(t *testing.T) {
+	app := newTestApp(t)
+	h := serveApprovals(app)
+	user, authenticator, legacy := seedLegacyAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	raw, opts := beginApproval(t, h, `{"recipient": "bob", "amount": "10.00"}`, withCookie)
+	w := postWith(h, "/api/approvals/finish?ceremony="+opts.CeremonyID, authenticator.assert(t, raw, legacy), withCookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approval finish: expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestApprovalBindsAssertionToDocument(t *testing.T) {
+	app := newTestApp(t)
+	h := serveApprovals(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	_, small := beginApproval(t, h, `{"recipient": "bob", "amount": "1.00"}`, withCookie)
+	large, _ := beginApproval(t, h, `{"recipient": "mallory", "amount": "1000.00"}`, withCookie)
+
+	// An assertion over one document cannot finish the approval of another.
+	w := postWith(h, "/api/approvals/finish?ceremony="+small.CeremonyID, authenticator.assert(t, large, user.Handle), withCookie)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestApprovalCannotBeRecordedTwice(t *testing.T) {
+	app := newTestApp(t)
+	h := serveApprovals(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	raw, opts := beginApproval(t, h, `{"recipient": "bob", "amount": "10.00"}`, withCookie)
+	ceremony, err := app.ceremonies.Get(opts.CeremonyID)
+	if err != nil {
+		t.Fatalf("Get ceremony: %v", err)
+	}
+	assertion := authenticator.assert(t, raw, user.Handle)
+	if w := postWith(h, "/api/approvals/finish?ceremony="+opts.CeremonyID, assertion, withCookie); w.Code != http.StatusOK {
+		t.Fatalf("approval finish: expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// Even if the ceremony came back, say from a restored ceremony store,
+	// the same signed approval is not recorded again.
+	app.ceremonies.Set(opts.CeremonyID, ceremony, time.Minute)
+	w := postWith(h, "/api/approvals/finish?ceremony="+opts.CeremonyID, assertion, withCookie)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusConflict || resp["code"] != codeApprovalUsed {
+		t.Fatalf("expected the replay to be refused, got %d: %v", w.Code, resp)
+	}
+}
+
+func TestApprovalExpires(t *testing.T) {
+	app := newTestApp(t, WithApprovalTTL(time.Second))
+	h := serveApprovals(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	raw, opts := beginApproval(t, h, `{"recipient": "bob", "amount": "10.00"}`, withCookie)
+	w := postWith(h, "/api/approvals/finish?ceremony="+opts.CeremonyID, authenticator.assert(t, raw, user.Handle), withCookie)
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	app.db.Exec("UPDATE approvals SET expires_at = ?", time.Now().UTC().Add(-time.Minute))
+	if code, resp := redeemWith(t, h, resp["approval"].(string), "payment", withCookie); code != http.StatusBadRequest || resp["code"] != codeApprovalInvalid {
+		t.Fatalf("expected an expired approval to be refused, got %d: %v", code, resp)
+	}
+}
+
+func TestApprovalBeginRejectsInvalidPayload(t *testing.T) {
+	app := newTestApp(t)
+	h := serveApprovals(app)
+	user, _ := seedAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, 0)
+
+	for _, body := range []string{
+		`{"action": "payment", "payload": [1, 2]}`,
+		`{"action": "payment"}`,
+		`{"payload": {"amount": "1"}}`,
+	} {
+		if w := postWith(h, "/api/approvals/begin", []byte(body), func(r *http.Request) { r.AddCookie(cookie) }); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Audit event kinds.
+const (
+	auditRegistrationRejected = "registration_rejected"
+	auditLoginRejected        = "login_rejected"
+	auditRefreshRejected      = "refresh_rejected"
+)
+
+// auditEvent is one row of the audit_events table. Reason is the error code
+// the client was sent.
+type auditEvent struct {
+	Event    string
+	Reason   string
+	UserID   int // 0 for a sign-up refused before the account exists
+	Username string
+	Cred     *webauthn.Credential
+}
+
+// recordAudit stores e along with the client address of r. Failing to write
+// the audit log does not change the outcome of the request, so errors are
+// only logged.
+func (a *App) recordAudit(r *http.Request, e auditEvent) {
+	var userID sql.NullInt64
+	if e.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(e.UserID), Valid: true}
+	}
+	var credID, aaguid []byte
+	if e.Cred != nil {
+		credID, aaguid = e.Cred.ID, e.Cred.Authenticator.AAGUID
+	}
+	_, err := a.db.Exec(`INSERT INTO audit_events
+		(created_at, event, reason, user_id, username, credential_id, aaguid, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC(), e.Event, e.Reason, userID, e.Username, credID, aaguid, a.clientIP(r), r.UserAgent())
+	if err != nil {
+		log.Printf("record audit event %s/%s: %v", e.Event, e.Reason, err)
+	}
+}
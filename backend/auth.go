@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AuthContext describes how the user behind a request authenticated.
+type AuthContext struct {
+	Method       string    // amr value: amrHardwareKey or amrPassword
+	Time         time.Time // when the user authenticated
+	CredentialID []byte    // the passkey used, nil for a password login
+	SessionID    string    // the login session, if known
+	Bearer       bool      // authenticated by access token rather than session cookie
+}
+
+// sessionAuthContext is the AuthContext of a request carrying the cookie of s.
+func sessionAuthContext(s *LoginSession) AuthContext {
+	return AuthContext{
+		Method:       s.AuthMethod,
+		Time:         s.AuthTime,
+		CredentialID: s.CredentialID,
+		SessionID:    s.ID,
+	}
+}
+
+// authenticate resolves the user behind a request from its session cookie
+// or, failing that, its bearer access token.
+func (a *App) authenticate(r *http.Request) (*User, *AuthContext, error) {
+	if s, user, err := a.currentSession(r); err == nil {
+		auth := sessionAuthContext(s)
+		return user, &auth, nil
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, nil, ErrSessionNotFound
+	}
+	claims, err := a.tokens.Verify(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := a.getUserBySubject(claims.Subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	// An access token lives no longer than the login it was issued for, so
+	// logging out or resetting the password also ends bearer access.
+	if claims.SessionID == "" {
+		return nil, nil, ErrSessionNotFound
+	}
+	s, err := a.getLoginSessionByID(claims.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.UserID != user.ID {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	auth := &AuthContext{SessionID: claims.SessionID, Bearer: true}
+	if len(claims.AMR) > 0 {
+		auth.Method = claims.AMR[0]
+	}
+	switch {
+	case claims.AuthTime != nil:
+		auth.Time = claims.AuthTime.Time
+	case claims.IssuedAt != nil:
+		auth.Time = claims.IssuedAt.Time
+	}
+	if claims.CredentialID != "" {
+		auth.CredentialID, _ = decodeCredentialID(claims.CredentialID)
+	}
+	return user, auth, nil
+}
+
+type requestAuthKey struct{}
+
+type requestAuthInfo struct {
+	user *User
+	auth *AuthContext
+}
+
+// RequireAuth rejects requests that carry neither a live session cookie nor
+// a valid bearer token. Handlers behind it get the user and how they
+// authenticated from requestUser.
+func (a *App) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, auth, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			jsonError(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), requestAuthKey{}, requestAuthInfo{user: user, auth: auth})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestUser returns the user and auth context stored by RequireAuth. It
+// panics if the handler is not behind RequireAuth, which is a wiring bug.
+func requestUser(r *http.Request) (*User, *AuthContext) {
+	info, ok := r.Context().Value(requestAuthKey{}).(requestAuthInfo)
+	if !ok {
+		panic("requestUser called outside RequireAuth")
+	}
+	return info.user, info.auth
+}
+
+// meHandler returns the current user's profile, their passkeys and how they
+// authenticated for this request.
+func (a *App) meHandler(w http.ResponseWriter, r *http.Request) {
+	user, auth := requestUser(r)
+
+	passkeys, err := a.listPasskeys(user.ID)
+	if err != nil {
+		log.Printf("listPasskeys error: %v", err)
+		jsonError(w, "Failed to load account", http.StatusInternalServerError)
+		return
+	}
+	passwordHash, err := a.getPasswordHash(user.ID)
+	if err != nil {
+		log.Printf("getPasswordHash error: %v", err)
+		jsonError(w, "Failed to load account", http.StatusInternalServerError)
+		return
+	}
+
+	via := "session"
+	if auth.Bearer {
+		via = "bearer"
+	}
+	authResp := map[string]any{
+		"method": auth.Method,
+		"time":   auth.Time,
+		"via":    via,
+	}
+	if auth.CredentialID != nil {
+		authResp["credentialId"] = encodeCredentialID(auth.CredentialID)
+	}
+
+	jsonResponse(w, map[string]any{
+		"user": map[string]any{
+			"username":    user.Name,
+			"displayName": user.DisplayName,
+			"hasPassword": passwordHash != "",
+		},
+		"passkeys": passkeys,
+		"auth":     authResp,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getMe calls /api/me through RequireAuth with the credentials set by
+// authorize and returns the status and decoded body.
+func getMe(t *testing.T, app *App, authorize func(*http.Request)) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	authorize(req)
+	w := httptest.NewRecorder()
+	app.RequireAuth(http.HandlerFunc(app.meHandler)).ServeHTTP(w, req)
+
+	var body map[string]any
+	json.NewDecoder(w.Body).Decode(&body)
+	return w.Code, body
+}
+
+func TestRequireAuthRejectsAnonymousRequests(t *testing.T) {
+	app := newTestApp(t)
+
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	w := httptest.NewRecorder()
+	app.RequireAuth(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Fatal("handler called without authentication")
+	})).ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatal("expected a WWW-Authenticate challenge")
+	}
+
+	code, _ := getMe(t, app, func(r *http.Request) { r.Header.Set("Authorization", "Bearer not-a-token") })
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an invalid token, got %d", code)
+	}
+}
+
+func TestMeWithSessionCookie(t *testing.T) {
+	app := newTestApp(t)
+	_, cookie := seedPasskeyUser(t, app, "alice", "cred-1", "cred-2")
+
+	code, body := getMe(t, app, func(r *http.Request) { r.AddCookie(cookie) })
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+	user := body["user"].(map[string]any)
+	if user["username"] != "alice" || user["hasPassword"] != false {
+		t.Fatalf("unexpected user %v", user)
+	}
+	if passkeys := body["passkeys"].([]any); len(passkeys) != 2 {
+		t.Fatalf("expected 2 passkeys, got %d", len(passkeys))
+	}
+	auth := body["auth"].(map[string]any)
+	if auth["method"] != amrHardwareKey || auth["via"] != "session" || auth["credentialId"] != encodeCredentialID([]byte("cred-1")) {
+		t.Fatalf("unexpected auth context %v", auth)
+	}
+}
+
+func TestMeWithBearerToken(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "carol@example.com", "password")
+	authTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_, sessionID := sessionCookie(t, app, user, amrPassword, time.Hour)
+	token, _, err := app.tokens.Issue(user, AuthContext{Method: amrPassword, Time: authTime, SessionID: sessionID})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	code, body := getMe(t, app, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) })
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, body)
+	}
+	if user := body["user"].(map[string]any); user["hasPassword"] != true {
+		t.Fatalf("unexpected user %v", user)
+	}
+	auth := body["auth"].(map[string]any)
+	if auth["method"] != amrPassword || auth["via"] != "bearer" {
+		t.Fatalf("unexpected auth context %v", auth)
+	}
+	if _, ok := auth["credentialId"]; ok {
+		t.Fatal("expected no credential for a password login")
+	}
+	if got, _ := time.Parse(time.RFC3339, auth["time"].(string)); !got.Equal(authTime) {
+		t.Fatalf("expected the original auth time %s, got %v", authTime, auth["time"])
+	}
+}
+
+func TestMeRejectsBearerTokenOfEndedSession(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "carol@example.com", "password")
+	cookie, sessionID := sessionCookie(t, app, user, amrPassword, 0)
+	token, _, _ := app.tokens.Issue(user, AuthContext{Method: amrPassword, Time: time.Now(), SessionID: sessionID})
+	sessionless, _, _ := app.tokens.Issue(user, AuthContext{Method: amrPassword, Time: time.Now()})
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	if code, _ := getMe(t, app, bearer(sessionless)); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a token without a session, got %d", code)
+	}
+	if code, _ := getMe(t, app, bearer(token)); code != http.StatusOK {
+		t.Fatalf("expected 200 while the session is live, got %d", code)
+	}
+	if err := app.revokeLoginSession(cookie.Value); err != nil {
+		t.Fatalf("revokeLoginSession: %v", err)
+	}
+	if code, _ := getMe(t, app, bearer(token)); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after logout, got %d", code)
+	}
+}
+
+func TestRequireAuthRejectsLoggedOutSession(t *testing.T) {
+	app := newTestApp(t)
+	_, cookie := seedPasskeyUser(t, app, "alice", "cred-1")
+	app.db.Exec("UPDATE sessions SET revoked_at = ?", time.Now().UTC())
+
+	if code, _ := getMe(t, app, func(r *http.Request) { r.AddCookie(cookie) }); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after logout, got %d", code)
+	}
+}
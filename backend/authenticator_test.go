@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// testAuthenticator is a software passkey producing ES256 assertions the
+// WebAuthn library accepts for the test app's relying party.
+type testAuthenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T, id string) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return &testAuthenticator{id: []byte(id), key: key}
+}
+
+// credential returns the credential to store for the authenticator.
+func (a *testAuthenticator) credential() webauthn.Credential {
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.PublicKey.X.FillBytes(x)
+	a.key.PublicKey.Y.FillBytes(y)
+	// COSE_Key map {1: 2 (EC2), 3: -7 (ES256), -1: 1 (P-256), -2: x, -3: y}.
+	cose := append([]byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}, x...)
+	cose = append(append(cose, 0x22, 0x58, 0x20), y...)
+	return webauthn.Credential{
+		ID:        a.id,
+		PublicKey: cose,
+		Flags:     webauthn.CredentialFlags{UserPresent: true, UserVerified: true},
+	}
+}
+
+// assert answers the challenge of options, a loginOptions response, with a
+// user-verified assertion and returns the request body for a finish endpoint.
+func (a *testAuthenticator) assert(t *testing.T, options []byte, userHandle []byte) []byte {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil || opts.PublicKey.Challenge == "" {
+		t.Fatalf("no challenge in options %s: %v", options, err)
+	}
+
+	clientData, _ := json.Marshal(map[string]any{
+		"type":        "webauthn.get",
+		"challenge":   opts.PublicKey.Challenge,
+		"origin":      "http://localhost:3000",
+		"crossOrigin": false,
+	})
+	a.signCount++
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	authData := append(rpIDHash[:], 0x05) // user present, user verified
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("sign assertion: %v", err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": b64(authData),
+			"clientDataJSON":    b64(clientData),
+			"signature":         b64(sig),
+			"userHandle":        b64(userHandle),
+		},
+	})
+	return body
+}
+
+// seedAuthenticatorUser creates a user whose only passkey is a new test
+// authenticator.
+func seedAuthenticatorUser(t *testing.T, app *App, username string) (*User, *testAuthenticator) {
+	t.Helper()
+	user, err := app.saveUser(username, username)
+	if err != nil {
+		t.Fatalf("saveUser: %v", err)
+	}
+	authenticator := newTestAuthenticator(t, "cred-"+username)
+	if err := app.saveCredential(user.ID, authenticator.credential()); err != nil {
+		t.Fatalf("saveCredential: %v", err)
+	}
+	user.Credentials = app.getCredentialsForUser(user.ID)
+	return user, authenticator
+}
+
+// seedLegacyAuthenticatorUser is seedAuthenticatorUser for an account from
+// before random user handles, whose passkey asserts the numeric legacy
+// handle it returns.
+func seedLegacyAuthenticatorUser(t *testing.T, app *App, username string) (*User, *testAuthenticator, []byte) {
+	t.Helper()
+	user, authenticator := seedAuthenticatorUser(t, app, username)
+	legacy := []byte(strconv.Itoa(user.ID))
+	if _, err := app.db.Exec("UPDATE users SET legacy_handle = ? WHERE id = ?", legacy, user.ID); err != nil {
+		t.Fatalf("set legacy handle: %v", err)
+	}
+	return user, authenticator, legacy
+}
+
+func TestUsernameLoginWithLegacyHandle(t *testing.T) {
+	app := newTestApp(t)
+	_, authenticator, legacy := seedLegacyAuthenticatorUser(t, app, "alice")
+
+	w := httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin", strings.NewReader(`{"username": "alice"}`)))
+	var begin loginOptions
+	json.Unmarshal(w.Body.Bytes(), &begin)
+
+	body := authenticator.assert(t, w.Body.Bytes(), legacy)
+	req := httptest.NewRequest("POST", "/api/auth/login/finish?ceremony="+begin.CeremonyID, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	app.loginFinish(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginWithTestAuthenticator(t *testing.T) {
+	app := newTestApp(t)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+
+	w := httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin", nil))
+	var begin loginOptions
+	json.Unmarshal(w.Body.Bytes(), &begin)
+
+	body := authenticator.assert(t, w.Body.Bytes(), user.Handle)
+	req := httptest.NewRequest("POST", "/api/auth/login/finish?ceremony="+begin.CeremonyID, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	app.loginFinish(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
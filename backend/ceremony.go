@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ceremonyParam is the query parameter finish endpoints read the ceremony ID from.
+const ceremonyParam = "ceremony"
+
+const (
+	// defaultCeremonyTTL bounds how long a challenge stays valid when the
+	// SessionData carries no expiry of its own.
+	defaultCeremonyTTL = 5 * time.Minute
+
+	// defaultConditionalCeremonyTTL is the lifetime of conditional
+	// mediation (autofill) login challenges, which wait for the user while
+	// the login page stays open.
+	defaultConditionalCeremonyTTL = 15 * time.Minute
+
+	// defaultSweepInterval is how often expired ceremonies are evicted.
+	defaultSweepInterval = time.Minute
+)
+
+// Ceremony kinds, recorded so a challenge issued by one begin endpoint cannot
+// be redeemed at another endpoint's finish.
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	ceremonyReauth       = "reauth"
+	ceremonyApproval     = "approval"
+)
+
+// ErrCeremonyNotFound is returned when a ceremony does not exist or has expired.
+var ErrCeremonyNotFound = errors.New("ceremony not found")
+
+// Ceremony is the server-side state of one pending begin/finish exchange.
+type Ceremony struct {
+	Kind    string               `json:"kind"`
+	Session webauthn.SessionData `json:"session"`
+
+	// PendingUser is set for sign-up registrations. The account is only
+	// written to the database once the ceremony finishes successfully.
+	PendingUser *PendingUser `json:"pendingUser,omitempty"`
+
+	// Upgrade marks a registration begun from the post-password-login
+	// passkey upgrade flow.
+	Upgrade bool `json:"upgrade,omitempty"`
+
+	// Approval is the action an approval ceremony asks the user to sign.
+	Approval *ApprovalDocument `json:"approval,omitempty"`
+}
+
+// PendingUser is an account that exists only inside a registration ceremony.
+type PendingUser struct {
+	Handle      []byte `json:"handle"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// User returns the in-memory user the registration is performed for.
+func (p *PendingUser) User() *User {
+	return &User{Handle: p.Handle, Name: p.Name, DisplayName: p.DisplayName}
+}
+
+// CeremonyStore holds pending ceremonies between their begin and finish calls.
+// Implementations must be safe for concurrent use.
+type CeremonyStore interface {
+	// Set stores c under key. The entry expires at c.Session.Expires or
+	// after ttl, whichever comes first.
+	Set(key string, c *Ceremony, ttl time.Duration) error
+
+	// Get returns the ceremony stored under key without removing it.
+	Get(key string) (*Ceremony, error)
+
+	// Take atomically returns and removes the ceremony stored under key, so
+	// concurrent callers can never both redeem the same challenge.
+	Take(key string) (*Ceremony, error)
+
+	// Delete removes the ceremony stored under key, if any.
+	Delete(key string) error
+
+	// Sweep removes all expired ceremonies and returns how many were removed.
+	Sweep() (int, error)
+}
+
+// registrationOptions is the registerBegin response: the WebAuthn creation
+// options plus the ID the client must pass back to registerFinish.
+type registrationOptions struct {
+	*protocol.CredentialCreation
+	CeremonyID string `json:"ceremonyId"`
+}
+
+// loginOptions is the loginBegin response: the WebAuthn request options plus
+// the ID the client must pass back to loginFinish.
+type loginOptions struct {
+	*protocol.CredentialAssertion
+	CeremonyID string `json:"ceremonyId"`
+}
+
+// newCeremonyID returns an unguessable key for one begin/finish ceremony.
+func newCeremonyID() (string, error) {
+	return randomID(32)
+}
+
+// ceremonyExpiry returns when an entry stored at now with ttl should expire.
+func ceremonyExpiry(c *Ceremony, now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		ttl = defaultCeremonyTTL
+	}
+	expires := now.Add(ttl)
+	if !c.Session.Expires.IsZero() && c.Session.Expires.Before(expires) {
+		expires = c.Session.Expires
+	}
+	return expires
+}
+
+// startSweeper runs store.Sweep every interval in a background goroutine.
+// The returned function stops the sweeper and waits for it to exit.
+func startSweeper(store CeremonyStore, interval time.Duration) (stop func()) {
+	return runEvery(interval, func() {
+		if _, err := store.Sweep(); err != nil {
+			log.Printf("sweep ceremonies: %v", err)
+		}
+	})
+}
+
+// runEvery calls fn every interval in a background goroutine. The returned
+// function stops it and waits for a running call to finish; it is safe to
+// call more than once.
+func runEvery(interval time.Duration, fn func()) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultMaxCeremonies caps the number of pending ceremonies a store keeps.
+const defaultMaxCeremonies = 10000
+
+// MemoryCeremonyStore is a thread-safe in-memory CeremonyStore. Once the
+// store holds capacity entries the least recently used one is evicted to
+// make room for a new ceremony. It only works for a single replica.
+type MemoryCeremonyStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List // front is most recently used
+	now      func() time.Time
+}
+
+type memoryEntry struct {
+	key      string
+	ceremony *Ceremony
+	expires  time.Time
+}
+
+// NewMemoryCeremonyStore creates a new empty MemoryCeremonyStore. A
+// non-positive capacity selects the default.
+func NewMemoryCeremonyStore(capacity int) *MemoryCeremonyStore {
+	if capacity <= 0 {
+		capacity = defaultMaxCeremonies
+	}
+	return &MemoryCeremonyStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get retrieves the ceremony for the given key.
+func (s *MemoryCeremonyStore) Get(key string) (*Ceremony, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryEntry).ceremony, nil
+}
+
+// Take retrieves and removes the ceremony for the given key.
+func (s *MemoryCeremonyStore) Take(key string) (*Ceremony, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	s.remove(el)
+	return el.Value.(*memoryEntry).ceremony, nil
+}
+
+// Set stores a ceremony under the given key.
+func (s *MemoryCeremonyStore) Set(key string, c *Ceremony, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := ceremonyExpiry(c, s.now(), ttl)
+
+	if el, ok := s.entries[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.ceremony, entry.expires = c, expires
+		s.lru.MoveToFront(el)
+		return nil
+	}
+
+	for s.lru.Len() >= s.capacity {
+		s.remove(s.lru.Back())
+	}
+	s.entries[key] = s.lru.PushFront(&memoryEntry{key: key, ceremony: c, expires: expires})
+	return nil
+}
+
+// Delete removes the ceremony for the given key.
+func (s *MemoryCeremonyStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+// Len returns the number of stored entries, including expired ones that
+// have not been swept yet.
+func (s *MemoryCeremonyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Sweep evicts all expired entries and returns how many were removed.
+func (s *MemoryCeremonyStore) Sweep() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	removed := 0
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if !now.Before(el.Value.(*memoryEntry).expires) {
+			s.remove(el)
+			removed++
+		}
+		el = prev
+	}
+	return removed, nil
+}
+
+// lookup returns the live element for key, dropping it if it has expired.
+func (s *MemoryCeremonyStore) lookup(key string) (*list.Element, error) {
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, ErrCeremonyNotFound
+	}
+	if !s.now().Before(el.Value.(*memoryEntry).expires) {
+		s.remove(el)
+		return nil, ErrCeremonyNotFound
+	}
+	return el, nil
+}
+
+func (s *MemoryCeremonyStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*memoryEntry).key)
+}
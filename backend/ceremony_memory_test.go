@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryCeremonyStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := NewMemoryCeremonyStore(2)
+	s.Set("a", testCeremony("a"), time.Minute)
+	s.Set("b", testCeremony("b"), time.Minute)
+
+	// Touch "a" so "b" becomes the eviction candidate.
+	s.Get("a")
+	s.Set("c", testCeremony("c"), time.Minute)
+
+	if s.Len() != 2 {
+		t.Fatalf("expected store capped at 2 entries, have %d", s.Len())
+	}
+	if _, err := s.Get("b"); !errors.Is(err, ErrCeremonyNotFound) {
+		t.Fatal("expected least recently used ceremony to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := s.Get(key); err != nil {
+			t.Fatalf("expected %q to remain: %v", key, err)
+		}
+	}
+}
+
+func TestMemoryCeremonyStoreDropsExpiredOnAccess(t *testing.T) {
+	clock := newFakeClock()
+	s := NewMemoryCeremonyStore(10)
+	s.now = clock.Now
+	s.Set("a", testCeremony("a"), time.Minute)
+
+	clock.Advance(time.Minute)
+	s.Get("a")
+	if s.Len() != 0 {
+		t.Fatalf("expected expired ceremony to be removed on access, have %d", s.Len())
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SQLiteCeremonyStore is a CeremonyStore backed by the ceremonies table, so
+// every replica sharing the database can finish a ceremony begun elsewhere.
+// Once the table holds capacity entries the oldest one is evicted to make
+// room for a new ceremony.
+type SQLiteCeremonyStore struct {
+	db       *sql.DB
+	capacity int
+	now      func() time.Time
+}
+
+// NewSQLiteCeremonyStore creates a CeremonyStore on db. The ceremonies table
+// must already exist. A non-positive capacity selects the default.
+func NewSQLiteCeremonyStore(db *sql.DB, capacity int) *SQLiteCeremonyStore {
+	if capacity <= 0 {
+		capacity = defaultMaxCeremonies
+	}
+	return &SQLiteCeremonyStore{db: db, capacity: capacity, now: time.Now}
+}
+
+// Get retrieves the ceremony for the given key.
+func (s *SQLiteCeremonyStore) Get(key string) (*Ceremony, error) {
+	var data string
+	err := s.db.QueryRow("SELECT data FROM ceremonies WHERE id = ? AND expires_at > ?",
+		key, s.now().UnixNano()).Scan(&data)
+	return decodeCeremony(data, err)
+}
+
+// Take retrieves and removes the ceremony for the given key. The lookup and
+// delete are a single statement, so only one caller can ever receive it.
+func (s *SQLiteCeremonyStore) Take(key string) (*Ceremony, error) {
+	var data string
+	err := s.db.QueryRow("DELETE FROM ceremonies WHERE id = ? AND expires_at > ? RETURNING data",
+		key, s.now().UnixNano()).Scan(&data)
+	return decodeCeremony(data, err)
+}
+
+// Set stores a ceremony under the given key.
+func (s *SQLiteCeremonyStore) Set(key string, c *Ceremony, ttl time.Duration) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal ceremony: %w", err)
+	}
+	expires := ceremonyExpiry(c, s.now(), ttl)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// A replaced row gets a new rowid, so rowid order is insertion order.
+	if _, err := tx.Exec("INSERT OR REPLACE INTO ceremonies (id, data, expires_at) VALUES (?, ?, ?)",
+		key, string(data), expires.UnixNano()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM ceremonies WHERE rowid IN (SELECT rowid FROM ceremonies ORDER BY rowid DESC LIMIT -1 OFFSET ?)",
+		s.capacity); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes the ceremony for the given key.
+func (s *SQLiteCeremonyStore) Delete(key string) error {
+	_, err := s.db.Exec("DELETE FROM ceremonies WHERE id = ?", key)
+	return err
+}
+
+// Sweep deletes all expired ceremonies and returns how many were removed.
+func (s *SQLiteCeremonyStore) Sweep() (int, error) {
+	res, err := s.db.Exec("DELETE FROM ceremonies WHERE expires_at <= ?", s.now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func decodeCeremony(data string, err error) (*Ceremony, error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCeremonyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Ceremony
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return nil, fmt.Errorf("unmarshal ceremony: %w", err)
+	}
+	return &c, nil
+}
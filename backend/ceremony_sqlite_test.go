@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSQLiteCeremonyStoreEvictsOldest(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	s := NewSQLiteCeremonyStore(db, 2)
+	s.Set("a", testCeremony("a"), time.Minute)
+	s.Set("b", testCeremony("b"), time.Minute)
+
+	// Replacing "a" makes it the newest, so "b" is evicted next.
+	s.Set("a", testCeremony("a2"), time.Minute)
+	s.Set("c", testCeremony("c"), time.Minute)
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM ceremonies").Scan(&n)
+	if n != 2 {
+		t.Fatalf("expected store capped at 2 entries, have %d", n)
+	}
+	if _, err := s.Get("b"); !errors.Is(err, ErrCeremonyNotFound) {
+		t.Fatal("expected the oldest ceremony to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := s.Get(key); err != nil {
+			t.Fatalf("expected %q to remain: %v", key, err)
+		}
+	}
+}
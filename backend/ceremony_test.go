@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// fakeClock lets tests move a store's notion of now.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(1_700_000_000, 0)}
+}
+
+// ceremonyStores returns every CeremonyStore implementation wired to a fake clock.
+func ceremonyStores(t *testing.T) map[string]func() (CeremonyStore, *fakeClock) {
+	t.Helper()
+	return map[string]func() (CeremonyStore, *fakeClock){
+		"memory": func() (CeremonyStore, *fakeClock) {
+			clock := newFakeClock()
+			s := NewMemoryCeremonyStore(100)
+			s.now = clock.Now
+			return s, clock
+		},
+		"sqlite": func() (CeremonyStore, *fakeClock) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("open database: %v", err)
+			}
+			db.SetMaxOpenConns(1)
+			t.Cleanup(func() { db.Close() })
+			if err := migrate(db); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+			clock := newFakeClock()
+			s := NewSQLiteCeremonyStore(db, 100)
+			s.now = clock.Now
+			return s, clock
+		},
+	}
+}
+
+func testCeremony(challenge string) *Ceremony {
+	return &Ceremony{Kind: ceremonyLogin, Session: webauthn.SessionData{Challenge: challenge}}
+}
+
+func TestCeremonyStoreSetGet(t *testing.T) {
+	for name, newStore := range ceremonyStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newStore()
+			if err := s.Set("a", testCeremony("challenge-a"), time.Minute); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+
+			c, err := s.Get("a")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if c.Kind != ceremonyLogin || c.Session.Challenge != "challenge-a" {
+				t.Fatalf("unexpected ceremony %+v", c)
+			}
+
+			if _, err := s.Get("missing"); !errors.Is(err, ErrCeremonyNotFound) {
+				t.Fatalf("expected ErrCeremonyNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCeremonyStoreTakeOnce(t *testing.T) {
+	for name, newStore := range ceremonyStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newStore()
+			s.Set("a", testCeremony("a"), time.Minute)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			taken := 0
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := s.Take("a"); err == nil {
+						mu.Lock()
+						taken++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if taken != 1 {
+				t.Fatalf("expected exactly one successful Take, got %d", taken)
+			}
+			if _, err := s.Get("a"); !errors.Is(err, ErrCeremonyNotFound) {
+				t.Fatalf("expected ceremony to be gone after Take, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCeremonyStoreExpiry(t *testing.T) {
+	for name, newStore := range ceremonyStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, clock := newStore()
+			s.Set("ttl", testCeremony("ttl"), time.Minute)
+
+			early := testCeremony("early")
+			early.Session.Expires = clock.Now().Add(30 * time.Second)
+			s.Set("early", early, time.Hour)
+
+			clock.Advance(30 * time.Second)
+			if _, err := s.Get("early"); !errors.Is(err, ErrCeremonyNotFound) {
+				t.Fatalf("expected ceremony to expire at SessionData.Expires, got %v", err)
+			}
+			if _, err := s.Get("ttl"); err != nil {
+				t.Fatalf("expected ceremony before TTL, got %v", err)
+			}
+
+			clock.Advance(30 * time.Second)
+			if _, err := s.Take("ttl"); !errors.Is(err, ErrCeremonyNotFound) {
+				t.Fatalf("expected ceremony to be rejected once TTL elapsed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCeremonyStoreSweep(t *testing.T) {
+	for name, newStore := range ceremonyStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, clock := newStore()
+			s.Set("old", testCeremony("old"), time.Minute)
+			clock.Advance(30 * time.Second)
+			s.Set("new", testCeremony("new"), time.Minute)
+			clock.Advance(45 * time.Second)
+
+			removed, err := s.Sweep()
+			if err != nil {
+				t.Fatalf("Sweep: %v", err)
+			}
+			if removed != 1 {
+				t.Fatalf("expected 1 ceremony swept, got %d", removed)
+			}
+			if _, err := s.Get("new"); err != nil {
+				t.Fatalf("expected unexpired ceremony to survive sweep, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSweeperStops(t *testing.T) {
+	s := NewMemoryCeremonyStore(10)
+	s.Set("a", testCeremony("a"), time.Nanosecond)
+
+	stop := startSweeper(s, time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for s.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sweeper did not evict expired ceremony")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	stop() // idempotent
+}
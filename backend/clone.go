@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// CloneWarningPolicy decides what happens when an assertion's signature
+// counter did not increase, which suggests the authenticator was cloned.
+type CloneWarningPolicy string
+
+const (
+	// CloneWarningLog records the warning and lets the login proceed.
+	CloneWarningLog CloneWarningPolicy = "log"
+	// CloneWarningReject refuses the login but leaves the credential usable.
+	CloneWarningReject CloneWarningPolicy = "reject"
+	// CloneWarningLock refuses the login and locks the credential until an
+	// operator reviews it.
+	CloneWarningLock CloneWarningPolicy = "lock"
+)
+
+// ParseCloneWarningPolicy validates a policy name from configuration.
+func ParseCloneWarningPolicy(s string) (CloneWarningPolicy, error) {
+	switch p := CloneWarningPolicy(s); p {
+	case CloneWarningLog, CloneWarningReject, CloneWarningLock:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown clone warning policy %q: want log, reject or lock", s)
+}
+
+var (
+	// ErrCloneWarning is returned when an assertion is refused because the
+	// authenticator may have been cloned.
+	ErrCloneWarning = errors.New("authenticator may have been cloned")
+
+	// ErrCredentialLocked is returned for assertions made with a locked credential.
+	ErrCredentialLocked = errors.New("credential is locked pending review")
+)
+
+// recordAssertion applies the clone warning policy to a verified assertion
+// and persists the credential's updated sign counter, flags and last-used
+// time. A non-nil error means the login must be refused.
+//
+// The warning is judged for this assertion alone, against the stored
+// counter: webauthn.Authenticator.CloneWarning never resets, so one flagged
+// login would otherwise taint every later one.
+func (a *App) recordAssertion(userID int, cred *webauthn.Credential) error {
+	var (
+		signCount uint32
+		lockedAt  sql.NullTime
+	)
+	err := a.db.QueryRow("SELECT sign_count, locked_at FROM credentials WHERE user_id = ? AND credential_id = ?",
+		userID, cred.ID).Scan(&signCount, &lockedAt)
+	if err != nil {
+		return fmt.Errorf("load credential: %w", err)
+	}
+	if lockedAt.Valid {
+		return ErrCredentialLocked
+	}
+
+	// The library only advances the counter when the assertion's counter is
+	// higher, so an unchanged non-zero counter means it did not increase.
+	if signCount != 0 && cred.Authenticator.SignCount <= signCount {
+		log.Printf("clone warning: user %d credential %s sign count %d (policy %s)",
+			userID, encodeCredentialID(cred.ID), signCount, a.clonePolicy)
+
+		switch a.clonePolicy {
+		case CloneWarningReject:
+			return ErrCloneWarning
+		case CloneWarningLock:
+			if err := a.updateCredential(userID, *cred, time.Now().UTC()); err != nil {
+				return err
+			}
+			if _, err := a.db.Exec("UPDATE credentials SET locked_at = ? WHERE user_id = ? AND credential_id = ?",
+				time.Now().UTC(), userID, cred.ID); err != nil {
+				return fmt.Errorf("lock credential: %w", err)
+			}
+			return ErrCredentialLocked
+		}
+	}
+
+	return a.updateCredential(userID, *cred, time.Now().UTC())
+}
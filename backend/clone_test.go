@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// assertedCredential returns the stored credential as FinishLogin would
+// after an assertion reporting signCount.
+func assertedCredential(t *testing.T, app *App, userID int, signCount uint32) *webauthn.Credential {
+	t.Helper()
+	creds := app.getCredentialsForUser(userID)
+	if len(creds) != 1 {
+		t.Fatalf("expected 1 stored credential, got %d", len(creds))
+	}
+	cred := creds[0]
+	cred.Authenticator.UpdateCounter(signCount)
+	cred.Flags.BackupState = false
+	return &cred
+}
+
+func TestRecordAssertionPersistsCounterAndFlags(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+
+	if err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 7)); err != nil {
+		t.Fatalf("recordAssertion: %v", err)
+	}
+
+	stored := app.getCredentialsForUser(user.ID)[0]
+	if stored.Authenticator.SignCount != 7 {
+		t.Fatalf("expected sign count 7, got %d", stored.Authenticator.SignCount)
+	}
+	if stored.Flags.BackupState {
+		t.Fatal("expected updated backup state to be persisted")
+	}
+	passkeys, _ := app.listPasskeys(user.ID)
+	if passkeys[0].LastUsedAt == nil {
+		t.Fatal("expected last used time to be recorded")
+	}
+}
+
+func TestRecordAssertionClonePolicies(t *testing.T) {
+	tests := []struct {
+		policy     CloneWarningPolicy
+		wantErr    error
+		wantLocked bool
+	}{
+		{CloneWarningLog, nil, false},
+		{CloneWarningReject, ErrCloneWarning, false},
+		{CloneWarningLock, ErrCredentialLocked, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			app := newTestApp(t)
+			app.clonePolicy = tt.policy
+			user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+			if err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 5)); err != nil {
+				t.Fatalf("recordAssertion: %v", err)
+			}
+
+			err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 5))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			passkeys, _ := app.listPasskeys(user.ID)
+			if passkeys[0].Locked != tt.wantLocked {
+				t.Fatalf("expected locked=%v, got %v", tt.wantLocked, passkeys[0].Locked)
+			}
+		})
+	}
+}
+
+func TestRecordAssertionRejectsLockedCredential(t *testing.T) {
+	app := newTestApp(t)
+	app.clonePolicy = CloneWarningLock
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+
+	app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 5))
+	app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 3))
+
+	// Even a clean assertion is refused until the lock is lifted.
+	err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 10))
+	if !errors.Is(err, ErrCredentialLocked) {
+		t.Fatalf("expected ErrCredentialLocked, got %v", err)
+	}
+}
+
+func TestRecordAssertionWarnsPerAssertion(t *testing.T) {
+	app := newTestApp(t)
+	app.clonePolicy = CloneWarningReject
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+
+	app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 5))
+	if err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 4)); !errors.Is(err, ErrCloneWarning) {
+		t.Fatalf("expected ErrCloneWarning, got %v", err)
+	}
+
+	// A later assertion whose counter did increase is accepted again.
+	if err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 6)); err != nil {
+		t.Fatalf("expected a clean assertion to be accepted, got %v", err)
+	}
+	if stored := app.getCredentialsForUser(user.ID)[0]; stored.Authenticator.SignCount != 6 {
+		t.Fatalf("expected sign count 6, got %d", stored.Authenticator.SignCount)
+	}
+}
+
+func TestRecordAssertionAcceptsZeroCounters(t *testing.T) {
+	app := newTestApp(t)
+	app.clonePolicy = CloneWarningReject
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+
+	// Authenticators without a counter, like most synced passkeys, always
+	// report zero.
+	for range 2 {
+		if err := app.recordAssertion(user.ID, assertedCredential(t, app, user.ID, 0)); err != nil {
+			t.Fatalf("recordAssertion: %v", err)
+		}
+	}
+}
+
+func TestParseCloneWarningPolicy(t *testing.T) {
+	if _, err := ParseCloneWarningPolicy("lock"); err != nil {
+		t.Fatalf("expected 'lock' to parse: %v", err)
+	}
+	if _, err := ParseCloneWarningPolicy("ignore"); err == nil {
+		t.Fatal("expected unknown policy to be rejected")
+	}
+}
@@ -1,31 +1,238 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/netip"
+	"strings"
+	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 // App holds all application dependencies.
 type App struct {
-	db           *sql.DB
-	webAuthn     *webauthn.WebAuthn
-	sessionStore *SessionStore
+	db                     *sql.DB
+	webAuthn               *webauthn.WebAuthn
+	ceremonies             CeremonyStore
+	ceremonyTTL            time.Duration
+	conditionalCeremonyTTL time.Duration
+	tokens                 *TokenService
+	stopKeyRotation        func()
+	refreshTokenTTL        time.Duration
+	stopSweeper            func()
+
+	sessionTTL    time.Duration
+	secureCookies bool
+
+	// trustedProxies are the reverse proxies whose X-Forwarded-For header
+	// names the client.
+	trustedProxies []netip.Prefix
+
+	clonePolicy        CloneWarningPolicy
+	registrationPolicy RegistrationPolicy
+	aaguids            *AAGUIDRegistry
+	aaguidPolicy       AAGUIDPolicy
+	mds                *MetadataService
+
+	passwordParams    Argon2Params
+	dummyPasswordHash string
+
+	// dummyCredentialKey derives stand-in credentials for username-first
+	// logins of unknown users. It is kept in app_secrets, so the stand-ins
+	// stay the same across restarts and replicas.
+	dummyCredentialKey []byte
+
+	mailer           Mailer
+	stopOutbox       func()
+	passwordResetTTL time.Duration
+	passwordResetURL string
+
+	upgradeWindow     time.Duration
+	stopUpgradeReport func()
+
+	approvalTTL time.Duration
+}
+
+// AppOption customises an App created by NewApp.
+type AppOption func(*App)
+
+// WithTokenService sets the service used to sign access tokens. Without it
+// NewApp keeps generated signing keys in memory.
+func WithTokenService(ts *TokenService) AppOption {
+	return func(a *App) {
+		a.tokens = ts
+	}
+}
+
+// WithRefreshTokenTTL sets how long a refresh token stays valid. Each refresh
+// issues a new token with a fresh lifetime.
+func WithRefreshTokenTTL(ttl time.Duration) AppOption {
+	return func(a *App) {
+		a.refreshTokenTTL = ttl
+	}
+}
+
+// WithCeremonyStore sets the store used for pending WebAuthn ceremonies.
+func WithCeremonyStore(store CeremonyStore) AppOption {
+	return func(a *App) {
+		a.ceremonies = store
+	}
+}
+
+// WithSQLiteCeremonyStore keeps up to capacity pending WebAuthn ceremonies
+// in the App's database so that several replicas can share them.
+func WithSQLiteCeremonyStore(capacity int) AppOption {
+	return func(a *App) {
+		a.ceremonies = NewSQLiteCeremonyStore(a.db, capacity)
+	}
+}
+
+// WithCeremonyTTL sets how long a pending WebAuthn challenge stays valid.
+func WithCeremonyTTL(ttl time.Duration) AppOption {
+	return func(a *App) {
+		a.ceremonyTTL = ttl
+	}
+}
+
+// WithConditionalCeremonyTTL sets how long a conditional mediation (autofill)
+// login challenge stays valid.
+func WithConditionalCeremonyTTL(ttl time.Duration) AppOption {
+	return func(a *App) {
+		a.conditionalCeremonyTTL = ttl
+	}
+}
+
+// WithSessionTTL sets how long a login session lasts.
+func WithSessionTTL(ttl time.Duration) AppOption {
+	return func(a *App) {
+		a.sessionTTL = ttl
+	}
+}
+
+// WithSecureCookies controls the Secure attribute of session cookies. It
+// should only be disabled for plain-HTTP development setups.
+func WithSecureCookies(secure bool) AppOption {
+	return func(a *App) {
+		a.secureCookies = secure
+	}
+}
+
+// WithTrustedProxies sets the reverse proxies allowed to report the client
+// address in X-Forwarded-For.
+func WithTrustedProxies(proxies []netip.Prefix) AppOption {
+	return func(a *App) {
+		a.trustedProxies = proxies
+	}
+}
+
+// WithCloneWarningPolicy sets how logins from possibly cloned authenticators
+// are handled.
+func WithCloneWarningPolicy(policy CloneWarningPolicy) AppOption {
+	return func(a *App) {
+		a.clonePolicy = policy
+	}
+}
+
+// WithRegistrationPolicy sets the options new passkeys are created with and
+// checked against.
+func WithRegistrationPolicy(p RegistrationPolicy) AppOption {
+	return func(a *App) {
+		a.registrationPolicy = p
+	}
+}
+
+// WithAAGUIDRegistry sets the registry used to name authenticators. Without
+// it only the bundled list is known.
+func WithAAGUIDRegistry(r *AAGUIDRegistry) AppOption {
+	return func(a *App) {
+		a.aaguids = r
+	}
+}
+
+// WithAAGUIDPolicy restricts which authenticator models may register and
+// log in with passkeys.
+func WithAAGUIDPolicy(p AAGUIDPolicy) AppOption {
+	return func(a *App) {
+		a.aaguidPolicy = p
+	}
+}
+
+// WithMetadataService checks attestation statements of new passkeys against
+// FIDO metadata, so only listed authenticators in good standing can register.
+// It requires a registration policy asking for direct or enterprise
+// attestation.
+func WithMetadataService(m *MetadataService) AppOption {
+	return func(a *App) {
+		a.mds = m
+	}
+}
+
+// WithPasswordParams sets the Argon2id cost of new password hashes. Existing
+// hashes made with other parameters are upgraded on their next login.
+func WithPasswordParams(p Argon2Params) AppOption {
+	return func(a *App) {
+		a.passwordParams = p
+	}
+}
+
+// WithMailer sets how queued mail is delivered. Without it mail is only logged.
+func WithMailer(m Mailer) AppOption {
+	return func(a *App) {
+		a.mailer = m
+	}
+}
+
+// WithPasswordResetTTL sets how long a password reset link stays valid.
+func WithPasswordResetTTL(ttl time.Duration) AppOption {
+	return func(a *App) {
+		a.passwordResetTTL = ttl
+	}
+}
+
+// WithPasswordResetURL sets the page reset links point to; the token is
+// appended as the token query parameter.
+func WithPasswordResetURL(u string) AppOption {
+	return func(a *App) {
+		a.passwordResetURL = u
+	}
+}
+
+// WithPasskeyUpgradeWindow sets how soon after a password login the user may
+// create a passkey through the upgrade flow.
+func WithPasskeyUpgradeWindow(d time.Duration) AppOption {
+	return func(a *App) {
+		a.upgradeWindow = d
+	}
+}
+
+// WithApprovalTTL sets how long a signed approval may be redeemed.
+func WithApprovalTTL(ttl time.Duration) AppOption {
+	return func(a *App) {
+		a.approvalTTL = ttl
+	}
 }
 
 // NewApp creates a new App with the given database path and WebAuthn config.
-func NewApp(dbPath string, config *webauthn.Config) (*App, error) {
+func NewApp(dbPath string, config *webauthn.Config, opts ...AppOption) (*App, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
+	// SQLite serialises writers anyway, and every connection to ":memory:"
+	// would otherwise get its own empty database.
+	db.SetMaxOpenConns(1)
 
-	if err := createTables(db); err != nil {
-		return nil, fmt.Errorf("create tables: %w", err)
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("migrate database: %w", err)
 	}
 
 	wa, err := webauthn.New(config)
@@ -33,48 +240,172 @@ func NewApp(dbPath string, config *webauthn.Config) (*App, error) {
 		return nil, fmt.Errorf("init webauthn: %w", err)
 	}
 
-	return &App{
-		db:           db,
-		webAuthn:     wa,
-		sessionStore: NewSessionStore(),
-	}, nil
-}
+	app := &App{
+		db:                     db,
+		webAuthn:               wa,
+		ceremonies:             NewMemoryCeremonyStore(defaultMaxCeremonies),
+		ceremonyTTL:            defaultCeremonyTTL,
+		conditionalCeremonyTTL: defaultConditionalCeremonyTTL,
+		refreshTokenTTL:        defaultRefreshTokenTTL,
 
-func createTables(db *sql.DB) error {
-	createUsersTable := `CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE,
-		display_name TEXT
-	);`
+		sessionTTL:    defaultSessionTTL,
+		secureCookies: true,
 
-	createCredentialsTable := `CREATE TABLE IF NOT EXISTS credentials (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER,
-		credential_json TEXT NOT NULL,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);`
+		clonePolicy:        CloneWarningLog,
+		registrationPolicy: DefaultRegistrationPolicy(),
+		aaguids:            NewAAGUIDRegistry(),
 
-	if _, err := db.Exec(createUsersTable); err != nil {
-		return err
+		passwordParams: defaultArgon2Params,
+
+		mailer:           LogMailer{},
+		passwordResetTTL: defaultPasswordResetTTL,
+
+		upgradeWindow: defaultUpgradeWindow,
+
+		approvalTTL: defaultApprovalTTL,
 	}
-	if _, err := db.Exec(createCredentialsTable); err != nil {
-		return err
+	if len(config.RPOrigins) > 0 {
+		app.passwordResetURL = config.RPOrigins[0] + "/reset-password"
 	}
-	return nil
+	for _, opt := range opts {
+		opt(app)
+	}
+	if err := app.registrationPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("registration policy: %w", err)
+	}
+	if app.mds != nil {
+		// Statements in the "none" format skip metadata checks entirely, so
+		// the policy must ask authenticators to attest.
+		switch app.registrationPolicy.Attestation {
+		case protocol.PreferDirectAttestation, protocol.PreferEnterpriseAttestation:
+		default:
+			return nil, errors.New("metadata service requires direct or enterprise attestation")
+		}
+		wa.Config.MDS = app.mds
+	}
+
+	// Logins for unknown users are checked against this hash so that they
+	// take as long as logins for real ones.
+	dummy, err := randomID(16)
+	if err != nil {
+		return nil, err
+	}
+	if app.dummyPasswordHash, err = hashPassword(dummy, app.passwordParams); err != nil {
+		return nil, fmt.Errorf("init password hashing: %w", err)
+	}
+	if app.dummyCredentialKey, err = app.appSecret("dummy_credential_key", 32); err != nil {
+		return nil, fmt.Errorf("load dummy credential key: %w", err)
+	}
+
+	if app.tokens == nil {
+		issuer := ""
+		if len(config.RPOrigins) > 0 {
+			issuer = config.RPOrigins[0]
+		}
+		if app.tokens, err = newEphemeralTokenService(issuer); err != nil {
+			return nil, fmt.Errorf("init token service: %w", err)
+		}
+	}
+	if app.refreshTokenTTL > app.sessionTTL {
+		return nil, fmt.Errorf("refresh tokens cannot outlive the login session (%s)", app.sessionTTL)
+	}
+	if app.tokens.keys.rotation.Retention < app.approvalTTL {
+		return nil, fmt.Errorf("signing keys must stay published for at least the approval lifetime (%s)", app.approvalTTL)
+	}
+
+	app.stopKeyRotation = runEvery(app.tokens.keys.checkInterval(), func() {
+		if err := app.tokens.keys.Rotate(); err != nil {
+			log.Printf("rotate signing keys: %v", err)
+		}
+	})
+	app.stopSweeper = startSweeper(app.ceremonies, defaultSweepInterval)
+	app.stopOutbox = runEvery(defaultOutboxInterval, func() {
+		if _, err := app.drainOutbox(); err != nil {
+			log.Printf("drain outbox: %v", err)
+		}
+	})
+	app.stopUpgradeReport = runEvery(upgradeReportInterval, app.logUpgradeStats)
+
+	return app, nil
+}
+
+// Close stops background work and closes the database.
+func (a *App) Close() error {
+	a.stopUpgradeReport()
+	a.stopOutbox()
+	a.stopSweeper()
+	a.stopKeyRotation()
+	return a.db.Close()
+}
+
+// appSecret returns the secret stored under name, generating size random
+// bytes for it the first time. Whichever replica stores it first wins.
+func (a *App) appSecret(name string, size int) ([]byte, error) {
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if _, err := a.db.Exec("INSERT OR IGNORE INTO app_secrets (name, value) VALUES (?, ?)", name, secret); err != nil {
+		return nil, err
+	}
+	if err := a.db.QueryRow("SELECT value FROM app_secrets WHERE name = ?", name).Scan(&secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+var (
+	// ErrUsernameTaken is returned when creating a user whose username already exists.
+	ErrUsernameTaken = errors.New("username already taken")
+
+	// ErrCredentialExists is returned when storing a credential whose ID is
+	// already registered.
+	ErrCredentialExists = errors.New("credential already registered")
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// userHandleLen is the size of a WebAuthn user handle, the maximum the
+// specification allows.
+const userHandleLen = 64
+
+// newUserHandle returns a fresh random WebAuthn user handle.
+func newUserHandle() ([]byte, error) {
+	handle := make([]byte, userHandleLen)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+	return handle, nil
 }
 
 // User represents the user model.
 type User struct {
 	ID          int
+	Handle      []byte
 	Name        string
 	DisplayName string
 	Credentials []webauthn.Credential
+
+	// legacyHandle is the numeric handle the user's passkeys were registered
+	// under before random handles were introduced, if any.
+	legacyHandle []byte
+
+	// presentedHandle is the handle an authenticator asserted when it differs
+	// from Handle, as it does for passkeys registered under the legacy
+	// numeric handle. WebAuthnID must echo it for the assertion to verify.
+	presentedHandle []byte
 }
 
 // WebAuthn interface implementation.
 
 func (u *User) WebAuthnID() []byte {
-	return []byte(fmt.Sprintf("%d", u.ID))
+	if u.presentedHandle != nil {
+		return u.presentedHandle
+	}
+	return u.Handle
 }
 
 func (u *User) WebAuthnName() string {
@@ -85,6 +416,11 @@ func (u *User) WebAuthnDisplayName() string {
 	return u.DisplayName
 }
 
+// Subject is the stable identifier used as the sub claim of access tokens.
+func (u *User) Subject() string {
+	return base64.RawURLEncoding.EncodeToString(u.Handle)
+}
+
 func (u *User) WebAuthnIcon() string {
 	return ""
 }
@@ -95,18 +431,55 @@ func (u *User) WebAuthnCredentials() []webauthn.Credential {
 
 // Database helpers — methods on App so they use the instance's db.
 
+const userColumns = "id, user_handle, legacy_handle, username, display_name"
+
 func (a *App) saveUser(username, displayName string) (*User, error) {
-	res, err := a.db.Exec("INSERT INTO users (username, display_name) VALUES (?, ?)", username, displayName)
+	handle, err := newUserHandle()
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.db.Exec("INSERT INTO users (user_handle, username, display_name) VALUES (?, ?, ?)", handle, username, displayName)
 	if err != nil {
 		return nil, err
 	}
 	id, _ := res.LastInsertId()
-	return &User{ID: int(id), Name: username, DisplayName: displayName}, nil
+	return &User{ID: int(id), Handle: handle, Name: username, DisplayName: displayName}, nil
 }
 
-func (a *App) getUser(username string) (*User, error) {
+// createUserWithCredential writes a pending user and its first credential
+// in one transaction, so an account never exists without a login method.
+func (a *App) createUserWithCredential(p *PendingUser, cred webauthn.Credential) (*User, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO users (user_handle, username, display_name) VALUES (?, ?, ?)", p.Handle, p.Name, p.DisplayName)
+	if isUniqueViolation(err) {
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+
+	if err := insertCredential(tx, int(id), cred, a.authenticatorName(cred)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	user := p.User()
+	user.ID = int(id)
+	user.Credentials = []webauthn.Credential{cred}
+	return user, nil
+}
+
+func (a *App) queryUser(where string, args ...any) (*User, error) {
 	var u User
-	err := a.db.QueryRow("SELECT id, username, display_name FROM users WHERE username = ?", username).Scan(&u.ID, &u.Name, &u.DisplayName)
+	err := a.db.QueryRow("SELECT "+userColumns+" FROM users WHERE "+where, args...).Scan(&u.ID, &u.Handle, &u.legacyHandle, &u.Name, &u.DisplayName)
 	if err != nil {
 		return nil, err
 	}
@@ -114,27 +487,176 @@ func (a *App) getUser(username string) (*User, error) {
 	return &u, nil
 }
 
+func (a *App) getUser(username string) (*User, error) {
+	return a.queryUser("username = ?", username)
+}
+
 func (a *App) getUserByID(id int) (*User, error) {
-	var u User
-	err := a.db.QueryRow("SELECT id, username, display_name FROM users WHERE id = ?", id).Scan(&u.ID, &u.Name, &u.DisplayName)
+	return a.queryUser("id = ?", id)
+}
+
+// getUserByHandle resolves a WebAuthn user handle to its user. Handles
+// issued before random handles were introduced are still accepted for the
+// passkeys that carry them.
+func (a *App) getUserByHandle(handle []byte) (*User, error) {
+	u, err := a.queryUser("user_handle = ? OR legacy_handle = ?", handle, handle)
 	if err != nil {
 		return nil, err
 	}
-	u.Credentials = a.getCredentialsForUser(u.ID)
-	return &u, nil
+	if !bytes.Equal(handle, u.Handle) {
+		u.presentedHandle = handle
+	}
+	return u, nil
+}
+
+// userForAssertion returns user and session as they must look to verify an
+// assertion for user that presented handle. Passkeys registered under the
+// legacy numeric handle assert it instead of Handle, and the library checks
+// both user and session against the asserted handle. Callers must already
+// have tied session to user.
+func userForAssertion(user *User, session webauthn.SessionData, handle []byte) (*User, webauthn.SessionData) {
+	if len(handle) == 0 || user.legacyHandle == nil || !bytes.Equal(handle, user.legacyHandle) {
+		return user, session
+	}
+	legacy := *user
+	legacy.presentedHandle = handle
+	session.UserID = handle
+	return &legacy, session
+}
+
+// credentialColumns are the credentials columns holding a
+// webauthn.Credential, in the order credentialValues and scanCredential use.
+const credentialColumns = "credential_id, public_key, aaguid, sign_count, transports, flags, attachment, attestation_type, attestation"
+
+// credentialValues flattens cred into credentialColumns order.
+func credentialValues(cred webauthn.Credential) ([]any, error) {
+	attestation, err := json.Marshal(cred.Attestation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attestation: %w", err)
+	}
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	return []any{
+		cred.ID,
+		cred.PublicKey,
+		cred.Authenticator.AAGUID,
+		cred.Authenticator.SignCount,
+		strings.Join(transports, ","),
+		int(credentialFlagBits(cred.Flags)),
+		string(cred.Authenticator.Attachment),
+		cred.AttestationType,
+		string(attestation),
+	}, nil
+}
+
+// scanCredential reads credentialColumns followed by any extra destinations.
+func scanCredential(scan func(dest ...any) error, extra ...any) (webauthn.Credential, error) {
+	var (
+		c           webauthn.Credential
+		transports  string
+		flags       int
+		attachment  string
+		attestation string
+	)
+	dest := append([]any{
+		&c.ID,
+		&c.PublicKey,
+		&c.Authenticator.AAGUID,
+		&c.Authenticator.SignCount,
+		&transports,
+		&flags,
+		&attachment,
+		&c.AttestationType,
+		&attestation,
+	}, extra...)
+	if err := scan(dest...); err != nil {
+		return c, err
+	}
+
+	if transports != "" {
+		for _, t := range strings.Split(transports, ",") {
+			c.Transport = append(c.Transport, protocol.AuthenticatorTransport(t))
+		}
+	}
+	c.Flags = webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(flags))
+	c.Authenticator.Attachment = protocol.AuthenticatorAttachment(attachment)
+	if err := json.Unmarshal([]byte(attestation), &c.Attestation); err != nil {
+		return c, fmt.Errorf("failed to unmarshal attestation: %w", err)
+	}
+	return c, nil
+}
+
+// placeholders returns n comma-separated SQL bind parameters.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// credentialFlagBits encodes the stored credential flags in authenticator
+// data bit positions.
+func credentialFlagBits(f webauthn.CredentialFlags) protocol.AuthenticatorFlags {
+	var bits protocol.AuthenticatorFlags
+	if f.UserPresent {
+		bits |= protocol.FlagUserPresent
+	}
+	if f.UserVerified {
+		bits |= protocol.FlagUserVerified
+	}
+	if f.BackupEligible {
+		bits |= protocol.FlagBackupEligible
+	}
+	if f.BackupState {
+		bits |= protocol.FlagBackupState
+	}
+	return bits
 }
 
 func (a *App) saveCredential(userID int, cred webauthn.Credential) error {
-	credJSON, err := json.Marshal(cred)
+	return insertCredential(a.db, userID, cred, a.authenticatorName(cred))
+}
+
+// insertCredential stores a new credential for userID, named after its
+// authenticator until the user renames it. It returns ErrCredentialExists if
+// the credential ID is already stored for any user.
+func insertCredential(db execer, userID int, cred webauthn.Credential, authName string) error {
+	values, err := credentialValues(cred)
 	if err != nil {
-		return fmt.Errorf("failed to marshal credential: %w", err)
+		return err
+	}
+	args := append([]any{userID}, values...)
+	args = append(args, authName, authName, time.Now().UTC())
+	_, err = db.Exec("INSERT INTO credentials (user_id, "+credentialColumns+", name, authenticator_name, created_at) VALUES ("+placeholders(len(args))+")", args...)
+	if isUniqueViolation(err) {
+		return ErrCredentialExists
 	}
-	_, err = a.db.Exec("INSERT INTO credentials (user_id, credential_json) VALUES (?, ?)", userID, string(credJSON))
+	return err
+}
+
+// credentialExists reports whether credentialID is stored for any user.
+func (a *App) credentialExists(credentialID []byte) (bool, error) {
+	var exists bool
+	err := a.db.QueryRow("SELECT EXISTS (SELECT 1 FROM credentials WHERE credential_id = ?)", credentialID).Scan(&exists)
+	return exists, err
+}
+
+// isUniqueViolation reports whether err is a failed UNIQUE constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// updateCredential stores the state of cred after a successful assertion.
+func (a *App) updateCredential(userID int, cred webauthn.Credential, usedAt time.Time) error {
+	_, err := a.db.Exec(`UPDATE credentials SET sign_count = ?, flags = ?, last_used_at = ?
+		WHERE user_id = ? AND credential_id = ?`,
+		cred.Authenticator.SignCount, int(credentialFlagBits(cred.Flags)), usedAt,
+		userID, cred.ID)
 	return err
 }
 
 func (a *App) getCredentialsForUser(userID int) []webauthn.Credential {
-	rows, err := a.db.Query("SELECT credential_json FROM credentials WHERE user_id = ?", userID)
+	rows, err := a.db.Query("SELECT "+credentialColumns+" FROM credentials WHERE user_id = ? ORDER BY id", userID)
 	if err != nil {
 		return nil
 	}
@@ -142,16 +664,151 @@ func (a *App) getCredentialsForUser(userID int) []webauthn.Credential {
 
 	var creds []webauthn.Credential
 	for rows.Next() {
-		var credJSON string
-		if err := rows.Scan(&credJSON); err != nil {
-			continue
-		}
-		var c webauthn.Credential
-		if err := json.Unmarshal([]byte(credJSON), &c); err != nil {
-			log.Printf("failed to unmarshal credential: %v", err)
+		c, err := scanCredential(rows.Scan)
+		if err != nil {
+			log.Printf("failed to read credential: %v", err)
 			continue
 		}
 		creds = append(creds, c)
 	}
 	return creds
 }
+
+// normalizeCredentials is the hook for migration 2. It copies every row of
+// the JSON-blob credentials table into credentials_v2 and swaps the tables.
+// Databases from before migrations may also carry the name and timestamp
+// columns that were added in place; those are carried over when present.
+func normalizeCredentials(tx *sql.Tx) error {
+	cols, err := tableColumns(tx, "credentials")
+	if err != nil {
+		return err
+	}
+	optional := func(col string) string {
+		if cols[col] {
+			return col
+		}
+		return "NULL"
+	}
+
+	type legacyRow struct {
+		id, userID                    int
+		credJSON                      string
+		name                          sql.NullString
+		createdAt, lastUsed, lockedAt sql.NullTime
+	}
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, user_id, credential_json, %s, %s, %s, %s FROM credentials",
+		optional("name"), optional("created_at"), optional("last_used_at"), optional("locked_at")))
+	if err != nil {
+		return err
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var r legacyRow
+		if err := rows.Scan(&r.id, &r.userID, &r.credJSON, &r.name, &r.createdAt, &r.lastUsed, &r.lockedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, r := range legacy {
+		var cred webauthn.Credential
+		if err := json.Unmarshal([]byte(r.credJSON), &cred); err != nil {
+			return fmt.Errorf("credential %d: %w", r.id, err)
+		}
+		values, err := credentialValues(cred)
+		if err != nil {
+			return fmt.Errorf("credential %d: %w", r.id, err)
+		}
+
+		name := r.name.String
+		if name == "" {
+			name = fallbackAuthenticatorName(cred)
+		}
+		createdAt := now
+		if r.createdAt.Valid {
+			createdAt = r.createdAt.Time
+		}
+
+		args := append([]any{r.id, r.userID}, values...)
+		args = append(args, name, createdAt, r.lastUsed, r.lockedAt)
+		_, err = tx.Exec("INSERT INTO credentials_v2 (id, user_id, "+credentialColumns+", name, created_at, last_used_at, locked_at) VALUES ("+placeholders(len(args))+")", args...)
+		if err != nil {
+			return fmt.Errorf("credential %d: %w", r.id, err)
+		}
+	}
+
+	for _, stmt := range []string{
+		"DROP TABLE credentials",
+		"ALTER TABLE credentials_v2 RENAME TO credentials",
+		"CREATE INDEX idx_credentials_user_id ON credentials(user_id)",
+		"CREATE INDEX idx_credentials_credential_id ON credentials(credential_id)",
+		"CREATE INDEX idx_credentials_aaguid ON credentials(aaguid)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logRemovedCredentials is the hook for migration 7. It logs every duplicate
+// credential the migration removed, so the owners can be told their passkey
+// moved or went away.
+func logRemovedCredentials(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT r.id, r.user_id, r.credential_id, r.kept_id, c.user_id
+		FROM removed_credentials r JOIN credentials c ON c.id = r.kept_id ORDER BY r.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, userID, keptID, keptUserID int
+		var credID []byte
+		if err := rows.Scan(&id, &userID, &credID, &keptID, &keptUserID); err != nil {
+			return err
+		}
+		log.Printf("migration: removed credential %d of user %d (ID %s), a duplicate of credential %d of user %d",
+			id, userID, encodeCredentialID(credID), keptID, keptUserID)
+	}
+	return rows.Err()
+}
+
+// assignUserHandles is the hook for migration 3. It gives every existing user
+// a random user handle.
+func assignUserHandles(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id FROM users WHERE user_handle IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		handle, err := newUserHandle()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE users SET user_handle = ? WHERE id = ?", handle, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
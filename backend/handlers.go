@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -22,119 +27,511 @@ func jsonError(w http.ResponseWriter, msg string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
+// Error codes sent with errors that clients may need to tell apart. The
+// message next to them is for people and may change.
+const (
+	codeVerificationFailed   = "verification_failed"
+	codeCredentialExists     = "credential_exists"
+	codeAAGUIDNotAllowed     = "aaguid_not_allowed"
+	codeAttachmentNotAllowed = "attachment_not_allowed"
+	codeAttestationRequired  = "attestation_required"
+	codeNotDiscoverable      = "not_discoverable"
+	codeCloneWarning         = "clone_warning"
+	codeCredentialLocked     = "credential_locked"
+	codeInvalidRefreshToken  = "invalid_refresh_token"
+	codeRefreshTokenReused   = "refresh_token_reused"
+	codeLoginMethodRemoved   = "login_method_removed"
+	codeReauthRequired       = "reauth_required"
+	codeApprovalInvalid      = "approval_invalid"
+	codeApprovalUsed         = "approval_used"
+)
+
+// jsonErrorCode is jsonError with a machine-readable error code.
+func jsonErrorCode(w http.ResponseWriter, errCode, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": errCode})
+}
+
+// rejectionCodes maps the policy errors that refuse a passkey to the codes
+// sent to the client.
+var rejectionCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrAAGUIDNotAllowed, codeAAGUIDNotAllowed},
+	{ErrAttachmentNotAllowed, codeAttachmentNotAllowed},
+	{ErrAttestationRequired, codeAttestationRequired},
+	{ErrNotDiscoverable, codeNotDiscoverable},
+	{ErrCloneWarning, codeCloneWarning},
+	{ErrCredentialLocked, codeCredentialLocked},
+}
+
+// rejectCredential refuses a verified passkey because of a policy error,
+// records the refusal in the audit log and writes the error response.
+// userID is 0 for a sign-up whose account does not exist yet.
+func (a *App) rejectCredential(w http.ResponseWriter, r *http.Request, event string, userID int, username string, cred *webauthn.Credential, err error, status int) {
+	code := codeVerificationFailed
+	for _, rc := range rejectionCodes {
+		if errors.Is(err, rc.err) {
+			code = rc.code
+			break
+		}
+	}
+	log.Printf("%s: user %q credential %s: %v", event, username, encodeCredentialID(cred.ID), err)
+	a.recordAudit(r, auditEvent{Event: event, Reason: code, UserID: userID, Username: username, Cred: cred})
+
+	msg := "Passkey not allowed: " + err.Error()
+	if event == auditLoginRejected {
+		msg = "Verification failed: " + err.Error()
+	}
+	jsonErrorCode(w, code, msg, status)
+}
+
 // discoverUser is called by the webauthn library during FinishDiscoverableLogin.
-// The userHandle is the WebAuthnID we returned — fmt.Sprintf("%d", user.ID).
+// The userHandle is the user's WebAuthnID at the time the passkey was created.
 func (a *App) discoverUser(rawID, userHandle []byte) (webauthn.User, error) {
-	idStr := string(userHandle)
-	id, err := strconv.Atoi(idStr)
+	user, err := a.getUserByHandle(userHandle)
 	if err != nil {
-		return nil, fmt.Errorf("invalid user handle: %s", idStr)
+		return nil, fmt.Errorf("user not found for handle: %w", err)
 	}
-	user, err := a.getUserByID(id)
+	return user, nil
+}
+
+// getUserBySubject resolves the sub claim of an access token to its user.
+func (a *App) getUserBySubject(sub string) (*User, error) {
+	handle, err := base64.RawURLEncoding.DecodeString(sub)
 	if err != nil {
-		return nil, fmt.Errorf("user not found for handle: %s", idStr)
+		return nil, fmt.Errorf("invalid subject: %w", err)
 	}
-	return user, nil
+	return a.getUserByHandle(handle)
 }
 
-func (a *App) registerBegin(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		jsonError(w, "Username required", http.StatusBadRequest)
+// writeLoginResponse starts a login session, issues an access token and a
+// refresh token for user and writes the login response shared by the passkey and password flows.
+// cred is the passkey used, or nil for a password login.
+func (a *App) writeLoginResponse(w http.ResponseWriter, r *http.Request, user *User, cred *webauthn.Credential, amr, message string) {
+	var credID []byte
+	if cred != nil {
+		credID = cred.ID
+	}
+	sessionToken, session, err := a.createLoginSession(user.ID, amr, credID, r)
+	if err != nil {
+		log.Printf("createLoginSession error: %v", err)
+		jsonError(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	user, err := a.getUser(username)
+	token, claims, err := a.tokens.Issue(user, sessionAuthContext(session))
+	if err != nil {
+		log.Printf("Issue token error: %v", err)
+		jsonError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	refreshToken, err := a.issueRefreshToken(session)
 	if err != nil {
-		user, err = a.saveUser(username, username)
+		log.Printf("issueRefreshToken error: %v", err)
+		jsonError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	a.setSessionCookie(w, sessionToken, session.ExpiresAt)
+
+	resp := map[string]any{
+		"status":        "ok",
+		"message":       message,
+		"token":         token,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		"refresh_token": refreshToken,
+	}
+	if cred != nil {
+		resp["authenticatorName"] = a.storedAuthenticatorName(*cred)
+	}
+	if amr == amrPassword {
+		upgrade, err := a.offerPasskeyUpgrade(user)
+		if err != nil {
+			log.Printf("offerPasskeyUpgrade error: %v", err)
+		}
+		resp["passkeyUpgrade"] = upgrade
+	}
+	jsonResponse(w, resp)
+}
+
+// beginCeremony stores c for ttl under a fresh ceremony ID and returns the ID.
+func (a *App) beginCeremony(c *Ceremony, ttl time.Duration) (string, error) {
+	id, err := newCeremonyID()
+	if err != nil {
+		return "", err
+	}
+	if err := a.ceremonies.Set(id, c, ttl); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// takeCeremony redeems the ceremony named by the request's ceremony
+// parameter. A ceremony can be taken only once, whether or not the finish
+// call then succeeds. On failure it writes the error response and returns nil.
+func (a *App) takeCeremony(w http.ResponseWriter, r *http.Request, kind string) *Ceremony {
+	ceremony, err := a.ceremonies.Take(r.URL.Query().Get(ceremonyParam))
+	if errors.Is(err, ErrCeremonyNotFound) || (err == nil && ceremony.Kind != kind) {
+		jsonError(w, "Session not found", http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		log.Printf("take ceremony error: %v", err)
+		jsonError(w, "Failed to load session", http.StatusInternalServerError)
+		return nil
+	}
+	return ceremony
+}
+
+// registerBegin starts a passkey registration. A logged-in user adds a
+// passkey to their own account; anyone else may only sign up under a
+// username that is not taken yet, and the account is created by
+// registerFinish once the passkey is verified. With mediation=conditional it
+// starts the passkey upgrade offered after a fresh password login.
+func (a *App) registerBegin(w http.ResponseWriter, r *http.Request) {
+	switch mediation := r.URL.Query().Get("mediation"); mediation {
+	case "":
+	case string(protocol.MediationConditional):
+		a.upgradeBegin(w, r)
+		return
+	default:
+		jsonError(w, "Unsupported mediation", http.StatusBadRequest)
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+
+	ceremony := &Ceremony{Kind: ceremonyRegistration}
+	user, err := a.authenticatedUser(r)
+	switch {
+	case err == nil:
+		if username != "" && username != user.Name {
+			jsonError(w, "Cannot add a passkey to another account", http.StatusForbidden)
+			return
+		}
+	case username == "":
+		jsonError(w, "Username required", http.StatusBadRequest)
+		return
+	default:
+		if _, err := a.getUser(username); err == nil {
+			jsonError(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		handle, err := newUserHandle()
 		if err != nil {
 			jsonError(w, "Failed to create user", http.StatusInternalServerError)
 			return
 		}
+		ceremony.PendingUser = &PendingUser{Handle: handle, Name: username, DisplayName: username}
+		user = ceremony.PendingUser.User()
 	}
 
-	options, session, err := a.webAuthn.BeginRegistration(user,
-		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
-	)
+	a.startRegistration(w, user, ceremony, protocol.MediationDefault)
+}
+
+// upgradeBegin starts a conditional-create registration for a user who has
+// just logged in with a password.
+func (a *App) upgradeBegin(w http.ResponseWriter, r *http.Request) {
+	user, err := a.freshPasswordUser(r)
+	if errors.Is(err, ErrStalePasswordLogin) {
+		jsonError(w, "A recent password login is required", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	a.startRegistration(w, user, &Ceremony{Kind: ceremonyRegistration, Upgrade: true}, protocol.MediationConditional)
+}
+
+// startRegistration begins registering a passkey for user and stores the
+// ceremony.
+func (a *App) startRegistration(w http.ResponseWriter, user *User, ceremony *Ceremony, mediation protocol.CredentialMediationRequirement) {
+	policy := a.registrationPolicy
+	opts := policy.registrationOptions(mediation)
+	// Listing the user's passkeys makes the browser refuse to register an
+	// authenticator that already holds one of them.
+	if len(user.Credentials) > 0 {
+		opts = append(opts, webauthn.WithExclusions(webauthn.Credentials(user.Credentials).CredentialDescriptors()))
+	}
+	options, session, err := a.webAuthn.BeginMediatedRegistration(user, mediation, opts...)
 	if err != nil {
 		log.Printf("BeginRegistration error: %v", err)
-		jsonError(w, err.Error(), http.StatusInternalServerError)
+		jsonError(w, "Failed to start registration", http.StatusInternalServerError)
 		return
 	}
 
-	a.sessionStore.Set(username, session)
-	jsonResponse(w, options)
+	// The ceremony must outlive the timeout the browser was given.
+	ttl := max(a.ceremonyTTL, policy.Timeout)
+	ceremony.Session = *session
+	ceremonyID, err := a.beginCeremony(ceremony, ttl)
+	if err != nil {
+		log.Printf("beginCeremony error: %v", err)
+		jsonError(w, "Failed to start ceremony", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, registrationOptions{CredentialCreation: options, CeremonyID: ceremonyID})
 }
 
 func (a *App) registerFinish(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	session, ok := a.sessionStore.Get(username)
-	if !ok {
-		jsonError(w, "Session not found", http.StatusBadRequest)
+	ceremony := a.takeCeremony(w, r, ceremonyRegistration)
+	if ceremony == nil {
 		return
 	}
 
-	user, err := a.getUser(username)
+	// The user comes from the stored ceremony, never from the request, so a
+	// client cannot finish a registration that was begun for someone else.
+	var user *User
+	if ceremony.PendingUser != nil {
+		user = ceremony.PendingUser.User()
+	} else {
+		var err error
+		user, err = a.getUserByHandle(ceremony.Session.UserID)
+		if err != nil {
+			jsonError(w, "User not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponse(r)
 	if err != nil {
-		jsonError(w, "User not found", http.StatusBadRequest)
+		log.Printf("ParseCredentialCreationResponse error: %v", err)
+		jsonErrorCode(w, codeVerificationFailed, "Passkey verification failed", http.StatusBadRequest)
 		return
 	}
-
-	credential, err := a.webAuthn.FinishRegistration(user, *session, r)
+	credential, err := a.webAuthn.CreateCredential(user, ceremony.Session, parsed)
 	if err != nil {
 		log.Printf("FinishRegistration error: %v", err)
-		jsonError(w, err.Error(), http.StatusBadRequest)
+		jsonErrorCode(w, codeVerificationFailed, "Passkey verification failed", http.StatusBadRequest)
+		return
+	}
+	err = a.registrationPolicy.checkRegistration(parsed, credential)
+	if err == nil {
+		err = a.aaguidPolicy.Check(credential.Authenticator.AAGUID)
+	}
+	if err != nil {
+		a.rejectCredential(w, r, auditRegistrationRejected, user.ID, user.Name, credential, err, http.StatusBadRequest)
+		return
+	}
+
+	// Browsers honour excludeCredentials, but the client is not trusted to;
+	// the unique index on credential_id also catches concurrent finishes.
+	exists, err := a.credentialExists(credential.ID)
+	if err != nil {
+		log.Printf("credentialExists error: %v", err)
+		jsonError(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		jsonErrorCode(w, codeCredentialExists, "Passkey already registered", http.StatusConflict)
 		return
 	}
 
-	err = a.saveCredential(user.ID, *credential)
+	if ceremony.PendingUser != nil {
+		_, err = a.createUserWithCredential(ceremony.PendingUser, *credential)
+	} else {
+		err = a.saveCredential(user.ID, *credential)
+	}
+	if errors.Is(err, ErrUsernameTaken) {
+		jsonError(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrCredentialExists) {
+		jsonErrorCode(w, codeCredentialExists, "Passkey already registered", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("saveCredential error: %v", err)
 		jsonError(w, "Failed to save credential", http.StatusInternalServerError)
 		return
 	}
+	if ceremony.Upgrade {
+		if err := a.markPasskeyUpgraded(user.ID); err != nil {
+			log.Printf("markPasskeyUpgraded error: %v", err)
+		}
+	}
 
-	a.sessionStore.Delete(username)
 	jsonResponse(w, map[string]string{"status": "ok"})
 }
 
+// loginBegin starts a passkey login. Without a body it is a discoverable
+// login where the authenticator picks the account. With {"username": ...}
+// it is username-first: the options list that user's credentials in
+// allowCredentials, which security keys without resident credentials need.
+// With mediation=conditional it is a discoverable login for the browser's
+// autofill UI, which a page starts on load and may never finish, so its
+// challenge lives longer than other ceremonies.
 func (a *App) loginBegin(w http.ResponseWriter, r *http.Request) {
-	options, session, err := a.webAuthn.BeginDiscoverableLogin(
-		webauthn.WithUserVerification(protocol.VerificationRequired),
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		options *protocol.CredentialAssertion
+		session *webauthn.SessionData
+		err     error
 	)
+	ttl := a.ceremonyTTL
+	uv := webauthn.WithUserVerification(protocol.VerificationRequired)
+	switch mediation := r.URL.Query().Get("mediation"); {
+	case mediation == string(protocol.MediationConditional):
+		if req.Username != "" {
+			jsonError(w, "Conditional login cannot name a user", http.StatusBadRequest)
+			return
+		}
+		ttl = a.conditionalCeremonyTTL
+		options, session, err = a.webAuthn.BeginDiscoverableMediatedLogin(protocol.MediationConditional, uv, withLoginTimeout(ttl))
+	case mediation != "":
+		jsonError(w, "Unsupported mediation", http.StatusBadRequest)
+		return
+	case req.Username == "":
+		options, session, err = a.webAuthn.BeginDiscoverableLogin(uv)
+	default:
+		options, session, err = a.webAuthn.BeginLogin(a.loginUser(req.Username), uv)
+	}
 	if err != nil {
-		log.Printf("BeginDiscoverableLogin error: %v", err)
-		jsonError(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("BeginLogin error: %v", err)
+		jsonError(w, "Failed to start login", http.StatusInternalServerError)
 		return
 	}
 
-	a.sessionStore.Set("login_session", session)
-	jsonResponse(w, options)
+	ceremonyID, err := a.beginCeremony(&Ceremony{Kind: ceremonyLogin, Session: *session}, ttl)
+	if err != nil {
+		log.Printf("beginCeremony error: %v", err)
+		jsonError(w, "Failed to start ceremony", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, loginOptions{CredentialAssertion: options, CeremonyID: ceremonyID})
+}
+
+// withLoginTimeout sets the assertion timeout, which also bounds how long
+// the library considers the session valid.
+func withLoginTimeout(d time.Duration) webauthn.LoginOption {
+	return func(o *protocol.PublicKeyCredentialRequestOptions) {
+		o.Timeout = int(d.Milliseconds())
+	}
+}
+
+// standInTransports are the transport lists stand-in credentials pick from,
+// matching what platform authenticators, phones and security keys report.
+var standInTransports = [][]protocol.AuthenticatorTransport{
+	{protocol.Internal, protocol.Hybrid},
+	{protocol.Internal},
+	{protocol.Hybrid},
+	{protocol.USB},
+	{protocol.NFC, protocol.USB},
+}
+
+// maxStandInCredentials is the most credentials a stand-in user gets.
+const maxStandInCredentials = 3
+
+// loginUser returns the user a username-first login is for. Unknown users and
+// users without passkeys get a stand-in with one to three made-up
+// credentials, derived from the username so that repeated requests look the
+// same, and the login simply fails at the finish step. This keeps loginBegin
+// from revealing which usernames exist.
+func (a *App) loginUser(username string) *User {
+	if user, err := a.getUser(username); err == nil && len(user.Credentials) > 0 {
+		return user
+	}
+
+	derive := func(label string, size int) []byte {
+		mac := hmac.New(sha512.New, a.dummyCredentialKey)
+		mac.Write([]byte(label + "\x00" + username))
+		return mac.Sum(nil)[:size]
+	}
+	shape := derive("shape", 1+maxStandInCredentials)
+	user := &User{Handle: derive("handle", userHandleLen), Name: username}
+	for i := range 1 + int(shape[0])%maxStandInCredentials {
+		user.Credentials = append(user.Credentials, webauthn.Credential{
+			ID:        derive(fmt.Sprintf("credential %d", i), 32),
+			Transport: standInTransports[int(shape[1+i])%len(standInTransports)],
+		})
+	}
+	return user
 }
 
 func (a *App) loginFinish(w http.ResponseWriter, r *http.Request) {
-	session, ok := a.sessionStore.Get("login_session")
-	if !ok {
-		jsonError(w, "Session not found", http.StatusBadRequest)
+	ceremony := a.takeCeremony(w, r, ceremonyLogin)
+	if ceremony == nil {
 		return
 	}
 
-	credential, err := a.webAuthn.FinishDiscoverableLogin(a.discoverUser, *session, r)
+	var (
+		user       *User
+		credential *webauthn.Credential
+		err        error
+	)
+	if len(ceremony.Session.UserID) > 0 {
+		// Username-first: the ceremony names the user. A stand-in user from
+		// loginUser does not resolve, which fails like a bad assertion.
+		user, err = a.getUserByHandle(ceremony.Session.UserID)
+		if err == nil {
+			_, credential, err = a.validateAssertion(user, ceremony.Session, r)
+		}
+	} else {
+		var webAuthnUser webauthn.User
+		webAuthnUser, credential, err = a.webAuthn.FinishPasskeyLogin(a.discoverUser, ceremony.Session, r)
+		if err == nil {
+			user = webAuthnUser.(*User)
+		}
+	}
 	if err != nil {
-		log.Printf("FinishDiscoverableLogin error: %v", err)
-		jsonError(w, "Verification failed: "+err.Error(), http.StatusUnauthorized)
+		log.Printf("FinishLogin error: %v", err)
+		jsonErrorCode(w, codeVerificationFailed, "Passkey verification failed", http.StatusUnauthorized)
 		return
 	}
 
-	_ = credential
+	if !a.acceptAssertion(w, r, user, credential) {
+		return
+	}
+	a.writeLoginResponse(w, r, user, credential, amrHardwareKey, "Passkey login successful!")
+}
 
-	a.sessionStore.Delete("login_session")
+// validateAssertion parses the assertion in r and verifies it for user
+// against session. Unlike webauthn.FinishLogin it also accepts passkeys that
+// assert the user's legacy handle.
+func (a *App) validateAssertion(user *User, session webauthn.SessionData, r *http.Request) (*protocol.ParsedCredentialAssertionData, *webauthn.Credential, error) {
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	assertingUser, session := userForAssertion(user, session, parsed.Response.UserHandle)
+	credential, err := a.webAuthn.ValidateLogin(assertingUser, session, parsed)
+	return parsed, credential, err
+}
+
+// acceptAssertion applies the checks a verified assertion must still pass
+// and records its use. On failure it writes the error response and returns
+// false.
+func (a *App) acceptAssertion(w http.ResponseWriter, r *http.Request, user *User, credential *webauthn.Credential) bool {
+	// The policy may have changed since the passkey was registered.
+	if err := a.aaguidPolicy.Check(credential.Authenticator.AAGUID); err != nil {
+		a.rejectCredential(w, r, auditLoginRejected, user.ID, user.Name, credential, err, http.StatusUnauthorized)
+		return false
+	}
 
-	jsonResponse(w, map[string]string{
-		"status":  "ok",
-		"message": "Passkey login successful!",
-		"token":   "mock-jwt-token",
-	})
+	err := a.recordAssertion(user.ID, credential)
+	switch {
+	case errors.Is(err, ErrCloneWarning), errors.Is(err, ErrCredentialLocked):
+		a.rejectCredential(w, r, auditLoginRejected, user.ID, user.Name, credential, err, http.StatusUnauthorized)
+		return false
+	case err != nil:
+		log.Printf("recordAssertion error: %v", err)
+		jsonError(w, "Failed to update credential", http.StatusInternalServerError)
+		return false
+	}
+	return true
 }
 
 func (a *App) passwordLoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -152,13 +549,13 @@ func (a *App) passwordLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Replace with real password verification (bcrypt, argon2, etc.)
-	if req.Password == "password" {
-		jsonResponse(w, map[string]string{
-			"token":   "mock-jwt-token-12345",
-			"message": "Login successful",
-		})
-	} else {
+	// Tokens and sessions are only ever issued for a password verified
+	// against the user's stored hash.
+	user, ok := a.checkPassword(req.Email, req.Password)
+	if !ok {
 		jsonError(w, "Invalid credentials", http.StatusUnauthorized)
+		return
 	}
+
+	a.writeLoginResponse(w, r, user, nil, amrPassword, "Login successful")
 }
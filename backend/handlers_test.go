@@ -1,26 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
+// testArgon2Params keep password hashing cheap in tests.
+var testArgon2Params = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLen: 16, KeyLen: 32}
+
 // newTestApp creates an App backed by an in-memory SQLite database.
-func newTestApp(t *testing.T) *App {
+func newTestApp(t *testing.T, opts ...AppOption) *App {
 	t.Helper()
 	app, err := NewApp(":memory:", &webauthn.Config{
 		RPDisplayName: "Passkey Demo",
 		RPID:          "localhost",
 		RPOrigins:     []string{"http://localhost:3000"},
-	})
+	}, append([]AppOption{WithPasswordParams(testArgon2Params)}, opts...)...)
 	if err != nil {
 		t.Fatalf("newTestApp: %v", err)
 	}
+	t.Cleanup(func() { app.Close() })
 	return app
 }
 
@@ -85,7 +96,7 @@ func TestRegisterBeginRequiresUsername(t *testing.T) {
 	}
 }
 
-func TestRegisterBeginCreatesUser(t *testing.T) {
+func TestRegisterBeginDoesNotCreateUser(t *testing.T) {
 	app := newTestApp(t)
 
 	req := httptest.NewRequest("POST", "/api/auth/register/begin?username=bob", nil)
@@ -97,13 +108,100 @@ func TestRegisterBeginCreatesUser(t *testing.T) {
 		t.Fatalf("expected 200, got %d", w.Result().StatusCode)
 	}
 
-	// Verify user was created in DB
-	user, err := app.getUser("bob")
+	// The account only exists once registration finishes.
+	if _, err := app.getUser("bob"); err == nil {
+		t.Fatal("expected no user 'bob' before registration finishes")
+	}
+
+	var body registrationOptions
+	json.NewDecoder(w.Result().Body).Decode(&body)
+	ceremony, err := app.ceremonies.Get(body.CeremonyID)
+	if err != nil {
+		t.Fatalf("expected stored ceremony: %v", err)
+	}
+	if ceremony.PendingUser == nil || ceremony.PendingUser.Name != "bob" {
+		t.Fatalf("expected pending user 'bob', got %+v", ceremony.PendingUser)
+	}
+	if !bytes.Equal(ceremony.Session.UserID, ceremony.PendingUser.Handle) {
+		t.Fatal("expected the ceremony to be bound to the pending user's handle")
+	}
+}
+
+func TestRegisterBeginRejectsExistingUsername(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.saveUser("carol", "carol"); err != nil {
+		t.Fatalf("saveUser failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	app.registerBegin(w, httptest.NewRequest("POST", "/api/auth/register/begin?username=carol", nil))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+}
+
+func TestRegisterBeginForLoggedInUser(t *testing.T) {
+	app := newTestApp(t)
+	user, cookie := seedPasskeyUser(t, app, "dave", "cred-1")
+
+	// The username may be omitted; the session decides the account.
+	req := httptest.NewRequest("POST", "/api/auth/register/begin", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	app.registerBegin(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body registrationOptions
+	json.NewDecoder(w.Result().Body).Decode(&body)
+	ceremony, err := app.ceremonies.Get(body.CeremonyID)
 	if err != nil {
-		t.Fatalf("expected user 'bob' to exist in DB: %v", err)
+		t.Fatalf("expected stored ceremony: %v", err)
 	}
-	if user.Name != "bob" {
-		t.Fatalf("expected username 'bob', got %q", user.Name)
+	if ceremony.PendingUser != nil || !bytes.Equal(ceremony.Session.UserID, user.Handle) {
+		t.Fatal("expected the ceremony to be bound to the logged-in user")
+	}
+
+	req = httptest.NewRequest("POST", "/api/auth/register/begin?username=someone-else", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	app.registerBegin(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another username, got %d", w.Code)
+	}
+}
+
+func TestCreateUserWithCredential(t *testing.T) {
+	app := newTestApp(t)
+
+	pending := &PendingUser{Handle: []byte("pending-handle"), Name: "erin", DisplayName: "erin"}
+	cred := webauthn.Credential{ID: []byte("erin-cred"), PublicKey: []byte("key")}
+	user, err := app.createUserWithCredential(pending, cred)
+	if err != nil {
+		t.Fatalf("createUserWithCredential failed: %v", err)
+	}
+
+	fetched, err := app.getUser("erin")
+	if err != nil {
+		t.Fatalf("expected user to exist: %v", err)
+	}
+	if fetched.ID != user.ID || len(fetched.Credentials) != 1 {
+		t.Fatalf("expected user with one credential, got %+v", fetched)
+	}
+
+	// A second sign-up that finishes later under the same name loses.
+	other := &PendingUser{Handle: []byte("other-handle"), Name: "erin", DisplayName: "erin"}
+	_, err = app.createUserWithCredential(other, webauthn.Credential{ID: []byte("other-cred"), PublicKey: []byte("key")})
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+	var n int
+	app.db.QueryRow("SELECT COUNT(*) FROM credentials WHERE credential_id = ?", []byte("other-cred")).Scan(&n)
+	if n != 0 {
+		t.Fatal("expected the losing credential not to be stored")
 	}
 }
 
@@ -141,6 +239,93 @@ func TestLoginBeginReturnsChallenge(t *testing.T) {
 	}
 }
 
+func TestLoginBeginIssuesDistinctCeremonies(t *testing.T) {
+	app := newTestApp(t)
+
+	ids := make([]string, 2)
+	for i := range ids {
+		w := httptest.NewRecorder()
+		app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin", nil))
+
+		var body map[string]any
+		if err := json.NewDecoder(w.Result().Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		id, _ := body["ceremonyId"].(string)
+		if id == "" {
+			t.Fatal("response missing ceremonyId field")
+		}
+		ids[i] = id
+	}
+
+	if ids[0] == ids[1] {
+		t.Fatal("expected each loginBegin to mint a new ceremony ID")
+	}
+	// Both concurrent ceremonies must still be pending.
+	for _, id := range ids {
+		if _, err := app.ceremonies.Get(id); err != nil {
+			t.Fatalf("ceremony %q was overwritten", id)
+		}
+	}
+}
+
+func TestLoginFinishRejectsRegistrationCeremony(t *testing.T) {
+	app := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	app.registerBegin(w, httptest.NewRequest("POST", "/api/auth/register/begin?username=alice", nil))
+	var begin map[string]any
+	json.NewDecoder(w.Result().Body).Decode(&begin)
+	ceremonyID, _ := begin["ceremonyId"].(string)
+
+	body := `{"id":"test","rawId":"test","type":"public-key","response":{}}`
+	req := httptest.NewRequest("POST", "/api/auth/login/finish?ceremony="+ceremonyID, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+
+	app.loginFinish(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var result map[string]string
+	json.NewDecoder(w.Result().Body).Decode(&result)
+	if result["error"] != "Session not found" {
+		t.Fatalf("expected 'Session not found', got %q", result["error"])
+	}
+}
+
+func TestSQLiteCeremonyStoreSharedAcrossApps(t *testing.T) {
+	dbPath := t.TempDir() + "/auth.db"
+	config := &webauthn.Config{
+		RPDisplayName: "Passkey Demo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:3000"},
+	}
+
+	// Two replicas sharing one database.
+	first, err := NewApp(dbPath, config, WithSQLiteCeremonyStore(0))
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	defer first.Close()
+	second, err := NewApp(dbPath, config, WithSQLiteCeremonyStore(0))
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	defer second.Close()
+
+	w := httptest.NewRecorder()
+	first.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin", nil))
+	var begin map[string]any
+	json.NewDecoder(w.Result().Body).Decode(&begin)
+	ceremonyID, _ := begin["ceremonyId"].(string)
+
+	if _, err := second.ceremonies.Get(ceremonyID); err != nil {
+		t.Fatalf("expected ceremony begun on one replica to be visible on another: %v", err)
+	}
+}
+
 func TestLoginFinishWithoutSessionReturnsError(t *testing.T) {
 	app := newTestApp(t)
 
@@ -186,8 +371,36 @@ func TestRegisterFinishWithoutSessionReturnsError(t *testing.T) {
 	}
 }
 
+func TestRegisterFinishIgnoresUsernameParameter(t *testing.T) {
+	app := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	app.registerBegin(w, httptest.NewRequest("POST", "/api/auth/register/begin?username=victim", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	// Knowing the username is not enough to address the pending ceremony.
+	body := `{"id":"test","rawId":"test","type":"public-key","response":{}}`
+	req := httptest.NewRequest("POST", "/api/auth/register/finish?username=victim", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+
+	app.registerFinish(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var result map[string]string
+	json.NewDecoder(w.Result().Body).Decode(&result)
+	if result["error"] != "Session not found" {
+		t.Fatalf("expected 'Session not found', got %q", result["error"])
+	}
+}
+
 func TestPasswordLoginSuccess(t *testing.T) {
 	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "test@example.com", "password")
 
 	body := `{"email":"test@example.com","password":"password"}`
 	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
@@ -201,14 +414,41 @@ func TestPasswordLoginSuccess(t *testing.T) {
 		t.Fatalf("expected 200, got %d", resp.StatusCode)
 	}
 
-	var result map[string]string
+	var result map[string]any
 	json.NewDecoder(resp.Body).Decode(&result)
 	if result["message"] != "Login successful" {
 		t.Fatalf("expected 'Login successful', got %q", result["message"])
 	}
-	if result["token"] == "" {
+	token, _ := result["token"].(string)
+	if token == "" {
 		t.Fatal("expected token in response")
 	}
+
+	claims, err := app.tokens.Verify(token)
+	if err != nil {
+		t.Fatalf("issued token does not verify: %v", err)
+	}
+	if claims.Subject != user.Subject() {
+		t.Fatalf("expected sub %q, got %q", user.Subject(), claims.Subject)
+	}
+	if len(claims.AMR) != 1 || claims.AMR[0] != amrPassword {
+		t.Fatalf("expected amr [%s], got %v", amrPassword, claims.AMR)
+	}
+}
+
+func TestPasswordLoginUnknownUser(t *testing.T) {
+	app := newTestApp(t)
+
+	body := `{"email":"nobody@example.com","password":"password"}`
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	app.passwordLoginHandler(w, req)
+
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Result().StatusCode)
+	}
 }
 
 func TestPasswordLoginInvalidCredentials(t *testing.T) {
@@ -233,6 +473,38 @@ func TestPasswordLoginInvalidCredentials(t *testing.T) {
 	}
 }
 
+func TestPasswordLoginIssuesNothingWithoutVerifiedPassword(t *testing.T) {
+	app := newTestApp(t)
+	seedPasskeyUser(t, app, "passkey@example.com", "cred-1")
+	seedPasswordUser(t, app, "carol@example.com", "correct-password")
+	var before int
+	app.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&before)
+
+	for _, body := range []string{
+		// A passkey-only user has no password, whatever is sent.
+		`{"email":"passkey@example.com","password":"password"}`,
+		`{"email":"passkey@example.com","password":""}`,
+		`{"email":"carol@example.com","password":"password"}`,
+	} {
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		app.passwordLoginHandler(w, req)
+
+		var result map[string]any
+		json.NewDecoder(w.Body).Decode(&result)
+		if w.Code != http.StatusUnauthorized || result["token"] != nil || len(w.Result().Cookies()) != 0 {
+			t.Fatalf("%s: expected 401 without credentials, got %d %v", body, w.Code, result)
+		}
+	}
+
+	var after int
+	app.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&after)
+	if after != before {
+		t.Fatalf("expected no sessions for failed logins, got %d new", after-before)
+	}
+}
+
 func TestPasswordLoginMethodNotAllowed(t *testing.T) {
 	app := newTestApp(t)
 
@@ -267,11 +539,21 @@ func TestCORSMiddleware(t *testing.T) {
 		t.Fatalf("expected origin 'http://localhost:3000', got %q", origin)
 	}
 
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatal("expected Access-Control-Allow-Credentials: true")
+	}
+
 	methods := resp.Header.Get("Access-Control-Allow-Methods")
 	if !strings.Contains(methods, "POST") {
 		t.Fatalf("expected CORS methods to include POST, got %q", methods)
 	}
 
+	// Bearer clients send their access token in Authorization.
+	headers := resp.Header.Get("Access-Control-Allow-Headers")
+	if !strings.Contains(headers, "Authorization") {
+		t.Fatalf("expected CORS headers to include Authorization, got %q", headers)
+	}
+
 	// Test regular request also gets CORS headers
 	req2 := httptest.NewRequest("GET", "/api/test", nil)
 	w2 := httptest.NewRecorder()
@@ -347,3 +629,316 @@ func TestDuplicateUserFails(t *testing.T) {
 		t.Fatal("expected error for duplicate username")
 	}
 }
+
+func TestSaveUserAssignsRandomHandle(t *testing.T) {
+	app := newTestApp(t)
+
+	a, err := app.saveUser("handle-a", "A")
+	if err != nil {
+		t.Fatalf("saveUser failed: %v", err)
+	}
+	b, err := app.saveUser("handle-b", "B")
+	if err != nil {
+		t.Fatalf("saveUser failed: %v", err)
+	}
+
+	if len(a.WebAuthnID()) != userHandleLen {
+		t.Fatalf("expected %d-byte handle, got %d", userHandleLen, len(a.WebAuthnID()))
+	}
+	if bytes.Equal(a.WebAuthnID(), b.WebAuthnID()) {
+		t.Fatal("expected distinct handles")
+	}
+	if string(a.WebAuthnID()) == strconv.Itoa(a.ID) {
+		t.Fatal("handle must not be the row ID")
+	}
+
+	fetched, err := app.getUserByHandle(b.Handle)
+	if err != nil {
+		t.Fatalf("getUserByHandle failed: %v", err)
+	}
+	if fetched.ID != b.ID || !bytes.Equal(fetched.WebAuthnID(), b.Handle) {
+		t.Fatalf("expected user %d with its handle, got %+v", b.ID, fetched)
+	}
+}
+
+func TestDiscoverUserUnknownHandle(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.saveUser("someone", "Someone"); err != nil {
+		t.Fatalf("saveUser failed: %v", err)
+	}
+
+	if _, err := app.discoverUser([]byte("cred"), []byte("1")); err == nil {
+		t.Fatal("expected numeric handle of a user without legacy passkeys to be rejected")
+	}
+}
+
+// usernameLoginBegin starts a username-first login and returns the options.
+func usernameLoginBegin(t *testing.T, app *App, username string) loginOptions {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/auth/login/begin", strings.NewReader(`{"username":"`+username+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	app.loginBegin(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login begin: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var opts loginOptions
+	if err := json.NewDecoder(w.Body).Decode(&opts); err != nil {
+		t.Fatalf("decode options: %v", err)
+	}
+	return opts
+}
+
+func TestUsernameLoginBeginListsCredentials(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1", "cred-2")
+
+	opts := usernameLoginBegin(t, app, "alice")
+
+	allowed := opts.Response.AllowedCredentials
+	if len(allowed) != 2 || string(allowed[0].CredentialID) != "cred-1" || string(allowed[1].CredentialID) != "cred-2" {
+		t.Fatalf("expected alice's credentials in allowCredentials, got %+v", allowed)
+	}
+	if len(allowed[0].Transport) != 1 || allowed[0].Transport[0] != "usb" {
+		t.Fatalf("expected transports to be included, got %v", allowed[0].Transport)
+	}
+
+	ceremony, err := app.ceremonies.Get(opts.CeremonyID)
+	if err != nil {
+		t.Fatalf("expected stored ceremony: %v", err)
+	}
+	if !bytes.Equal(ceremony.Session.UserID, user.Handle) {
+		t.Fatal("expected the ceremony to be bound to alice")
+	}
+}
+
+func TestUsernameLoginBeginUnknownUser(t *testing.T) {
+	app := newTestApp(t)
+	seedPasskeyUser(t, app, "alice", "cred-1")
+
+	first := usernameLoginBegin(t, app, "mallory")
+	second := usernameLoginBegin(t, app, "mallory")
+	other := usernameLoginBegin(t, app, "trent")
+
+	allowed := first.Response.AllowedCredentials
+	if len(allowed) == 0 || len(allowed) > maxStandInCredentials || len(allowed[0].CredentialID) == 0 || len(allowed[0].Transport) == 0 {
+		t.Fatalf("expected plausible stand-in credentials, got %+v", allowed)
+	}
+	if !bytes.Equal(allowed[0].CredentialID, second.Response.AllowedCredentials[0].CredentialID) {
+		t.Fatal("expected repeated requests for the same username to match")
+	}
+	if bytes.Equal(allowed[0].CredentialID, other.Response.AllowedCredentials[0].CredentialID) {
+		t.Fatal("expected different usernames to get different stand-ins")
+	}
+
+	// The finish step fails like any bad assertion.
+	body := `{"id":"test","rawId":"dGVzdA","type":"public-key","response":{}}`
+	req := httptest.NewRequest("POST", "/api/auth/login/finish?ceremony="+first.CeremonyID, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	app.loginFinish(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestUsernameLoginStandInsVary(t *testing.T) {
+	app := newTestApp(t)
+	counts := make(map[int]bool)
+	transports := make(map[string]bool)
+	for i := range 40 {
+		user := app.loginUser(fmt.Sprintf("user%d", i))
+		counts[len(user.Credentials)] = true
+		for _, c := range user.Credentials {
+			transports[fmt.Sprint(c.Transport)] = true
+		}
+	}
+	if len(counts) < 2 || len(transports) < 2 {
+		t.Fatalf("expected stand-ins to vary in count and transports, got counts %v and transports %v", counts, transports)
+	}
+}
+
+func TestUsernameLoginStandInSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passkeys.db")
+	open := func() *App {
+		app, err := NewApp(path, &webauthn.Config{
+			RPDisplayName: "Passkey Demo",
+			RPID:          "localhost",
+			RPOrigins:     []string{"http://localhost:3000"},
+		}, WithPasswordParams(testArgon2Params))
+		if err != nil {
+			t.Fatalf("NewApp: %v", err)
+		}
+		return app
+	}
+
+	app := open()
+	before := app.loginUser("mallory")
+	app.Close()
+	app = open()
+	defer app.Close()
+	after := app.loginUser("mallory")
+
+	if !bytes.Equal(before.Handle, after.Handle) || !bytes.Equal(before.Credentials[0].ID, after.Credentials[0].ID) {
+		t.Fatal("expected the stand-in for a username to stay the same across restarts")
+	}
+}
+
+func TestLoginBeginRejectsMalformedBody(t *testing.T) {
+	app := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin", strings.NewReader("{")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func conditionalLoginBegin(app *App) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin?mediation=conditional", nil))
+	return w
+}
+
+func TestConditionalLoginBegin(t *testing.T) {
+	app := newTestApp(t)
+	clock := newFakeClock()
+	store := NewMemoryCeremonyStore(100)
+	store.now = clock.Now
+	app.ceremonies = store
+
+	w := conditionalLoginBegin(app)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var conditional loginOptions
+	json.NewDecoder(w.Body).Decode(&conditional)
+	if conditional.Mediation != protocol.MediationConditional {
+		t.Fatalf("expected conditional mediation, got %q", conditional.Mediation)
+	}
+	if len(conditional.Response.AllowedCredentials) != 0 {
+		t.Fatal("expected a discoverable request without allowCredentials")
+	}
+
+	w = httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin", nil))
+	var modal loginOptions
+	json.NewDecoder(w.Body).Decode(&modal)
+
+	// A page left open outlives a normal challenge but not the conditional one.
+	clock.Advance(defaultCeremonyTTL + time.Minute)
+	if _, err := store.Get(modal.CeremonyID); !errors.Is(err, ErrCeremonyNotFound) {
+		t.Fatalf("expected the modal ceremony to expire, got %v", err)
+	}
+	ceremony, err := store.Get(conditional.CeremonyID)
+	if err != nil {
+		t.Fatalf("expected the conditional ceremony to still be valid: %v", err)
+	}
+	if ceremony.Kind != ceremonyLogin || len(ceremony.Session.UserID) != 0 {
+		t.Fatalf("expected a discoverable login ceremony, got %+v", ceremony)
+	}
+
+	clock.Advance(defaultConditionalCeremonyTTL)
+	if _, err := store.Get(conditional.CeremonyID); !errors.Is(err, ErrCeremonyNotFound) {
+		t.Fatalf("expected the conditional ceremony to expire eventually, got %v", err)
+	}
+}
+
+func TestConditionalLoginEnforcedTimeout(t *testing.T) {
+	app, err := NewApp(":memory:", &webauthn.Config{
+		RPDisplayName: "Passkey Demo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:3000"},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login: webauthn.TimeoutConfig{Enforce: true},
+		},
+	}, WithPasswordParams(testArgon2Params))
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	defer app.Close()
+
+	w := conditionalLoginBegin(app)
+	var opts loginOptions
+	json.NewDecoder(w.Body).Decode(&opts)
+	ceremony, err := app.ceremonies.Get(opts.CeremonyID)
+	if err != nil {
+		t.Fatalf("expected stored ceremony: %v", err)
+	}
+	if until := time.Until(ceremony.Session.Expires); until < defaultConditionalCeremonyTTL-time.Minute {
+		t.Fatalf("expected the session to stay valid for the conditional TTL, expires in %v", until)
+	}
+}
+
+func TestConditionalLoginRejectsUsername(t *testing.T) {
+	app := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin?mediation=conditional", strings.NewReader(`{"username":"alice"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	app.loginBegin(w, httptest.NewRequest("POST", "/api/auth/login/begin?mediation=silent", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unsupported mediation, got %d", w.Code)
+	}
+}
+
+func TestRegisterBeginExcludesExistingCredentials(t *testing.T) {
+	app := newTestApp(t)
+	_, cookie := seedPasskeyUser(t, app, "frank", "cred-1", "cred-2")
+
+	req := httptest.NewRequest("POST", "/api/auth/register/begin", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	app.registerBegin(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var opts registrationOptions
+	json.NewDecoder(w.Body).Decode(&opts)
+	excluded := opts.Response.CredentialExcludeList
+	if len(excluded) != 2 || string(excluded[0].CredentialID) != "cred-1" || string(excluded[1].CredentialID) != "cred-2" {
+		t.Fatalf("expected both passkeys in excludeCredentials, got %+v", excluded)
+	}
+	if len(excluded[0].Transport) != 1 || excluded[0].Transport[0] != protocol.USB {
+		t.Fatalf("expected transports on excluded credentials, got %+v", excluded[0].Transport)
+	}
+
+	// Sign-ups have nothing to exclude.
+	w = httptest.NewRecorder()
+	app.registerBegin(w, httptest.NewRequest("POST", "/api/auth/register/begin?username=grace", nil))
+	var signUp registrationOptions
+	json.NewDecoder(w.Body).Decode(&signUp)
+	if len(signUp.Response.CredentialExcludeList) != 0 {
+		t.Fatalf("expected no excluded credentials for a new user, got %+v", signUp.Response.CredentialExcludeList)
+	}
+}
+
+func TestSaveCredentialRejectsDuplicateID(t *testing.T) {
+	app := newTestApp(t)
+	alice, _ := seedPasskeyUser(t, app, "alice", "shared-cred")
+	bob, _ := seedPasskeyUser(t, app, "bob")
+
+	cred := webauthn.Credential{ID: []byte("shared-cred"), PublicKey: []byte("key")}
+	for _, user := range []*User{alice, bob} {
+		if err := app.saveCredential(user.ID, cred); !errors.Is(err, ErrCredentialExists) {
+			t.Fatalf("expected ErrCredentialExists for user %d, got %v", user.ID, err)
+		}
+	}
+	if exists, err := app.credentialExists([]byte("shared-cred")); err != nil || !exists {
+		t.Fatalf("expected credential to exist, got %v, %v", exists, err)
+	}
+
+	// A sign-up finishing with a registered credential creates no account.
+	pending := &PendingUser{Handle: []byte("carol-handle"), Name: "carol", DisplayName: "carol"}
+	if _, err := app.createUserWithCredential(pending, cred); !errors.Is(err, ErrCredentialExists) {
+		t.Fatalf("expected ErrCredentialExists, got %v", err)
+	}
+	if _, err := app.getUser("carol"); err == nil {
+		t.Fatal("expected the sign-up to be rolled back")
+	}
+}
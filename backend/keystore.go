@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeyStore persists the signing keys of a KeyRing. Save replaces the whole
+// set; Load returns no keys, not an error, if nothing was saved yet. Lock
+// holds off every other KeyRing using the same store, in this process or
+// another, until unlock is called, so rotations do not overwrite each other.
+type KeyStore interface {
+	Load() ([]*SigningKey, error)
+	Save(keys []*SigningKey) error
+	Lock() (unlock func(), err error)
+}
+
+// MemoryKeyStore keeps signing keys in memory, so tokens become invalid when
+// the process restarts.
+type MemoryKeyStore struct {
+	rotating sync.Mutex
+
+	mu   sync.Mutex
+	keys []*SigningKey
+}
+
+// NewMemoryKeyStore returns an empty MemoryKeyStore.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+// Load implements KeyStore.
+func (s *MemoryKeyStore) Load() ([]*SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*SigningKey(nil), s.keys...), nil
+}
+
+// Save implements KeyStore.
+func (s *MemoryKeyStore) Save(keys []*SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([]*SigningKey(nil), keys...)
+	return nil
+}
+
+// Lock implements KeyStore.
+func (s *MemoryKeyStore) Lock() (func(), error) {
+	s.rotating.Lock()
+	return s.rotating.Unlock, nil
+}
+
+// FileKeyStore keeps signing keys in a file encrypted with AES-256-GCM under
+// a key derived from a secret with Argon2id. The file is replaced atomically
+// on every save, and Lock takes an advisory lock on a ".lock" file next to
+// it, so replicas sharing the file rotate one at a time.
+type FileKeyStore struct {
+	path   string
+	secret []byte
+}
+
+// ErrKeyFileDecrypt is returned when the key file cannot be decrypted with
+// the configured secret.
+var ErrKeyFileDecrypt = errors.New("cannot decrypt signing key file: wrong secret or corrupted file")
+
+// keyFileVersion identifies the file layout; it is also authenticated as
+// additional data.
+const keyFileVersion = 1
+
+type keyFile struct {
+	Version    int          `json:"version"`
+	KDF        Argon2Params `json:"kdf"`
+	Salt       []byte       `json:"salt"`
+	Nonce      []byte       `json:"nonce"`
+	Ciphertext []byte       `json:"ciphertext"`
+}
+
+// storedSigningKey is the plaintext form of a SigningKey.
+type storedSigningKey struct {
+	Algorithm   SigningAlgorithm `json:"alg"`
+	PrivateKey  []byte           `json:"private_key"` // PKCS #8 DER
+	CreatedAt   time.Time        `json:"created_at"`
+	ActivatesAt time.Time        `json:"activates_at"`
+}
+
+// NewFileKeyStore returns a store for the file at path. The file is created
+// on the first save.
+func NewFileKeyStore(path string, secret []byte) (*FileKeyStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("signing key file secret is empty")
+	}
+	return &FileKeyStore{path: path, secret: secret}, nil
+}
+
+func (s *FileKeyStore) aead(p Argon2Params, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(argon2.IDKey(s.secret, salt, p.Iterations, p.Memory, p.Parallelism, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func keyFileAD(version int) []byte {
+	return fmt.Appendf(nil, "signing-keys v%d", version)
+}
+
+// Load implements KeyStore.
+func (s *FileKeyStore) Load() ([]*SigningKey, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	if f.Version != keyFileVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", s.path, f.Version)
+	}
+	aead, err := s.aead(f.KDF, f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, ErrKeyFileDecrypt
+	}
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, keyFileAD(f.Version))
+	if err != nil {
+		return nil, ErrKeyFileDecrypt
+	}
+
+	var stored []storedSigningKey
+	if err := json.Unmarshal(plaintext, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	keys := make([]*SigningKey, 0, len(stored))
+	for _, sk := range stored {
+		priv, err := x509.ParsePKCS8PrivateKey(sk.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: %T is not a signing key", s.path, priv)
+		}
+		k, err := newSigningKey(sk.Algorithm, signer, sk.CreatedAt, sk.ActivatesAt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Save implements KeyStore.
+func (s *FileKeyStore) Save(keys []*SigningKey) error {
+	stored := make([]storedSigningKey, len(keys))
+	for i, k := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+		if err != nil {
+			return err
+		}
+		stored[i] = storedSigningKey{Algorithm: k.Algorithm, PrivateKey: der, CreatedAt: k.CreatedAt, ActivatesAt: k.ActivatesAt}
+	}
+	plaintext, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	f := keyFile{Version: keyFileVersion, KDF: defaultArgon2Params, Salt: make([]byte, 16)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return err
+	}
+	aead, err := s.aead(f.KDF, f.Salt)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return err
+	}
+	f.Ciphertext = aead.Seal(nil, f.Nonce, plaintext, keyFileAD(f.Version))
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Lock implements KeyStore.
+func (s *FileKeyStore) Lock() (func(), error) {
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", f.Name(), err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileKeyStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-keys.json")
+	store, err := NewFileKeyStore(path, []byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatalf("NewFileKeyStore: %v", err)
+	}
+	if keys, err := store.Load(); err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys before the first save, got %d, %v", len(keys), err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var want []*SigningKey
+	for _, alg := range []SigningAlgorithm{SigningEdDSA, SigningES256} {
+		k, err := generateSigningKey(alg, now, now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("generateSigningKey: %v", err)
+		}
+		want = append(want, k)
+	}
+	if err := store.Save(want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	for _, k := range want {
+		der, _ := x509.MarshalPKCS8PrivateKey(k.Private)
+		if bytes.Contains(data, der) {
+			t.Fatal("expected private keys to be encrypted on disk")
+		}
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("expected the key file to be private, got %v", info.Mode().Perm())
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d keys, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Algorithm != want[i].Algorithm || !got[i].ActivatesAt.Equal(want[i].ActivatesAt) {
+			t.Fatalf("key %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestFileKeyStoreLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-keys.json")
+	a, _ := NewFileKeyStore(path, []byte("secret"))
+	b, _ := NewFileKeyStore(path, []byte("secret"))
+	unlock, err := a.Lock()
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		unlockB, err := b.Lock()
+		if err == nil {
+			unlockB()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected the second store to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second store to get the lock once released")
+	}
+}
+
+func TestFileKeyStoreWrongSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-keys.json")
+	store, _ := NewFileKeyStore(path, []byte("secret"))
+	if _, err := NewKeyRing(store, DefaultKeyRotation()); err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+
+	other, _ := NewFileKeyStore(path, []byte("other secret"))
+	if _, err := other.Load(); !errors.Is(err, ErrKeyFileDecrypt) {
+		t.Fatalf("expected ErrKeyFileDecrypt, got %v", err)
+	}
+	if _, err := NewFileKeyStore(path, nil); err == nil {
+		t.Fatal("expected an error for an empty secret")
+	}
+}
+
+func TestKeyRingSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-keys.json")
+	store, _ := NewFileKeyStore(path, []byte("secret"))
+	keys, err := NewKeyRing(store, DefaultKeyRotation())
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	ts, _ := NewTokenService(keys, "http://localhost:3000", time.Minute)
+	token, _, err := ts.Issue(&User{ID: 1, Handle: []byte("handle-1")}, AuthContext{Method: amrPassword})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	reloaded, err := NewKeyRing(store, DefaultKeyRotation())
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	ts, _ = NewTokenService(reloaded, "http://localhost:3000", time.Minute)
+	if _, err := ts.Verify(token); err != nil {
+		t.Fatalf("expected tokens to verify after a restart: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// sessionCookieName is the cookie carrying the opaque login session token.
+const sessionCookieName = "session"
+
+const defaultSessionTTL = 24 * time.Hour
+
+// ErrSessionNotFound is returned when a login session does not exist, has
+// expired or has been revoked.
+var ErrSessionNotFound = errors.New("session not found")
+
+// LoginSession is a server-side record of a successful login.
+type LoginSession struct {
+	ID           string
+	UserID       int
+	AuthMethod   string
+	CredentialID []byte // the passkey used, nil for a password login
+	AuthTime     time.Time
+	CreatedAt    time.Time
+	LastSeenAt   time.Time
+	ExpiresAt    time.Time
+	UserAgent    string
+	IP           string
+}
+
+// hashToken derives the stored ID of an opaque token held by the client, such
+// as a session cookie or password reset token, so a leaked database does not
+// hand out usable secrets.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createLoginSession records a new login session for userID, authenticated
+// with authMethod and, for passkey logins, credentialID. It returns the opaque
+// token to hand to the client.
+func (a *App) createLoginSession(userID int, authMethod string, credentialID []byte, r *http.Request) (string, *LoginSession, error) {
+	token, err := randomID(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+	s := &LoginSession{
+		ID:           hashToken(token),
+		UserID:       userID,
+		AuthMethod:   authMethod,
+		CredentialID: credentialID,
+		AuthTime:     now,
+		CreatedAt:    now,
+		LastSeenAt:   now,
+		ExpiresAt:    now.Add(a.sessionTTL),
+		UserAgent:    r.UserAgent(),
+		IP:           a.clientIP(r),
+	}
+	_, err = a.db.Exec(`INSERT INTO sessions (id, user_id, auth_method, credential_id, auth_time, created_at, last_seen_at, expires_at, user_agent, ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.UserID, s.AuthMethod, s.CredentialID, s.AuthTime, s.CreatedAt, s.LastSeenAt, s.ExpiresAt, s.UserAgent, s.IP)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, s, nil
+}
+
+// getLoginSession looks up the live session for token and records that it
+// was seen.
+func (a *App) getLoginSession(token string) (*LoginSession, error) {
+	return a.getLoginSessionByID(hashToken(token))
+}
+
+// getLoginSessionByID looks up the live session with id, as named by the sid
+// claim of access tokens, and records that it was seen.
+func (a *App) getLoginSessionByID(id string) (*LoginSession, error) {
+	now := time.Now().UTC()
+	var s LoginSession
+	err := a.db.QueryRow(`SELECT id, user_id, auth_method, credential_id, auth_time, created_at, last_seen_at, expires_at, user_agent, ip
+		FROM sessions WHERE id = ? AND revoked_at IS NULL AND expires_at > ?`,
+		id, now).
+		Scan(&s.ID, &s.UserID, &s.AuthMethod, &s.CredentialID, &s.AuthTime, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.UserAgent, &s.IP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := a.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", now, s.ID); err != nil {
+		return nil, err
+	}
+	s.LastSeenAt = now
+	return &s, nil
+}
+
+// revokeLoginSession ends the session for token.
+func (a *App) revokeLoginSession(token string) error {
+	_, err := a.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), hashToken(token))
+	return err
+}
+
+// currentSession returns the login session named by the request's session
+// cookie, along with its user.
+func (a *App) currentSession(r *http.Request) (*LoginSession, *User, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, nil, ErrSessionNotFound
+	}
+	s, err := a.getLoginSession(cookie.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := a.getUserByID(s.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, user, nil
+}
+
+// authenticatedUser resolves the user behind a request from its session
+// cookie or, failing that, its bearer access token. Handlers that require a
+// user should sit behind RequireAuth instead.
+func (a *App) authenticatedUser(r *http.Request) (*User, error) {
+	user, _, err := a.authenticate(r)
+	return user, err
+}
+
+func (a *App) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *App) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := a.revokeLoginSession(cookie.Value); err != nil {
+			jsonError(w, "Failed to end session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	a.clearSessionCookie(w)
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+func (a *App) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	s, user, err := a.currentSession(r)
+	if err != nil {
+		jsonError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	jsonResponse(w, map[string]any{
+		"user": map[string]string{
+			"username":    user.Name,
+			"displayName": user.DisplayName,
+		},
+		"authMethod": s.AuthMethod,
+		"createdAt":  s.CreatedAt,
+		"expiresAt":  s.ExpiresAt,
+	})
+}
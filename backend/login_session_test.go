@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedPasswordUser creates a user who logs in with password.
+func seedPasswordUser(t *testing.T, app *App, email, password string) *User {
+	t.Helper()
+	user, err := app.saveUser(email, email)
+	if err != nil {
+		t.Fatalf("saveUser: %v", err)
+	}
+	if err := app.setPassword(user.ID, password); err != nil {
+		t.Fatalf("setPassword: %v", err)
+	}
+	return user
+}
+
+// passwordLogin performs a password login with the password "password" and
+// returns the session cookie.
+func passwordLogin(t *testing.T, app *App, email string) *http.Cookie {
+	t.Helper()
+	return passwordLoginWith(t, app, email, "password")
+}
+
+// passwordLoginWith performs a password login and returns the session cookie.
+func passwordLoginWith(t *testing.T, app *App, email, password string) *http.Cookie {
+	t.Helper()
+	body := `{"email":"` + email + `","password":"` + password + `"}`
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	app.passwordLoginHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d", w.Code)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	t.Fatal("login response did not set a session cookie")
+	return nil
+}
+
+func TestLoginSetsSecureSessionCookie(t *testing.T) {
+	app := newTestApp(t)
+	seedPasswordUser(t, app, "alice@example.com", "password")
+
+	cookie := passwordLogin(t, app, "alice@example.com")
+
+	if !cookie.HttpOnly {
+		t.Fatal("expected HttpOnly session cookie")
+	}
+	if !cookie.Secure {
+		t.Fatal("expected Secure session cookie")
+	}
+	if cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected SameSite=Lax, got %v", cookie.SameSite)
+	}
+	if cookie.Value == "" {
+		t.Fatal("expected session token in cookie")
+	}
+}
+
+func TestSessionEndpointReturnsCurrentUser(t *testing.T) {
+	app := newTestApp(t)
+	seedPasswordUser(t, app, "alice@example.com", "password")
+	cookie := passwordLogin(t, app, "alice@example.com")
+
+	req := httptest.NewRequest("GET", "/api/auth/session", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	app.sessionHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		User struct {
+			Username string `json:"username"`
+		} `json:"user"`
+		AuthMethod string `json:"authMethod"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if body.User.Username != "alice@example.com" {
+		t.Fatalf("expected username 'alice@example.com', got %q", body.User.Username)
+	}
+	if body.AuthMethod != amrPassword {
+		t.Fatalf("expected authMethod %q, got %q", amrPassword, body.AuthMethod)
+	}
+}
+
+func TestSessionEndpointWithoutCookie(t *testing.T) {
+	app := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	app.sessionHandler(w, httptest.NewRequest("GET", "/api/auth/session", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	app := newTestApp(t)
+	seedPasswordUser(t, app, "alice@example.com", "password")
+	cookie := passwordLogin(t, app, "alice@example.com")
+
+	req := httptest.NewRequest("POST", "/api/auth/logout", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	app.logoutHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatal("expected logout to clear the session cookie")
+	}
+
+	// Replaying the old cookie must no longer work.
+	req = httptest.NewRequest("GET", "/api/auth/session", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	app.sessionHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after logout, got %d", w.Code)
+	}
+}
+
+func TestExpiredSessionRejected(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := app.saveUser("alice", "Alice")
+	app.sessionTTL = -time.Minute
+
+	token, _, err := app.createLoginSession(user.ID, amrHardwareKey, nil, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatalf("createLoginSession: %v", err)
+	}
+	if _, err := app.getLoginSession(token); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound for expired session, got %v", err)
+	}
+}
+
+func TestSessionStoresHashedToken(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := app.saveUser("alice", "Alice")
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	token, s, err := app.createLoginSession(user.ID, amrHardwareKey, nil, req)
+	if err != nil {
+		t.Fatalf("createLoginSession: %v", err)
+	}
+
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ?", token).Scan(&count)
+	if count != 0 {
+		t.Fatal("expected raw session token not to be stored")
+	}
+
+	got, err := app.getLoginSession(token)
+	if err != nil {
+		t.Fatalf("getLoginSession: %v", err)
+	}
+	if got.ID != s.ID || got.UserAgent != "test-agent" || got.IP != "192.0.2.1" {
+		t.Fatalf("unexpected session %+v", got)
+	}
+}
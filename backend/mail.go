@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailMessage is a plain-text email.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing mail. The outbox calls Send from a single
+// background goroutine and retries messages whose Send failed.
+type Mailer interface {
+	Send(msg MailMessage) error
+}
+
+// errHeaderInjection is returned for header values containing line breaks.
+var errHeaderInjection = errors.New("mail header contains a line break")
+
+// SMTPMailer sends mail through an SMTP server.
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth // nil for servers that need no authentication
+}
+
+// NewSMTPMailer creates an SMTPMailer. Username and password are optional;
+// when set, PLAIN authentication is used, which net/smtp only allows over TLS
+// or to localhost.
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send delivers msg.
+func (m *SMTPMailer) Send(msg MailMessage) error {
+	data, err := formatMail(m.From, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, data)
+}
+
+// formatMail renders msg as an RFC 5322 message.
+func formatMail(from string, msg MailMessage) ([]byte, error) {
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, errHeaderInjection
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+// LogMailer writes mail to the process log instead of sending it. It is meant
+// for local development.
+type LogMailer struct{}
+
+// Send logs msg.
+func (LogMailer) Send(msg MailMessage) error {
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileMailer appends mail to a file instead of sending it, so local setups
+// and tests can read what would have been sent.
+type FileMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileMailer creates a FileMailer appending to path.
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{path: path}
+}
+
+// Send appends msg to the file.
+func (m *FileMailer) Send(msg MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "To: %s\nSubject: %s\n\n%s\n\n", msg.To, msg.Subject, msg.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
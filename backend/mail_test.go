@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatMail(t *testing.T) {
+	data, err := formatMail("no-reply@example.com", MailMessage{To: "a@example.com", Subject: "Hi", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatalf("formatMail: %v", err)
+	}
+	s := string(data)
+	for _, want := range []string{"From: no-reply@example.com\r\n", "To: a@example.com\r\n", "Subject: Hi\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("expected %q in %q", want, s)
+		}
+	}
+}
+
+func TestFormatMailRejectsHeaderInjection(t *testing.T) {
+	_, err := formatMail("no-reply@example.com", MailMessage{To: "a@example.com\r\nBcc: b@example.com", Subject: "Hi"})
+	if !errors.Is(err, errHeaderInjection) {
+		t.Fatalf("expected errHeaderInjection, got %v", err)
+	}
+}
+
+func TestFileMailerAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	m := NewFileMailer(path)
+	m.Send(MailMessage{To: "a@example.com", Subject: "First", Body: "one"})
+	m.Send(MailMessage{To: "b@example.com", Subject: "Second", Body: "two"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read mail file: %v", err)
+	}
+	if !strings.Contains(string(data), "Subject: First") || !strings.Contains(string(data), "Subject: Second") {
+		t.Fatalf("expected both messages, got %q", data)
+	}
+}
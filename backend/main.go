@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
@@ -16,13 +25,117 @@ func envOr(key, fallback string) string {
 	return fallback
 }
 
+// envDuration parses a time.Duration from the environment, exiting on
+// malformed values so misconfiguration is caught at startup.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return d
+}
+
+// envInt parses an integer from the environment, exiting on malformed values.
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return n
+}
+
+// localOrigin reports whether origin points at this machine. Anything else is
+// treated as a deployment, where settings that only suit development must be
+// given explicitly.
+func localOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// registrationPolicyFromEnv reads the REGISTRATION_* settings, starting from
+// DefaultRegistrationPolicy, and exits on invalid values.
+func registrationPolicyFromEnv() RegistrationPolicy {
+	p := DefaultRegistrationPolicy()
+	p.ResidentKey = protocol.ResidentKeyRequirement(envOr("REGISTRATION_RESIDENT_KEY", string(p.ResidentKey)))
+	p.UserVerification = protocol.UserVerificationRequirement(envOr("REGISTRATION_USER_VERIFICATION", string(p.UserVerification)))
+	p.Attachment = protocol.AuthenticatorAttachment(os.Getenv("REGISTRATION_ATTACHMENT"))
+	p.Attestation = protocol.ConveyancePreference(envOr("REGISTRATION_ATTESTATION", string(p.Attestation)))
+	if v := os.Getenv("REGISTRATION_ALGORITHMS"); v != "" {
+		algs, err := ParseCOSEAlgorithms(v)
+		if err != nil {
+			log.Fatalf("invalid REGISTRATION_ALGORITHMS: %v", err)
+		}
+		p.Algorithms = algs
+	}
+	p.Timeout = envDuration("REGISTRATION_TIMEOUT", p.Timeout)
+	p.Hints = ParsePublicKeyCredentialHints(os.Getenv("REGISTRATION_HINTS"))
+	if err := p.Validate(); err != nil {
+		log.Fatalf("invalid registration policy: %v", err)
+	}
+	return p
+}
+
+// tokenServiceFromEnv sets up access token signing from the SIGNING_KEY*
+// settings, exiting on invalid values. Without SIGNING_KEYS_SECRET the keys
+// are kept in memory only, which production does not allow: every restart
+// would invalidate all access tokens and approvals.
+func tokenServiceFromEnv(rpOrigin string, production bool) *TokenService {
+	rotation := DefaultKeyRotation()
+	alg, err := ParseSigningAlgorithm(envOr("SIGNING_KEY_ALGORITHM", string(rotation.Algorithm)))
+	if err != nil {
+		log.Fatalf("invalid SIGNING_KEY_ALGORITHM: %v", err)
+	}
+	rotation.Algorithm = alg
+	rotation.Interval = envDuration("SIGNING_KEY_ROTATION", rotation.Interval)
+	rotation.PrePublish = envDuration("SIGNING_KEY_PREPUBLISH", rotation.PrePublish)
+	rotation.Retention = envDuration("SIGNING_KEY_RETENTION", rotation.Retention)
+
+	var store KeyStore
+	if secret := os.Getenv("SIGNING_KEYS_SECRET"); secret != "" {
+		if store, err = NewFileKeyStore(envOr("SIGNING_KEYS_FILE", "./signing-keys.json"), []byte(secret)); err != nil {
+			log.Fatalf("invalid SIGNING_KEYS_FILE: %v", err)
+		}
+	} else {
+		if production {
+			log.Fatal("SIGNING_KEYS_SECRET must be set when RP_ORIGIN is not a local origin")
+		}
+		log.Println("SIGNING_KEYS_SECRET not set; using ephemeral signing keys")
+		store = NewMemoryKeyStore()
+	}
+	keys, err := NewKeyRing(store, rotation)
+	if err != nil {
+		log.Fatalf("signing keys: %v", err)
+	}
+	tokens, err := NewTokenService(keys, envOr("TOKEN_ISSUER", rpOrigin), envDuration("ACCESS_TOKEN_TTL", defaultAccessTokenTTL))
+	if err != nil {
+		log.Fatalf("token service: %v", err)
+	}
+	return tokens
+}
+
 // corsMiddleware wraps a handler and applies CORS headers to every response,
 // including preflight OPTIONS requests.
 func corsMiddleware(allowedOrigin string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -39,17 +152,123 @@ func main() {
 	rpDisplayName := envOr("RP_DISPLAY_NAME", "Passkey Demo")
 	rpOrigin := envOr("RP_ORIGIN", "http://localhost:3000")
 	dbPath := envOr("DB_PATH", "./auth.db")
+	production := !localOrigin(rpOrigin)
+
+	opts := []AppOption{
+		WithCeremonyTTL(envDuration("CEREMONY_TTL", defaultCeremonyTTL)),
+		WithConditionalCeremonyTTL(envDuration("CONDITIONAL_CEREMONY_TTL", defaultConditionalCeremonyTTL)),
+		WithSessionTTL(envDuration("SESSION_TTL", defaultSessionTTL)),
+		WithRefreshTokenTTL(envDuration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)),
+		WithSecureCookies(envOr("COOKIE_SECURE", "true") != "false"),
+		WithPasskeyUpgradeWindow(envDuration("PASSKEY_UPGRADE_WINDOW", defaultUpgradeWindow)),
+		WithApprovalTTL(envDuration("APPROVAL_TTL", defaultApprovalTTL)),
+	}
+	clonePolicy, err := ParseCloneWarningPolicy(envOr("CLONE_WARNING_POLICY", string(CloneWarningLog)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts,
+		WithTrustedProxies(trustedProxies),
+		WithCloneWarningPolicy(clonePolicy),
+		WithRegistrationPolicy(registrationPolicyFromEnv()),
+	)
+
+	aaguids := NewAAGUIDRegistry()
+	if path := os.Getenv("AAGUID_REGISTRY"); path != "" {
+		if err := aaguids.LoadFile(path); err != nil {
+			log.Fatalf("invalid AAGUID_REGISTRY: %v", err)
+		}
+	}
+	opts = append(opts, WithAAGUIDRegistry(aaguids))
+
+	allow, err := ParseAAGUIDList(os.Getenv("AAGUID_ALLOWLIST"))
+	if err != nil {
+		log.Fatalf("invalid AAGUID_ALLOWLIST: %v", err)
+	}
+	deny, err := ParseAAGUIDList(os.Getenv("AAGUID_DENYLIST"))
+	if err != nil {
+		log.Fatalf("invalid AAGUID_DENYLIST: %v", err)
+	}
+	opts = append(opts, WithAAGUIDPolicy(AAGUIDPolicy{Allow: allow, Deny: deny}))
+
+	var mds *MetadataService
+	if path := os.Getenv("MDS_BLOB"); path != "" {
+		var root *x509.Certificate
+		if rootPath := os.Getenv("MDS_ROOT_CERT"); rootPath != "" {
+			if root, err = LoadCertificatePEM(rootPath); err != nil {
+				log.Fatalf("invalid MDS_ROOT_CERT: %v", err)
+			}
+		}
+		if mds, err = NewMetadataService(path, root); err != nil {
+			log.Fatalf("invalid MDS_BLOB: %v", err)
+		}
+		log.Printf("loaded metadata BLOB %d", mds.Number())
+		opts = append(opts, WithMetadataService(mds))
+	}
+
+	maxCeremonies := envInt("MAX_PENDING_CEREMONIES", defaultMaxCeremonies)
+	switch store := envOr("CEREMONY_STORE", "memory"); store {
+	case "memory":
+		opts = append(opts, WithCeremonyStore(NewMemoryCeremonyStore(maxCeremonies)))
+	case "sqlite":
+		opts = append(opts, WithSQLiteCeremonyStore(maxCeremonies))
+	default:
+		log.Fatalf("invalid CEREMONY_STORE %q: want memory or sqlite", store)
+	}
+	// The log mailer would leave reset links in the logs and users without
+	// mail, so a deployment has to choose a mailer.
+	mailer := os.Getenv("MAILER")
+	if mailer == "" {
+		if production {
+			log.Fatal("MAILER must be set when RP_ORIGIN is not a local origin")
+		}
+		mailer = "log"
+	}
+	switch mailer {
+	case "log":
+		opts = append(opts, WithMailer(LogMailer{}))
+	case "file":
+		opts = append(opts, WithMailer(NewFileMailer(envOr("MAIL_FILE", "./mail.log"))))
+	case "smtp":
+		opts = append(opts, WithMailer(NewSMTPMailer(
+			envOr("SMTP_ADDR", "localhost:25"),
+			envOr("MAIL_FROM", "no-reply@"+rpID),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+		)))
+	default:
+		log.Fatalf("invalid MAILER %q: want log, file or smtp", mailer)
+	}
+	opts = append(opts,
+		WithPasswordResetTTL(envDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL)),
+		WithPasswordResetURL(envOr("PASSWORD_RESET_URL", rpOrigin+"/reset-password")),
+	)
+
+	opts = append(opts, WithTokenService(tokenServiceFromEnv(rpOrigin, production)))
 
 	app, err := NewApp(dbPath, &webauthn.Config{
 		RPDisplayName: rpDisplayName,
 		RPID:          rpID,
 		RPOrigins:     []string{rpOrigin},
-	})
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true},
+			Registration: webauthn.TimeoutConfig{Enforce: true},
+		},
+	}, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Sensitive operations need a passkey assertion from the last few
+	// minutes, not just a live session.
+	recent := app.RequireRecentAuth(envDuration("REAUTH_MAX_AGE", defaultReauthMaxAge))
+
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jwks.json", app.jwksHandler)
 	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
@@ -58,9 +277,61 @@ func main() {
 	mux.HandleFunc("/api/auth/register/finish", app.registerFinish)
 	mux.HandleFunc("/api/auth/login/begin", app.loginBegin)
 	mux.HandleFunc("/api/auth/login/finish", app.loginFinish)
+	mux.HandleFunc("/api/auth/logout", app.logoutHandler)
+	mux.HandleFunc("/api/auth/session", app.sessionHandler)
+	mux.HandleFunc("POST /api/auth/token/refresh", app.refreshTokenHandler)
+	mux.Handle("POST /api/auth/reauth/begin", app.RequireAuth(http.HandlerFunc(app.reauthBegin)))
+	mux.Handle("POST /api/auth/reauth/finish", app.RequireAuth(http.HandlerFunc(app.reauthFinish)))
+	mux.Handle("POST /api/auth/password", app.RequireAuth(recent(http.HandlerFunc(app.setPasswordHandler))))
+	mux.HandleFunc("POST /api/auth/password/forgot", app.forgotPasswordHandler)
+	mux.HandleFunc("POST /api/auth/password/reset", app.resetPasswordHandler)
+	mux.Handle("GET /api/me", app.RequireAuth(http.HandlerFunc(app.meHandler)))
+	mux.Handle("GET /api/passkeys", app.RequireAuth(http.HandlerFunc(app.listPasskeysHandler)))
+	mux.Handle("PATCH /api/passkeys/{id}", app.RequireAuth(http.HandlerFunc(app.renamePasskeyHandler)))
+	mux.Handle("DELETE /api/passkeys/{id}", app.RequireAuth(recent(http.HandlerFunc(app.deletePasskeyHandler))))
+	mux.Handle("POST /api/approvals/begin", app.RequireAuth(http.HandlerFunc(app.approvalBegin)))
+	mux.Handle("POST /api/approvals/finish", app.RequireAuth(http.HandlerFunc(app.approvalFinish)))
+	mux.Handle("POST /api/approvals/redeem", app.RequireAuth(http.HandlerFunc(app.redeemApprovalHandler)))
+
+	srv := &http.Server{Addr: ":" + port, Handler: corsMiddleware(rpOrigin, mux)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP reloads the metadata BLOB, e.g. after a cron job downloads a
+	// new one.
+	if mds != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := mds.Reload(); err != nil {
+					log.Printf("reload metadata BLOB: %v", err)
+					continue
+				}
+				log.Printf("reloaded metadata BLOB %d", mds.Number())
+			}
+		}()
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		defer close(idle)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
 
 	fmt.Printf("Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, corsMiddleware(rpOrigin, mux)); err != nil {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	<-idle
+
+	if err := app.Close(); err != nil {
+		log.Printf("close app: %v", err)
+	}
 }
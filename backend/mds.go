@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/metadata/providers/memory"
+	"github.com/google/uuid"
+)
+
+// MetadataService checks attestation statements against a FIDO Metadata
+// Service (MDS3) BLOB read from disk: the authenticator must be listed, its
+// attestation must chain to the listed trust anchors, and none of its status
+// reports may be undesired (revoked or compromised). It implements
+// metadata.Provider and can be reloaded while the server is running.
+type MetadataService struct {
+	path string
+	root string // base64 DER, as the metadata decoder expects
+
+	mu         sync.RWMutex
+	provider   metadata.Provider
+	number     int
+	nextUpdate time.Time
+}
+
+// NewMetadataService loads the BLOB at path and verifies its signature
+// against root. A nil root means the FIDO Alliance production root.
+func NewMetadataService(path string, root *x509.Certificate) (*MetadataService, error) {
+	m := &MetadataService{path: path, root: metadata.ProductionMDSRoot}
+	if root != nil {
+		m.root = base64.StdEncoding.EncodeToString(root.Raw)
+	}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the BLOB file again. If the new BLOB fails to load, the
+// previous one stays in use.
+func (m *MetadataService) Reload() error {
+	blob, err := os.ReadFile(m.path)
+	if err != nil {
+		return fmt.Errorf("read metadata BLOB: %w", err)
+	}
+
+	decoder, err := metadata.NewDecoder(metadata.WithRootCertificate(m.root), metadata.WithIgnoreEntryParsingErrors())
+	if err != nil {
+		return err
+	}
+	payload, err := decoder.DecodeBytes(blob)
+	if err != nil {
+		return fmt.Errorf("verify metadata BLOB: %w", err)
+	}
+	parsed, err := decoder.Parse(payload)
+	if err != nil {
+		return fmt.Errorf("parse metadata BLOB: %w", err)
+	}
+	if n := len(parsed.Unparsed); n > 0 {
+		log.Printf("metadata BLOB %d: skipped %d entries that failed to parse", parsed.Parsed.Number, n)
+	}
+	if time.Now().After(parsed.Parsed.NextUpdate) {
+		log.Printf("metadata BLOB %d is stale: next update was due %s", parsed.Parsed.Number, parsed.Parsed.NextUpdate.Format(time.DateOnly))
+	}
+
+	provider, err := memory.New(
+		memory.WithMetadata(parsed.ToMap()),
+		memory.WithValidateEntry(true),
+		memory.WithValidateTrustAnchor(true),
+		memory.WithValidateStatus(true),
+		memory.WithValidateAttestationTypes(true),
+		memory.WithStatusUndesired(metadata.DefaultUndesiredAuthenticatorStatuses()),
+	)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.provider != nil && parsed.Parsed.Number < m.number {
+		return fmt.Errorf("metadata BLOB %d is older than the loaded BLOB %d", parsed.Parsed.Number, m.number)
+	}
+	m.provider = provider
+	m.number = parsed.Parsed.Number
+	m.nextUpdate = parsed.Parsed.NextUpdate
+	return nil
+}
+
+// Number is the serial number of the loaded BLOB.
+func (m *MetadataService) Number() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.number
+}
+
+func (m *MetadataService) current() metadata.Provider {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.provider
+}
+
+// GetEntry implements metadata.Provider.
+func (m *MetadataService) GetEntry(ctx context.Context, aaguid uuid.UUID) (*metadata.Entry, error) {
+	return m.current().GetEntry(ctx, aaguid)
+}
+
+// GetValidateEntry implements metadata.Provider.
+func (m *MetadataService) GetValidateEntry(ctx context.Context) bool {
+	return m.current().GetValidateEntry(ctx)
+}
+
+// GetValidateEntryPermitZeroAAGUID implements metadata.Provider.
+func (m *MetadataService) GetValidateEntryPermitZeroAAGUID(ctx context.Context) bool {
+	return m.current().GetValidateEntryPermitZeroAAGUID(ctx)
+}
+
+// GetValidateTrustAnchor implements metadata.Provider.
+func (m *MetadataService) GetValidateTrustAnchor(ctx context.Context) bool {
+	return m.current().GetValidateTrustAnchor(ctx)
+}
+
+// GetValidateStatus implements metadata.Provider.
+func (m *MetadataService) GetValidateStatus(ctx context.Context) bool {
+	return m.current().GetValidateStatus(ctx)
+}
+
+// GetValidateAttestationTypes implements metadata.Provider.
+func (m *MetadataService) GetValidateAttestationTypes(ctx context.Context) bool {
+	return m.current().GetValidateAttestationTypes(ctx)
+}
+
+// ValidateStatusReports implements metadata.Provider.
+func (m *MetadataService) ValidateStatusReports(ctx context.Context, reports []metadata.StatusReport) error {
+	return m.current().ValidateStatusReports(ctx, reports)
+}
+
+var _ metadata.Provider = (*MetadataService)(nil)
+
+// LoadCertificatePEM reads a single PEM-encoded certificate, such as the MDS
+// root certificate.
+func LoadCertificatePEM(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
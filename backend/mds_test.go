@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// testMDSSigner is a throwaway root -> intermediate -> leaf chain that signs
+// metadata BLOBs the way the FIDO Alliance does, so tests run offline.
+type testMDSSigner struct {
+	root    *x509.Certificate
+	chain   []string // leaf, intermediate as base64 DER
+	leafKey *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newTestMDSSigner(t *testing.T) *testMDSSigner {
+	t.Helper()
+	root, rootKey := newTestCert(t, "Test MDS Root", true, nil, nil)
+	inter, interKey := newTestCert(t, "Test MDS Intermediate", true, root, rootKey)
+	leaf, leafKey := newTestCert(t, "Test MDS Signer", false, inter, interKey)
+	return &testMDSSigner{
+		root: root,
+		chain: []string{
+			base64.StdEncoding.EncodeToString(leaf.Raw),
+			base64.StdEncoding.EncodeToString(inter.Raw),
+		},
+		leafKey: leafKey,
+	}
+}
+
+// testMDSEntry is a metadata BLOB entry for aaguid with the given status.
+func testMDSEntry(t *testing.T, aaguid string, status string) map[string]any {
+	t.Helper()
+	attRoot, _ := newTestCert(t, "Test Attestation Root", true, nil, nil)
+	return map[string]any{
+		"aaguid": aaguid,
+		"metadataStatement": map[string]any{
+			"aaguid":                      aaguid,
+			"description":                 "Test Authenticator " + aaguid[:8],
+			"attestationTypes":            []string{"basic_full"},
+			"attestationRootCertificates": []string{base64.StdEncoding.EncodeToString(attRoot.Raw)},
+		},
+		"statusReports":          []map[string]any{{"status": status, "effectiveDate": "2024-01-01"}},
+		"timeOfLastStatusChange": "2024-01-01",
+	}
+}
+
+// sign returns a BLOB with serial number no holding entries.
+func (s *testMDSSigner) sign(t *testing.T, no int, entries ...map[string]any) []byte {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"legalHeader": "test",
+		"no":          no,
+		"nextUpdate":  time.Now().AddDate(0, 1, 0).Format(time.DateOnly),
+		"entries":     entries,
+	})
+	token.Header["x5c"] = s.chain
+	blob, err := token.SignedString(s.leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(blob)
+}
+
+const (
+	certifiedAAGUID   = "11111111-1111-1111-1111-111111111111"
+	revokedAAGUID     = "22222222-2222-2222-2222-222222222222"
+	compromisedAAGUID = "33333333-3333-3333-3333-333333333333"
+)
+
+func writeBlob(t *testing.T, path string, blob []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, blob, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataServiceValidatesAuthenticators(t *testing.T) {
+	signer := newTestMDSSigner(t)
+	path := filepath.Join(t.TempDir(), "blob.jwt")
+	writeBlob(t, path, signer.sign(t, 1,
+		testMDSEntry(t, certifiedAAGUID, "FIDO_CERTIFIED"),
+		testMDSEntry(t, revokedAAGUID, "REVOKED"),
+		testMDSEntry(t, compromisedAAGUID, "ATTESTATION_KEY_COMPROMISE"),
+	))
+
+	mds, err := NewMetadataService(path, signer.root)
+	if err != nil {
+		t.Fatalf("NewMetadataService: %v", err)
+	}
+	if mds.Number() != 1 {
+		t.Fatalf("expected BLOB 1, got %d", mds.Number())
+	}
+
+	ctx := context.Background()
+	tests := []struct {
+		aaguid string
+		ok     bool
+	}{
+		{certifiedAAGUID, true},
+		{revokedAAGUID, false},
+		{compromisedAAGUID, false},
+		{"44444444-4444-4444-4444-444444444444", false}, // not listed
+	}
+	for _, tt := range tests {
+		err := protocol.ValidateMetadata(ctx, mds, uuid.MustParse(tt.aaguid), "basic_full", "packed", nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok=%v, got %v", tt.aaguid, tt.ok, err)
+		}
+	}
+}
+
+func TestMetadataServiceRejectsUntrustedBlob(t *testing.T) {
+	signer := newTestMDSSigner(t)
+	path := filepath.Join(t.TempDir(), "blob.jwt")
+	writeBlob(t, path, signer.sign(t, 1, testMDSEntry(t, certifiedAAGUID, "FIDO_CERTIFIED")))
+
+	other := newTestMDSSigner(t)
+	if _, err := NewMetadataService(path, other.root); err == nil {
+		t.Fatal("expected a BLOB signed under another root to be rejected")
+	}
+
+	writeBlob(t, path, []byte("not a jwt"))
+	if _, err := NewMetadataService(path, signer.root); err == nil {
+		t.Fatal("expected a malformed BLOB to be rejected")
+	}
+}
+
+func TestMetadataServiceReload(t *testing.T) {
+	signer := newTestMDSSigner(t)
+	path := filepath.Join(t.TempDir(), "blob.jwt")
+	writeBlob(t, path, signer.sign(t, 1, testMDSEntry(t, certifiedAAGUID, "FIDO_CERTIFIED")))
+
+	mds, err := NewMetadataService(path, signer.root)
+	if err != nil {
+		t.Fatalf("NewMetadataService: %v", err)
+	}
+	ctx := context.Background()
+	validate := func(aaguid string) error {
+		return protocol.ValidateMetadata(ctx, mds, uuid.MustParse(aaguid), "basic_full", "packed", nil)
+	}
+
+	// The next BLOB revokes the authenticator.
+	writeBlob(t, path, signer.sign(t, 2, testMDSEntry(t, certifiedAAGUID, "REVOKED")))
+	if err := mds.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if err := validate(certifiedAAGUID); err == nil {
+		t.Fatal("expected the reloaded BLOB to revoke the authenticator")
+	}
+
+	// A broken or rolled-back BLOB leaves the current one in place.
+	writeBlob(t, path, []byte("truncated"))
+	if err := mds.Reload(); err == nil {
+		t.Fatal("expected reloading a broken BLOB to fail")
+	}
+	writeBlob(t, path, signer.sign(t, 1, testMDSEntry(t, certifiedAAGUID, "FIDO_CERTIFIED")))
+	if err := mds.Reload(); err == nil {
+		t.Fatal("expected reloading an older BLOB to fail")
+	}
+	if mds.Number() != 2 || validate(certifiedAAGUID) == nil {
+		t.Fatal("expected BLOB 2 to stay loaded")
+	}
+}
+
+func TestNewAppWithMetadataServiceRequiresAttestation(t *testing.T) {
+	signer := newTestMDSSigner(t)
+	path := filepath.Join(t.TempDir(), "blob.jwt")
+	writeBlob(t, path, signer.sign(t, 1, testMDSEntry(t, certifiedAAGUID, "FIDO_CERTIFIED")))
+	mds, err := NewMetadataService(path, signer.root)
+	if err != nil {
+		t.Fatalf("NewMetadataService: %v", err)
+	}
+	config := func() *webauthn.Config {
+		return &webauthn.Config{
+			RPDisplayName: "Passkey Demo",
+			RPID:          "localhost",
+			RPOrigins:     []string{"http://localhost:3000"},
+		}
+	}
+
+	if _, err := NewApp(":memory:", config(), WithMetadataService(mds)); err == nil {
+		t.Fatal("expected NewApp to refuse metadata checks without attestation")
+	}
+
+	policy := DefaultRegistrationPolicy()
+	policy.Attestation = protocol.PreferDirectAttestation
+	app, err := NewApp(":memory:", config(), WithMetadataService(mds), WithRegistrationPolicy(policy))
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	defer app.Close()
+	if app.webAuthn.Config.MDS != mds {
+		t.Fatal("expected the metadata service to be used for attestation")
+	}
+}
+
+func TestLoadCertificatePEM(t *testing.T) {
+	cert, _ := newTestCert(t, "Test Root", true, nil, nil)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "root.pem")
+	writeBlob(t, path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	loaded, err := LoadCertificatePEM(path)
+	if err != nil {
+		t.Fatalf("LoadCertificatePEM: %v", err)
+	}
+	if !loaded.Equal(cert) {
+		t.Fatal("expected the same certificate")
+	}
+
+	bad := filepath.Join(dir, "bad.pem")
+	writeBlob(t, bad, []byte("not pem"))
+	if _, err := LoadCertificatePEM(bad); err == nil {
+		t.Fatal("expected an error for a file without a certificate")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var v int
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&v); err != nil {
+		t.Fatalf("read schema version: %v", err)
+	}
+	return v
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	migrations, _ := loadMigrations()
+	latest := migrations[len(migrations)-1].version
+	if v := schemaVersion(t, db); v != latest {
+		t.Fatalf("expected schema version %d, got %d", latest, v)
+	}
+
+	// Running again is a no-op.
+	if err := migrate(db); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	var applied int
+	db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied)
+	if applied != len(migrations) {
+		t.Fatalf("expected %d recorded migrations, got %d", len(migrations), applied)
+	}
+}
+
+func TestLoadMigrationsOrdered(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("expected contiguous versions, got %d at position %d", m.version, i)
+		}
+	}
+}
+
+// legacyCredentialJSON is a credential in the pre-migration credential_json format.
+func legacyCredentialJSON(t *testing.T) string {
+	t.Helper()
+	data, err := json.Marshal(webauthn.Credential{
+		ID:              []byte("legacy-id"),
+		PublicKey:       []byte("legacy-public-key"),
+		AttestationType: "none",
+		Transport:       []protocol.AuthenticatorTransport{protocol.Internal, protocol.Hybrid},
+		Flags:           webauthn.CredentialFlags{UserPresent: true, UserVerified: true, BackupEligible: true},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:     []byte("0123456789abcdef"),
+			SignCount:  12,
+			Attachment: protocol.Platform,
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal credential: %v", err)
+	}
+	return string(data)
+}
+
+func TestMigrateUpgradesLegacyDatabase(t *testing.T) {
+	db := openTestDB(t)
+	for _, stmt := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, display_name TEXT)`,
+		`CREATE TABLE credentials (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, credential_json TEXT NOT NULL, FOREIGN KEY(user_id) REFERENCES users(id))`,
+		`INSERT INTO users (username, display_name) VALUES ('alice', 'alice')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("legacy schema: %v", err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO credentials (user_id, credential_json) VALUES (1, ?)", legacyCredentialJSON(t)); err != nil {
+		t.Fatalf("insert legacy credential: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	app := &App{db: db}
+	creds := app.getCredentialsForUser(1)
+	if len(creds) != 1 {
+		t.Fatalf("expected 1 migrated credential, got %d", len(creds))
+	}
+	c := creds[0]
+	if string(c.ID) != "legacy-id" || string(c.PublicKey) != "legacy-public-key" {
+		t.Fatalf("credential key material not preserved: %+v", c)
+	}
+	if c.Authenticator.SignCount != 12 || string(c.Authenticator.AAGUID) != "0123456789abcdef" {
+		t.Fatalf("authenticator data not preserved: %+v", c.Authenticator)
+	}
+	if len(c.Transport) != 2 || c.Transport[1] != protocol.Hybrid {
+		t.Fatalf("transports not preserved: %v", c.Transport)
+	}
+	if !c.Flags.UserVerified || !c.Flags.BackupEligible || c.Flags.BackupState {
+		t.Fatalf("flags not preserved: %+v", c.Flags)
+	}
+
+	passkeys, err := app.listPasskeys(1)
+	if err != nil {
+		t.Fatalf("listPasskeys: %v", err)
+	}
+	if passkeys[0].Name != "Platform authenticator" || passkeys[0].CreatedAt == nil {
+		t.Fatalf("expected default name and creation time, got %+v", passkeys[0])
+	}
+
+	var indexed int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_credentials_credential_id'").Scan(&indexed)
+	if indexed != 1 {
+		t.Fatal("expected credential ID index")
+	}
+}
+
+func TestMigrateCarriesInPlaceColumns(t *testing.T) {
+	db := openTestDB(t)
+	usedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, stmt := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, display_name TEXT)`,
+		`CREATE TABLE credentials (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, credential_json TEXT NOT NULL,
+			credential_id TEXT, name TEXT NOT NULL DEFAULT '', created_at DATETIME, last_used_at DATETIME, locked_at DATETIME)`,
+		`INSERT INTO users (username, display_name) VALUES ('alice', 'alice')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("legacy schema: %v", err)
+		}
+	}
+	_, err := db.Exec("INSERT INTO credentials (user_id, credential_json, name, created_at, last_used_at) VALUES (1, ?, 'My phone', ?, ?)",
+		legacyCredentialJSON(t), usedAt, usedAt)
+	if err != nil {
+		t.Fatalf("insert legacy credential: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	passkeys, err := (&App{db: db}).listPasskeys(1)
+	if err != nil {
+		t.Fatalf("listPasskeys: %v", err)
+	}
+	p := passkeys[0]
+	if p.Name != "My phone" {
+		t.Fatalf("expected name to be carried over, got %q", p.Name)
+	}
+	if p.LastUsedAt == nil || !p.LastUsedAt.Equal(usedAt) {
+		t.Fatalf("expected last used %v, got %v", usedAt, p.LastUsedAt)
+	}
+}
+
+func TestMigrateRollsBackFailedStep(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	before := schemaVersion(t, db)
+
+	bad := migration{version: before + 1, name: "broken", sql: "CREATE TABLE half_done (id INTEGER); SELECT * FROM missing_table;"}
+	if err := applyMigration(db, bad); err == nil {
+		t.Fatal("expected broken migration to fail")
+	}
+
+	if v := schemaVersion(t, db); v != before {
+		t.Fatalf("expected schema version to stay %d, got %d", before, v)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'").Scan(&n)
+	if n != 0 {
+		t.Fatal("expected partial migration to be rolled back")
+	}
+}
+
+func TestMigrateKeepsLegacyHandles(t *testing.T) {
+	db := openTestDB(t)
+	for _, stmt := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, display_name TEXT)`,
+		`CREATE TABLE credentials (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, credential_json TEXT NOT NULL, FOREIGN KEY(user_id) REFERENCES users(id))`,
+		`INSERT INTO users (username, display_name) VALUES ('alice', 'alice'), ('bob', 'bob')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("legacy schema: %v", err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO credentials (user_id, credential_json) VALUES (1, ?)", legacyCredentialJSON(t)); err != nil {
+		t.Fatalf("insert legacy credential: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	app := &App{db: db}
+
+	alice, err := app.getUserByID(1)
+	if err != nil {
+		t.Fatalf("getUserByID: %v", err)
+	}
+	if len(alice.Handle) != userHandleLen {
+		t.Fatalf("expected a random %d-byte handle, got %q", userHandleLen, alice.Handle)
+	}
+
+	// A passkey registered before the migration asserts the numeric handle.
+	discovered, err := app.discoverUser([]byte("legacy-id"), []byte("1"))
+	if err != nil {
+		t.Fatalf("discoverUser with legacy handle: %v", err)
+	}
+	user := discovered.(*User)
+	if user.ID != 1 || string(user.WebAuthnID()) != "1" {
+		t.Fatalf("expected alice to echo the legacy handle, got id %d handle %q", user.ID, user.WebAuthnID())
+	}
+	if user.Subject() != alice.Subject() {
+		t.Fatal("expected the subject to use the new handle")
+	}
+
+	// Bob had no passkeys, so nothing holds his numeric handle.
+	if _, err := app.getUserByHandle([]byte("2")); err == nil {
+		t.Fatal("expected bob's numeric handle not to resolve")
+	}
+	bob, err := app.getUserByID(2)
+	if err != nil {
+		t.Fatalf("getUserByID: %v", err)
+	}
+	if bytes.Equal(bob.Handle, alice.Handle) {
+		t.Fatal("expected distinct handles")
+	}
+}
+
+func TestMigrateCollapsesDuplicateCredentials(t *testing.T) {
+	db := openTestDB(t)
+	for _, stmt := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, display_name TEXT)`,
+		`CREATE TABLE credentials (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, credential_json TEXT NOT NULL, FOREIGN KEY(user_id) REFERENCES users(id))`,
+		`INSERT INTO users (username, display_name) VALUES ('alice', 'alice')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("legacy schema: %v", err)
+		}
+	}
+	// The same authenticator registered twice.
+	for range 2 {
+		if _, err := db.Exec("INSERT INTO credentials (user_id, credential_json) VALUES (1, ?)", legacyCredentialJSON(t)); err != nil {
+			t.Fatalf("insert legacy credential: %v", err)
+		}
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM credentials").Scan(&n)
+	if n != 1 {
+		t.Fatalf("expected duplicates to collapse into one credential, got %d", n)
+	}
+	var removedID, keptID int
+	var credID []byte
+	if err := db.QueryRow("SELECT id, kept_id, credential_id FROM removed_credentials").Scan(&removedID, &keptID, &credID); err != nil {
+		t.Fatalf("expected the removed duplicate to be kept for review: %v", err)
+	}
+	if removedID != 2 || keptID != 1 || string(credID) != "legacy-id" {
+		t.Fatalf("unexpected removed credential %d (kept %d, ID %q)", removedID, keptID, credID)
+	}
+	if _, err := db.Exec("INSERT INTO credentials (user_id, credential_id, public_key, created_at) VALUES (1, ?, x'00', ?)",
+		[]byte("legacy-id"), time.Now()); err == nil {
+		t.Fatal("expected the unique index to reject a duplicate credential ID")
+	}
+}
+
+func TestMigrateAddsRemovedCredentialsAfterFirstDedup(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	// A database whose migration 0007 deleted duplicates without keeping them.
+	for _, stmt := range []string{
+		"DROP TABLE removed_credentials",
+		"DELETE FROM schema_migrations WHERE version = 14",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	migrations, _ := loadMigrations()
+	if err := applyMigration(db, migrations[13]); err != nil {
+		t.Fatalf("migration %d: %v", migrations[13].version, err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM removed_credentials WHERE kept_id IS NOT NULL").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("expected an empty removed_credentials table, got %d, %v", n, err)
+	}
+}
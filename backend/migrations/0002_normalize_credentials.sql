@@ -0,0 +1,22 @@
+-- Split the credential_json blob into queryable columns. Rows are copied
+-- from the old table by the Go hook for this version, which then swaps the
+-- tables and creates the indexes.
+
+CREATE TABLE credentials_v2 (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	credential_id BLOB NOT NULL,
+	public_key BLOB NOT NULL,
+	aaguid BLOB,
+	sign_count INTEGER NOT NULL DEFAULT 0,
+	transports TEXT NOT NULL DEFAULT '',
+	flags INTEGER NOT NULL DEFAULT 0,
+	attachment TEXT NOT NULL DEFAULT '',
+	attestation_type TEXT NOT NULL DEFAULT '',
+	attestation TEXT NOT NULL DEFAULT '{}',
+	name TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME,
+	locked_at DATETIME,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
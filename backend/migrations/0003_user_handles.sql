@@ -0,0 +1,11 @@
+-- Random WebAuthn user handles replace the decimal row ID. Passkeys created
+-- before this migration hold the old handle, so it is kept as legacy_handle
+-- for users who have any.
+ALTER TABLE users ADD COLUMN user_handle BLOB;
+ALTER TABLE users ADD COLUMN legacy_handle BLOB;
+
+UPDATE users SET legacy_handle = CAST(CAST(id AS TEXT) AS BLOB)
+WHERE id IN (SELECT user_id FROM credentials);
+
+CREATE UNIQUE INDEX idx_users_user_handle ON users(user_handle);
+CREATE UNIQUE INDEX idx_users_legacy_handle ON users(legacy_handle);
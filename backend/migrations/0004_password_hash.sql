@@ -0,0 +1,3 @@
+-- Argon2id password hashes in PHC string format. NULL means the user has no
+-- password and can only log in with a passkey.
+ALTER TABLE users ADD COLUMN password_hash TEXT;
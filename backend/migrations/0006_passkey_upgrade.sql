@@ -0,0 +1,4 @@
+-- Progress of moving password users to passkeys: when a user was first
+-- offered a passkey after a password login, and when they accepted.
+ALTER TABLE users ADD COLUMN passkey_offered_at DATETIME;
+ALTER TABLE users ADD COLUMN passkey_upgraded_at DATETIME;
@@ -0,0 +1,15 @@
+-- A credential ID names one key pair on one authenticator, so it may be
+-- stored only once. Duplicates registered before this was enforced are
+-- collapsed onto the first row that was stored. The removed rows are kept in
+-- removed_credentials, next to the row they were collapsed onto, for review.
+CREATE TABLE removed_credentials AS
+SELECT c.*, k.kept_id, CURRENT_TIMESTAMP AS removed_at
+FROM credentials c
+JOIN (SELECT credential_id, MIN(id) AS kept_id FROM credentials GROUP BY credential_id) k
+	ON k.credential_id = c.credential_id
+WHERE c.id <> k.kept_id;
+
+DELETE FROM credentials WHERE id IN (SELECT id FROM removed_credentials);
+
+DROP INDEX IF EXISTS idx_credentials_credential_id;
+CREATE UNIQUE INDEX idx_credentials_credential_id ON credentials(credential_id);
@@ -0,0 +1,4 @@
+-- The authenticator name looked up from the AAGUID when the credential was
+-- registered, e.g. "iCloud Keychain". Unlike name it cannot be changed by
+-- the user. Existing rows are left empty and named when listed.
+ALTER TABLE credentials ADD COLUMN authenticator_name TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,17 @@
+-- Security-relevant events kept for review, such as authenticators refused
+-- by policy. user_id is NULL for sign-ups refused before the account exists;
+-- username is recorded either way.
+CREATE TABLE audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at DATETIME NOT NULL,
+	event TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	user_id INTEGER,
+	username TEXT NOT NULL DEFAULT '',
+	credential_id BLOB,
+	aaguid BLOB,
+	ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_audit_events_created_at ON audit_events(created_at);
@@ -0,0 +1,24 @@
+-- Refresh tokens, stored by their SHA-256 hash. Refreshing marks a token used
+-- and issues its successor in the same family, so every token descended from
+-- one login shares a family_id. session_id, auth_method and credential_id
+-- record how that login happened; auth_time is when.
+CREATE TABLE refresh_tokens (
+	id TEXT PRIMARY KEY,
+	family_id TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	session_id TEXT NOT NULL,
+	auth_method TEXT NOT NULL,
+	credential_id BLOB,
+	auth_time DATETIME NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used_at DATETIME,
+	revoked_at DATETIME,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+
+-- When the user last set or reset their password. Rehashing the same
+-- password with new parameters does not count as a change.
+ALTER TABLE users ADD COLUMN password_changed_at DATETIME;
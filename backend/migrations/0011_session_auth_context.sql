@@ -0,0 +1,5 @@
+-- How the user authenticated for a session: the passkey used (NULL for a
+-- password login) and when. auth_time starts as the login time.
+ALTER TABLE sessions ADD COLUMN credential_id BLOB;
+ALTER TABLE sessions ADD COLUMN auth_time DATETIME;
+UPDATE sessions SET auth_time = created_at;
@@ -0,0 +1,19 @@
+-- Actions approved with a passkey. The assertion signed payload_hash, the
+-- SHA-256 of the canonical approval document, and is kept as evidence.
+-- payload_hash is unique so one signature can only ever approve once, and
+-- redeemed_at marks the approval as spent by the service that acted on it.
+CREATE TABLE approvals (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	payload_hash BLOB NOT NULL UNIQUE,
+	credential_id BLOB NOT NULL,
+	authenticator_data BLOB NOT NULL,
+	client_data_json BLOB NOT NULL,
+	signature BLOB NOT NULL,
+	approved_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	redeemed_at DATETIME,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
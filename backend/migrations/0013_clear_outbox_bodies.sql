@@ -0,0 +1,3 @@
+-- Bodies of delivered or abandoned mail are no longer kept: password reset
+-- mails carry a usable token in their link.
+UPDATE outbox SET body = '' WHERE sent_at IS NOT NULL OR attempts >= 8;
@@ -0,0 +1,7 @@
+-- Migration 0007 first deleted duplicate credentials outright; it now keeps
+-- them in removed_credentials. Databases that ran the first version get the
+-- table here, empty, since the rows they removed are gone.
+CREATE TABLE IF NOT EXISTS removed_credentials AS
+SELECT c.*, c.id AS kept_id, CURRENT_TIMESTAMP AS removed_at
+FROM credentials c
+WHERE 0;
@@ -0,0 +1,6 @@
+-- Secrets the backend generates for itself on first start and must keep
+-- across restarts and replicas.
+CREATE TABLE app_secrets (
+	name TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
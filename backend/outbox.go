@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// defaultOutboxInterval is how often pending mail is delivered.
+	defaultOutboxInterval = 5 * time.Second
+
+	outboxBatchSize   = 20
+	maxOutboxAttempts = 8
+
+	// outboxLease is how long a message claimed by one drainer is hidden from
+	// others, so replicas sharing the database do not send it twice.
+	outboxLease = time.Minute
+)
+
+// enqueueMail adds msg to the outbox. Passing a transaction makes the mail
+// part of the change that caused it.
+func enqueueMail(db execer, msg MailMessage) error {
+	now := time.Now().UTC()
+	_, err := db.Exec("INSERT INTO outbox (recipient, subject, body, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?)",
+		msg.To, msg.Subject, msg.Body, now, now)
+	return err
+}
+
+// outboxBackoff is the delay before retrying a message that failed attempts times.
+func outboxBackoff(attempts int) time.Duration {
+	d := 30 * time.Second << attempts
+	if d > time.Hour || d <= 0 {
+		d = time.Hour
+	}
+	return d
+}
+
+// drainOutbox sends the mail that is due and returns how many were sent.
+// Failed messages are retried with exponential backoff up to
+// maxOutboxAttempts times. The body is cleared once a message is sent or
+// given up on, since it may carry a secret such as a password reset link.
+func (a *App) drainOutbox() (int, error) {
+	now := time.Now().UTC()
+	rows, err := a.db.Query(`SELECT id, recipient, subject, body, attempts FROM outbox
+		WHERE sent_at IS NULL AND attempts < ? AND next_attempt_at <= ?
+		ORDER BY id LIMIT ?`, maxOutboxAttempts, now, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id       int64
+		msg      MailMessage
+		attempts int
+	}
+	var due []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.msg.To, &p.msg.Subject, &p.msg.Body, &p.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, p := range due {
+		claimed, err := a.claimOutboxMessage(p.id, now)
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := a.mailer.Send(p.msg); err != nil {
+			_, err = a.db.Exec(`UPDATE outbox SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?,
+				body = CASE WHEN attempts + 1 >= ? THEN '' ELSE body END WHERE id = ?`,
+				err.Error(), time.Now().UTC().Add(outboxBackoff(p.attempts)), maxOutboxAttempts, p.id)
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if _, err := a.db.Exec("UPDATE outbox SET sent_at = ?, last_error = NULL, body = '' WHERE id = ?", time.Now().UTC(), p.id); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// claimOutboxMessage leases message id to this drainer if nobody else has.
+func (a *App) claimOutboxMessage(id int64, now time.Time) (bool, error) {
+	res, err := a.db.Exec("UPDATE outbox SET next_attempt_at = ? WHERE id = ? AND sent_at IS NULL AND next_attempt_at <= ?",
+		now.Add(outboxLease), id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// maxPasskeyNameLen bounds user-chosen passkey names.
+const maxPasskeyNameLen = 64
+
+var (
+	// ErrPasskeyNotFound is returned when a user has no passkey with the given ID.
+	ErrPasskeyNotFound = errors.New("passkey not found")
+
+	// ErrLastLoginMethod is returned when deleting a passkey would leave the
+	// user without any way to log in.
+	ErrLastLoginMethod = errors.New("cannot delete the last login method")
+)
+
+// Passkey is the user-facing view of a stored credential.
+type Passkey struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name"`
+	CreatedAt         *time.Time `json:"createdAt"`
+	LastUsedAt        *time.Time `json:"lastUsedAt"`
+	AuthenticatorName string     `json:"authenticatorName"`
+	BackupEligible    bool       `json:"backupEligible"`
+	BackupState       bool       `json:"backupState"`
+	Locked            bool       `json:"locked"`
+}
+
+// encodeCredentialID is the stable text form of a credential ID, matching the
+// id field browsers report for a PublicKeyCredential.
+func encodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// decodeCredentialID parses the text form produced by encodeCredentialID.
+func decodeCredentialID(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// fallbackAuthenticatorName describes the kind of authenticator that holds
+// cred from its attachment and transports, for AAGUIDs the registry does not
+// know.
+func fallbackAuthenticatorName(cred webauthn.Credential) string {
+	if cred.Authenticator.Attachment == protocol.Platform {
+		return "Platform authenticator"
+	}
+	for _, t := range cred.Transport {
+		if t == protocol.Hybrid {
+			return "Phone or tablet"
+		}
+	}
+	for _, t := range cred.Transport {
+		switch t {
+		case protocol.USB, protocol.NFC, protocol.BLE:
+			return "Security key"
+		}
+	}
+	if cred.Authenticator.Attachment == protocol.CrossPlatform {
+		return "Security key"
+	}
+	return "Passkey"
+}
+
+func (a *App) listPasskeys(userID int) ([]Passkey, error) {
+	rows, err := a.db.Query("SELECT "+credentialColumns+", name, authenticator_name, created_at, last_used_at, locked_at IS NOT NULL FROM credentials WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var p Passkey
+		c, err := scanCredential(rows.Scan, &p.Name, &p.AuthenticatorName, &p.CreatedAt, &p.LastUsedAt, &p.Locked)
+		if err != nil {
+			return nil, err
+		}
+		p.ID = encodeCredentialID(c.ID)
+		if p.AuthenticatorName == "" {
+			p.AuthenticatorName = a.authenticatorName(c)
+		}
+		p.BackupEligible = c.Flags.BackupEligible
+		p.BackupState = c.Flags.BackupState
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+func (a *App) renamePasskey(userID int, credentialID []byte, name string) error {
+	res, err := a.db.Exec("UPDATE credentials SET name = ? WHERE user_id = ? AND credential_id = ?",
+		name, userID, credentialID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// deletePasskey removes one of the user's passkeys unless it is their only
+// remaining login method, counting a password as one. The check and the
+// delete are one statement so two concurrent deletes cannot remove the last
+// two passkeys together.
+func (a *App) deletePasskey(userID int, credentialID []byte) error {
+	res, err := a.db.Exec(`DELETE FROM credentials WHERE user_id = ? AND credential_id = ?
+		AND ((SELECT COUNT(*) FROM credentials WHERE user_id = ?) > 1
+			OR (SELECT password_hash FROM users WHERE id = ?) IS NOT NULL)`,
+		userID, credentialID, userID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	var exists int
+	err = a.db.QueryRow("SELECT COUNT(*) FROM credentials WHERE user_id = ? AND credential_id = ?",
+		userID, credentialID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrPasskeyNotFound
+	}
+	return ErrLastLoginMethod
+}
+
+func (a *App) listPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+
+	passkeys, err := a.listPasskeys(user.ID)
+	if err != nil {
+		log.Printf("listPasskeys error: %v", err)
+		jsonError(w, "Failed to list passkeys", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]any{"passkeys": passkeys})
+}
+
+func (a *App) renamePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxPasskeyNameLen {
+		jsonError(w, fmt.Sprintf("Name must be 1 to %d characters", maxPasskeyNameLen), http.StatusBadRequest)
+		return
+	}
+
+	credentialID, err := decodeCredentialID(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	err = a.renamePasskey(user.ID, credentialID, name)
+	if errors.Is(err, ErrPasskeyNotFound) {
+		jsonError(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("renamePasskey error: %v", err)
+		jsonError(w, "Failed to rename passkey", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+func (a *App) deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+
+	credentialID, err := decodeCredentialID(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	err = a.deletePasskey(user.ID, credentialID)
+	switch {
+	case errors.Is(err, ErrPasskeyNotFound):
+		jsonError(w, "Passkey not found", http.StatusNotFound)
+	case errors.Is(err, ErrLastLoginMethod):
+		jsonError(w, "Cannot delete your last login method", http.StatusConflict)
+	case err != nil:
+		log.Printf("deletePasskey error: %v", err)
+		jsonError(w, "Failed to delete passkey", http.StatusInternalServerError)
+	default:
+		jsonResponse(w, map[string]string{"status": "ok"})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// seedPasskeyUser creates a user with one stored credential per ID and
+// returns a session cookie for them.
+func seedPasskeyUser(t *testing.T, app *App, username string, credIDs ...string) (*User, *http.Cookie) {
+	t.Helper()
+	user, err := app.saveUser(username, username)
+	if err != nil {
+		t.Fatalf("saveUser: %v", err)
+	}
+	for _, id := range credIDs {
+		cred := webauthn.Credential{
+			ID:        []byte(id),
+			PublicKey: []byte("public-key-" + id),
+			Transport: []protocol.AuthenticatorTransport{protocol.USB},
+			Flags:     webauthn.CredentialFlags{BackupEligible: true, BackupState: true},
+		}
+		if err := app.saveCredential(user.ID, cred); err != nil {
+			t.Fatalf("saveCredential: %v", err)
+		}
+	}
+	var loginCred []byte
+	if len(credIDs) > 0 {
+		loginCred = []byte(credIDs[0])
+	}
+	token, _, err := app.createLoginSession(user.ID, amrHardwareKey, loginCred, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatalf("createLoginSession: %v", err)
+	}
+	return user, &http.Cookie{Name: sessionCookieName, Value: token}
+}
+
+// servePasskeys routes a request through the passkey management endpoints.
+func servePasskeys(app *App, req *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/passkeys", app.RequireAuth(http.HandlerFunc(app.listPasskeysHandler)))
+	mux.Handle("PATCH /api/passkeys/{id}", app.RequireAuth(http.HandlerFunc(app.renamePasskeyHandler)))
+	mux.Handle("DELETE /api/passkeys/{id}", app.RequireAuth(http.HandlerFunc(app.deletePasskeyHandler)))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestListPasskeys(t *testing.T) {
+	app := newTestApp(t)
+	_, cookie := seedPasskeyUser(t, app, "alice", "cred-1", "cred-2")
+	seedPasskeyUser(t, app, "bob", "cred-bob")
+
+	req := httptest.NewRequest("GET", "/api/passkeys", nil)
+	req.AddCookie(cookie)
+	w := servePasskeys(app, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		Passkeys []Passkey `json:"passkeys"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(body.Passkeys) != 2 {
+		t.Fatalf("expected alice's 2 passkeys, got %d", len(body.Passkeys))
+	}
+	p := body.Passkeys[0]
+	if p.ID != encodeCredentialID([]byte("cred-1")) {
+		t.Fatalf("unexpected passkey ID %q", p.ID)
+	}
+	if p.AuthenticatorName != "Security key" || p.Name != "Security key" {
+		t.Fatalf("expected USB credential to be named 'Security key', got %+v", p)
+	}
+	if p.CreatedAt == nil || p.LastUsedAt != nil {
+		t.Fatalf("expected createdAt set and lastUsedAt empty, got %+v", p)
+	}
+	if !p.BackupEligible || !p.BackupState {
+		t.Fatalf("expected backup flags, got %+v", p)
+	}
+}
+
+func TestListPasskeysRequiresLogin(t *testing.T) {
+	app := newTestApp(t)
+
+	w := servePasskeys(app, httptest.NewRequest("GET", "/api/passkeys", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestListPasskeysWithBearerToken(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	_, sessionID := sessionCookie(t, app, user, amrHardwareKey, 0)
+	token, _, err := app.tokens.Issue(user, AuthContext{Method: amrHardwareKey, SessionID: sessionID})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/passkeys", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := servePasskeys(app, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestRenamePasskey(t *testing.T) {
+	app := newTestApp(t)
+	user, cookie := seedPasskeyUser(t, app, "alice", "cred-1")
+	id := encodeCredentialID([]byte("cred-1"))
+
+	req := httptest.NewRequest("PATCH", "/api/passkeys/"+id, strings.NewReader(`{"name":"  Work laptop "}`))
+	req.AddCookie(cookie)
+	w := servePasskeys(app, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	passkeys, _ := app.listPasskeys(user.ID)
+	if passkeys[0].Name != "Work laptop" {
+		t.Fatalf("expected name 'Work laptop', got %q", passkeys[0].Name)
+	}
+
+	req = httptest.NewRequest("PATCH", "/api/passkeys/"+id, strings.NewReader(`{"name":"   "}`))
+	req.AddCookie(cookie)
+	if w := servePasskeys(app, req); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for blank name, got %d", w.Code)
+	}
+}
+
+func TestRenameOtherUsersPasskey(t *testing.T) {
+	app := newTestApp(t)
+	_, cookie := seedPasskeyUser(t, app, "alice", "cred-1")
+	seedPasskeyUser(t, app, "bob", "cred-bob")
+
+	req := httptest.NewRequest("PATCH", "/api/passkeys/"+encodeCredentialID([]byte("cred-bob")), strings.NewReader(`{"name":"mine"}`))
+	req.AddCookie(cookie)
+	w := servePasskeys(app, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestDeletePasskeyKeepsLastLoginMethod(t *testing.T) {
+	app := newTestApp(t)
+	user, cookie := seedPasskeyUser(t, app, "alice", "cred-1", "cred-2")
+
+	req := httptest.NewRequest("DELETE", "/api/passkeys/"+encodeCredentialID([]byte("cred-1")), nil)
+	req.AddCookie(cookie)
+	if w := servePasskeys(app, req); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/passkeys/"+encodeCredentialID([]byte("cred-2")), nil)
+	req.AddCookie(cookie)
+	if w := servePasskeys(app, req); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting the last passkey, got %d", w.Code)
+	}
+
+	if n := len(app.getCredentialsForUser(user.ID)); n != 1 {
+		t.Fatalf("expected 1 remaining credential, got %d", n)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/passkeys/unknown", nil)
+	req.AddCookie(cookie)
+	if w := servePasskeys(app, req); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown passkey, got %d", w.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	minPasswordLen = 8
+	// maxPasswordLen bounds the work an attacker can make us do per attempt.
+	maxPasswordLen = 256
+)
+
+// ErrInvalidPasswordHash is returned for stored hashes that cannot be parsed.
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Argon2Params are the Argon2id cost parameters. They are encoded into every
+// hash, so raising them only affects new hashes; older ones are upgraded the
+// next time their owner logs in.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLen     uint32
+	KeyLen      uint32
+}
+
+// defaultArgon2Params follow the OWASP recommendation for Argon2id.
+var defaultArgon2Params = Argon2Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLen:     16,
+	KeyLen:      32,
+}
+
+// hashPassword derives an Argon2id hash of password in PHC string format,
+// e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>.
+func hashPassword(password string, p Argon2Params) (string, error) {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// decodePasswordHash parses a hash produced by hashPassword.
+func decodePasswordHash(encoded string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// comparePassword reports whether password matches encoded, and whether a
+// match should be rehashed because it was made with parameters other than want.
+// Passwords longer than maxPasswordLen never match and are not hashed.
+func comparePassword(encoded, password string, want Argon2Params) (match, rehash bool, err error) {
+	if len(password) > maxPasswordLen {
+		return false, false, nil
+	}
+	p, salt, key, err := decodePasswordHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	got := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLen)
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return false, false, nil
+	}
+	return true, p != want, nil
+}
+
+// passwordPolicyError returns a user-facing reason why password cannot be
+// used, or "" if it is acceptable.
+func passwordPolicyError(password string) string {
+	if utf8.RuneCountInString(password) < minPasswordLen {
+		return fmt.Sprintf("Password must be at least %d characters", minPasswordLen)
+	}
+	if len(password) > maxPasswordLen {
+		return fmt.Sprintf("Password must be at most %d bytes", maxPasswordLen)
+	}
+	return ""
+}
+
+// getPasswordHash returns the user's password hash, or "" if they have none.
+func (a *App) getPasswordHash(userID int) (string, error) {
+	var hash sql.NullString
+	err := a.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&hash)
+	return hash.String, err
+}
+
+// setPassword hashes password with the current parameters and stores it as
+// the user's new password.
+func (a *App) setPassword(userID int, password string) error {
+	hash, err := hashPassword(password, a.passwordParams)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec("UPDATE users SET password_hash = ?, password_changed_at = ? WHERE id = ?",
+		hash, time.Now().UTC(), userID)
+	return err
+}
+
+// rehashPassword stores a new hash of the user's unchanged password, so
+// refresh tokens from earlier password logins stay valid.
+func (a *App) rehashPassword(userID int, password string) error {
+	hash, err := hashPassword(password, a.passwordParams)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, userID)
+	return err
+}
+
+// checkPassword verifies username and password. Unknown users and users
+// without a password cost the same hash computation as a wrong password, so
+// response times do not reveal which accounts exist.
+func (a *App) checkPassword(username, password string) (*User, bool) {
+	hash := a.dummyPasswordHash
+	user, err := a.getUser(username)
+	if err == nil {
+		if stored, err := a.getPasswordHash(user.ID); err == nil && stored != "" {
+			hash = stored
+		}
+	}
+
+	match, rehash, err := comparePassword(hash, password, a.passwordParams)
+	if err != nil {
+		log.Printf("comparePassword error: %v", err)
+		return nil, false
+	}
+	if !match || hash == a.dummyPasswordHash {
+		return nil, false
+	}
+
+	if rehash {
+		if err := a.rehashPassword(user.ID, password); err != nil {
+			log.Printf("rehash password error: %v", err)
+		}
+	}
+	return user, true
+}
+
+// setPasswordHandler sets or changes the logged-in user's password. Changing
+// an existing password requires the current one.
+func (a *App) setPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := passwordPolicyError(req.NewPassword); msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	stored, err := a.getPasswordHash(user.ID)
+	if err != nil {
+		log.Printf("getPasswordHash error: %v", err)
+		jsonError(w, "Failed to set password", http.StatusInternalServerError)
+		return
+	}
+	if stored != "" {
+		match, _, err := comparePassword(stored, req.CurrentPassword, a.passwordParams)
+		if err != nil || !match {
+			jsonError(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := a.setPassword(user.ID, req.NewPassword); err != nil {
+		log.Printf("setPassword error: %v", err)
+		jsonError(w, "Failed to set password", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultPasswordResetTTL = time.Hour
+
+// ErrResetTokenInvalid is returned for reset tokens that are unknown,
+// expired or already used.
+var ErrResetTokenInvalid = errors.New("invalid or expired reset token")
+
+// requestPasswordReset creates a reset token for user and queues the email
+// carrying it, in one transaction.
+func (a *App) requestPasswordReset(user *User) error {
+	token, err := randomID(32)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(a.passwordResetURL)
+	if err != nil {
+		return fmt.Errorf("parse reset URL: %w", err)
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO password_reset_tokens (id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), user.ID, now, now.Add(a.passwordResetTTL))
+	if err != nil {
+		return err
+	}
+	err = enqueueMail(tx, MailMessage{
+		To:      user.Name,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for %s.\n\n"+
+			"To choose a new password, open this link within %s:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.",
+			user.Name, a.passwordResetTTL, link),
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resetPassword redeems token and sets the new password. The token and any
+// other outstanding tokens of the same user are used up, and all of the
+// user's login sessions are revoked.
+func (a *App) resetPassword(token, password string) error {
+	hash, err := hashPassword(password, a.passwordParams)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var userID int
+	err = tx.QueryRow(`UPDATE password_reset_tokens SET used_at = ?
+		WHERE id = ? AND used_at IS NULL AND expires_at > ? RETURNING user_id`,
+		now, hashToken(token), now).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrResetTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"UPDATE users SET password_hash = ?, password_changed_at = ? WHERE id = ?", []any{hash, now, userID}},
+		{"UPDATE password_reset_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", []any{now, userID}},
+		{"UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", []any{now, userID}},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// forgotPasswordHandler emails a reset link. It answers the same way whether
+// or not the account exists, so it cannot be used to discover users.
+func (a *App) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		jsonError(w, "Email required", http.StatusBadRequest)
+		return
+	}
+
+	if user, err := a.getUser(req.Email); err == nil {
+		if err := a.requestPasswordReset(user); err != nil {
+			log.Printf("requestPasswordReset error: %v", err)
+			jsonError(w, "Failed to request password reset", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	jsonResponse(w, map[string]string{
+		"status":  "ok",
+		"message": "If the account exists, a reset link has been sent",
+	})
+}
+
+func (a *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := passwordPolicyError(req.NewPassword); msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	err := a.resetPassword(req.Token, req.NewPassword)
+	if errors.Is(err, ErrResetTokenInvalid) {
+		jsonError(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("resetPassword error: %v", err)
+		jsonError(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	a.clearSessionCookie(w)
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
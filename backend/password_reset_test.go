@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMailer keeps sent mail in memory and can be made to fail.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []MailMessage
+	err  error
+}
+
+func (m *recordingMailer) Send(msg MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+var resetTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// requestReset calls the forgot endpoint for email, drains the outbox and
+// returns the reset token from the mail, if one was sent.
+func requestReset(t *testing.T, app *App, mailer *recordingMailer, email string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	app.forgotPasswordHandler(w, httptest.NewRequest("POST", "/api/auth/password/forgot",
+		strings.NewReader(`{"email":"`+email+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("forgot: expected 200, got %d", w.Code)
+	}
+
+	before := len(mailer.sent)
+	if _, err := app.drainOutbox(); err != nil {
+		t.Fatalf("drainOutbox: %v", err)
+	}
+	if len(mailer.sent) == before {
+		return ""
+	}
+	m := resetTokenPattern.FindStringSubmatch(mailer.sent[len(mailer.sent)-1].Body)
+	if m == nil {
+		t.Fatalf("reset mail has no token: %q", mailer.sent[len(mailer.sent)-1].Body)
+	}
+	return m[1]
+}
+
+func resetRequest(app *App, token, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	app.resetPasswordHandler(w, httptest.NewRequest("POST", "/api/auth/password/reset",
+		strings.NewReader(`{"token":"`+token+`","newPassword":"`+password+`"}`)))
+	return w
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	app := newTestApp(t)
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+	seedPasswordUser(t, app, "alice@example.com", "old password")
+	cookie := passwordLoginWith(t, app, "alice@example.com", "old password")
+
+	token := requestReset(t, app, mailer, "alice@example.com")
+	if token == "" {
+		t.Fatal("expected a reset mail")
+	}
+	if got := mailer.sent[0].To; got != "alice@example.com" {
+		t.Fatalf("expected mail to alice, got %q", got)
+	}
+	if !strings.Contains(mailer.sent[0].Body, "http://localhost:3000/reset-password?token=") {
+		t.Fatalf("expected link to the reset page, got %q", mailer.sent[0].Body)
+	}
+
+	var stored int
+	app.db.QueryRow("SELECT COUNT(*) FROM password_reset_tokens WHERE id = ?", token).Scan(&stored)
+	if stored != 0 {
+		t.Fatal("reset token must not be stored in plain text")
+	}
+	var body string
+	app.db.QueryRow("SELECT body FROM outbox").Scan(&body)
+	if strings.Contains(body, token) {
+		t.Fatal("expected the reset link to be cleared from the outbox once sent")
+	}
+
+	if w := resetRequest(app, token, "new password"); w.Code != http.StatusOK {
+		t.Fatalf("reset: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := app.checkPassword("alice@example.com", "old password"); ok {
+		t.Fatal("expected the old password to stop working")
+	}
+	if _, ok := app.checkPassword("alice@example.com", "new password"); !ok {
+		t.Fatal("expected the new password to work")
+	}
+	if _, err := app.getLoginSession(cookie.Value); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected existing sessions to be revoked, got %v", err)
+	}
+
+	// Tokens are single use.
+	if w := resetRequest(app, token, "third password"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 when reusing a token, got %d", w.Code)
+	}
+}
+
+func TestPasswordResetUsesUpOtherTokens(t *testing.T) {
+	app := newTestApp(t)
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+	seedPasswordUser(t, app, "alice@example.com", "old password")
+
+	first := requestReset(t, app, mailer, "alice@example.com")
+	second := requestReset(t, app, mailer, "alice@example.com")
+
+	if w := resetRequest(app, second, "new password"); w.Code != http.StatusOK {
+		t.Fatalf("reset: expected 200, got %d", w.Code)
+	}
+	if w := resetRequest(app, first, "other password"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected older token to be used up, got %d", w.Code)
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	app := newTestApp(t)
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+
+	if token := requestReset(t, app, mailer, "nobody@example.com"); token != "" {
+		t.Fatal("expected no mail for an unknown account")
+	}
+}
+
+func TestPasswordResetExpiredToken(t *testing.T) {
+	app := newTestApp(t)
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+	app.passwordResetTTL = -time.Second
+	seedPasswordUser(t, app, "alice@example.com", "old password")
+
+	token := requestReset(t, app, mailer, "alice@example.com")
+	if w := resetRequest(app, token, "new password"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an expired token, got %d", w.Code)
+	}
+}
+
+func TestPasswordResetRejectsWeakPassword(t *testing.T) {
+	app := newTestApp(t)
+	if w := resetRequest(app, "anything", "short"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestOutboxRetriesFailedMail(t *testing.T) {
+	app := newTestApp(t)
+	mailer := &recordingMailer{err: errors.New("connection refused")}
+	app.mailer = mailer
+
+	if err := enqueueMail(app.db, MailMessage{To: "a@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("enqueueMail: %v", err)
+	}
+	if n, err := app.drainOutbox(); err != nil || n != 0 {
+		t.Fatalf("expected nothing sent, got %d, %v", n, err)
+	}
+
+	var attempts int
+	var lastError string
+	var next time.Time
+	app.db.QueryRow("SELECT attempts, last_error, next_attempt_at FROM outbox").Scan(&attempts, &lastError, &next)
+	if attempts != 1 || lastError != "connection refused" || !next.After(time.Now()) {
+		t.Fatalf("expected one recorded failure with a later retry, got %d %q %v", attempts, lastError, next)
+	}
+
+	// Not due yet, so a second drain leaves it alone.
+	mailer.err = nil
+	if n, _ := app.drainOutbox(); n != 0 {
+		t.Fatalf("expected retry to wait for its backoff, sent %d", n)
+	}
+
+	app.db.Exec("UPDATE outbox SET next_attempt_at = ?", time.Now().UTC().Add(-time.Second))
+	if n, err := app.drainOutbox(); err != nil || n != 1 {
+		t.Fatalf("expected the retry to be sent, got %d, %v", n, err)
+	}
+}
+
+func TestOutboxClearsAbandonedMail(t *testing.T) {
+	app := newTestApp(t)
+	app.mailer = &recordingMailer{err: errors.New("connection refused")}
+
+	if err := enqueueMail(app.db, MailMessage{To: "a@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("enqueueMail: %v", err)
+	}
+	app.db.Exec("UPDATE outbox SET attempts = ?", maxOutboxAttempts-1)
+	app.drainOutbox()
+
+	var attempts int
+	var body string
+	app.db.QueryRow("SELECT attempts, body FROM outbox").Scan(&attempts, &body)
+	if attempts != maxOutboxAttempts || body != "" {
+		t.Fatalf("expected the body of abandoned mail to be cleared, got %d attempts, body %q", attempts, body)
+	}
+}
+
+func TestOutboxClaimIsExclusive(t *testing.T) {
+	app := newTestApp(t)
+	if err := enqueueMail(app.db, MailMessage{To: "a@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("enqueueMail: %v", err)
+	}
+
+	now := time.Now().UTC()
+	first, err := app.claimOutboxMessage(1, now)
+	if err != nil || !first {
+		t.Fatalf("expected first claim to succeed, got %v, %v", first, err)
+	}
+	if second, _ := app.claimOutboxMessage(1, now); second {
+		t.Fatal("expected a claimed message not to be claimed again")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := hashPassword("correct horse", testArgon2Params)
+	if err != nil {
+		t.Fatalf("hashPassword: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("unexpected encoding %q", hash)
+	}
+
+	match, rehash, err := comparePassword(hash, "correct horse", testArgon2Params)
+	if err != nil || !match || rehash {
+		t.Fatalf("expected match without rehash, got match=%v rehash=%v err=%v", match, rehash, err)
+	}
+	if match, _, _ := comparePassword(hash, "wrong horse", testArgon2Params); match {
+		t.Fatal("expected wrong password not to match")
+	}
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	if _, rehash, _ := comparePassword(hash, "correct horse", stronger); !rehash {
+		t.Fatal("expected rehash when parameters change")
+	}
+
+	other, _ := hashPassword("correct horse", testArgon2Params)
+	if other == hash {
+		t.Fatal("expected a fresh salt per hash")
+	}
+}
+
+func TestComparePasswordRejectsMalformedHash(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"password",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!$a2V5",
+	} {
+		if _, _, err := comparePassword(encoded, "x", testArgon2Params); !errors.Is(err, ErrInvalidPasswordHash) {
+			t.Errorf("%q: expected ErrInvalidPasswordHash, got %v", encoded, err)
+		}
+	}
+}
+
+func TestPasswordLoginRejectsOversizedPassword(t *testing.T) {
+	app := newTestApp(t)
+	long := strings.Repeat("a", maxPasswordLen+1)
+	// Stored directly, as a hash from before the limit existed would be.
+	seedPasswordUser(t, app, "alice@example.com", long)
+
+	if _, ok := app.checkPassword("alice@example.com", long); ok {
+		t.Fatal("expected a password over the limit to be refused without hashing it")
+	}
+}
+
+func TestPasswordLoginRehashesOnParameterChange(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "alice@example.com", "password")
+	before, _ := app.getPasswordHash(user.ID)
+
+	app.passwordParams.Iterations = 2
+	passwordLogin(t, app, "alice@example.com")
+
+	after, _ := app.getPasswordHash(user.ID)
+	if after == before || !strings.Contains(after, ",t=2,") {
+		t.Fatalf("expected hash upgraded to t=2, got %q", after)
+	}
+	if match, _, _ := comparePassword(after, "password", app.passwordParams); !match {
+		t.Fatal("expected upgraded hash to verify")
+	}
+}
+
+func TestPasswordLoginWithoutPassword(t *testing.T) {
+	app := newTestApp(t)
+	seedPasskeyUser(t, app, "passkey-only", "cred-1")
+
+	if _, ok := app.checkPassword("passkey-only", ""); ok {
+		t.Fatal("expected a user without a password to be refused")
+	}
+	if _, ok := app.checkPassword("passkey-only", "password"); ok {
+		t.Fatal("expected a user without a password to be refused")
+	}
+}
+
+func TestSetPasswordHandler(t *testing.T) {
+	app := newTestApp(t)
+	user, cookie := seedPasskeyUser(t, app, "bob@example.com", "cred-1")
+
+	serve := func(c *http.Cookie, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/auth/password", strings.NewReader(body))
+		if c != nil {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		app.RequireAuth(http.HandlerFunc(app.setPasswordHandler)).ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(nil, `{"newPassword":"long enough"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %d", w.Code)
+	}
+	if w := serve(cookie, `{"newPassword":"short"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a short password, got %d", w.Code)
+	}
+
+	// A passkey user may set a first password without a current one.
+	if w := serve(cookie, `{"newPassword":"first password"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := app.checkPassword("bob@example.com", "first password"); !ok {
+		t.Fatal("expected the new password to work")
+	}
+
+	// Changing it requires the current password.
+	if w := serve(cookie, `{"currentPassword":"wrong","newPassword":"second password"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong current password, got %d", w.Code)
+	}
+	if w := serve(cookie, `{"currentPassword":"first password","newPassword":"second password"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if _, ok := app.checkPassword("bob@example.com", "second password"); !ok {
+		t.Fatal("expected the changed password to work")
+	}
+
+	// With a password set, the only passkey can now be deleted.
+	if err := app.deletePasskey(user.ID, []byte("cred-1")); err != nil {
+		t.Fatalf("expected last passkey deletable with a password set: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies(" 10.0.0.0/8, 192.0.2.1 ,::1")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+	if len(proxies) != 3 || proxies[1].String() != "192.0.2.1/32" || proxies[2].String() != "::1/128" {
+		t.Fatalf("unexpected proxies %v", proxies)
+	}
+	for _, bad := range []string{"proxy", "10.0.0.0/33"} {
+		if _, err := ParseTrustedProxies(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("10.0.0.0/8")
+	app := newTestApp(t, WithTrustedProxies(proxies))
+
+	for _, tc := range []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"untrusted peer cannot spoof", "203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:1234", "198.51.100.1", "198.51.100.1"},
+		{"client-written hops are ignored", "10.0.0.2:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"proxy chain", "10.0.0.2:1234", "198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.2:1234", "", "10.0.0.2"},
+		{"garbage stops the walk", "10.0.0.2:1234", "198.51.100.1, junk", "10.0.0.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := app.clientIP(r); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
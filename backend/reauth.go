@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// defaultReauthMaxAge is how recently the user must have authenticated to
+// perform a sensitive operation.
+const defaultReauthMaxAge = 5 * time.Minute
+
+// recentlyAuthenticated reports whether auth is fresh enough for a sensitive
+// operation. Users with passkeys must have used one, since only a
+// user-verified assertion proves the person at the keyboard; users without
+// passkeys cannot step up and may log in with their password again instead.
+func recentlyAuthenticated(user *User, auth *AuthContext, maxAge time.Duration) bool {
+	if auth.Method != amrHardwareKey && len(user.Credentials) > 0 {
+		return false
+	}
+	return time.Since(auth.Time) <= maxAge
+}
+
+// RequireRecentAuth rejects requests whose user authenticated more than
+// maxAge ago with a reauth_required error, which clients answer with the
+// step-up ceremony at /api/auth/reauth/begin and retry. It must sit behind
+// RequireAuth.
+func (a *App) RequireRecentAuth(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, auth := requestUser(r)
+			if !recentlyAuthenticated(user, auth, maxAge) {
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, int(maxAge.Seconds())))
+				jsonErrorCode(w, codeReauthRequired, "Please confirm it's you to continue", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reauthBegin starts a step-up ceremony: a user-verified assertion with one
+// of the current user's passkeys.
+func (a *App) reauthBegin(w http.ResponseWriter, r *http.Request) {
+	user, _ := requestUser(r)
+	if len(user.Credentials) == 0 {
+		jsonError(w, "No passkey to confirm with; log in again instead", http.StatusBadRequest)
+		return
+	}
+
+	options, session, err := a.webAuthn.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Printf("BeginLogin error: %v", err)
+		jsonError(w, "Failed to start re-authentication", http.StatusInternalServerError)
+		return
+	}
+
+	ceremonyID, err := a.beginCeremony(&Ceremony{Kind: ceremonyReauth, Session: *session}, a.ceremonyTTL)
+	if err != nil {
+		log.Printf("beginCeremony error: %v", err)
+		jsonError(w, "Failed to start ceremony", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, loginOptions{CredentialAssertion: options, CeremonyID: ceremonyID})
+}
+
+// reauthFinish verifies the step-up assertion, records it as the login
+// session's authentication and returns an access token carrying it.
+func (a *App) reauthFinish(w http.ResponseWriter, r *http.Request) {
+	user, auth := requestUser(r)
+	ceremony := a.takeCeremony(w, r, ceremonyReauth)
+	if ceremony == nil {
+		return
+	}
+	// A ceremony begun by one user cannot be finished by another.
+	if !bytes.Equal(ceremony.Session.UserID, user.Handle) {
+		jsonError(w, "Session not found", http.StatusBadRequest)
+		return
+	}
+
+	_, credential, err := a.validateAssertion(user, ceremony.Session, r)
+	if err != nil {
+		log.Printf("FinishLogin error: %v", err)
+		jsonErrorCode(w, codeVerificationFailed, "Passkey verification failed", http.StatusUnauthorized)
+		return
+	}
+	if !a.acceptAssertion(w, r, user, credential) {
+		return
+	}
+
+	stepped := AuthContext{
+		Method:       amrHardwareKey,
+		Time:         time.Now().UTC(),
+		CredentialID: credential.ID,
+		SessionID:    auth.SessionID,
+	}
+	if stepped.SessionID != "" {
+		err := a.recordReauth(stepped)
+		if errors.Is(err, ErrSessionNotFound) {
+			jsonError(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("recordReauth error: %v", err)
+			jsonError(w, "Failed to record re-authentication", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	token, claims, err := a.tokens.Issue(user, stepped)
+	if err != nil {
+		log.Printf("Issue token error: %v", err)
+		jsonError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]any{
+		"status":     "ok",
+		"authTime":   stepped.Time,
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_in": int(time.Until(claims.ExpiresAt.Time).Seconds()),
+	})
+}
+
+// recordReauth stores the step-up auth as the authentication of its login
+// session, so later requests with the session cookie count as recent.
+func (a *App) recordReauth(auth AuthContext) error {
+	res, err := a.db.Exec(`UPDATE sessions SET auth_method = ?, credential_id = ?, auth_time = ?
+		WHERE id = ? AND revoked_at IS NULL AND expires_at > ?`,
+		auth.Method, auth.CredentialID, auth.Time, auth.SessionID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
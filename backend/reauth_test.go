@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveReauth routes the step-up endpoints and a handler behind
+// RequireRecentAuth as main does.
+func serveReauth(app *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/auth/reauth/begin", app.RequireAuth(http.HandlerFunc(app.reauthBegin)))
+	mux.Handle("POST /api/auth/reauth/finish", app.RequireAuth(http.HandlerFunc(app.reauthFinish)))
+	mux.Handle("POST /sensitive", app.RequireAuth(app.RequireRecentAuth(defaultReauthMaxAge)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { jsonResponse(w, map[string]string{"status": "ok"}) }))))
+	return mux
+}
+
+// sessionCookie starts a login session for user that authenticated with
+// amr age ago and returns its cookie and ID.
+func sessionCookie(t *testing.T, app *App, user *User, amr string, age time.Duration) (*http.Cookie, string) {
+	t.Helper()
+	token, session, err := app.createLoginSession(user.ID, amr, nil, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatalf("createLoginSession: %v", err)
+	}
+	app.db.Exec("UPDATE sessions SET auth_time = ? WHERE id = ?", time.Now().UTC().Add(-age), session.ID)
+	return &http.Cookie{Name: sessionCookieName, Value: token}, session.ID
+}
+
+func postWith(h http.Handler, path string, body []byte, authorize func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	authorize(req)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// stepUp runs the reauth ceremony with authenticator, asserting handle, and
+// returns the finish response.
+func stepUp(t *testing.T, h http.Handler, handle []byte, authenticator *testAuthenticator, authorize func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	w := postWith(h, "/api/auth/reauth/begin", nil, authorize)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reauth begin: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var begin loginOptions
+	json.Unmarshal(w.Body.Bytes(), &begin)
+	body := authenticator.assert(t, w.Body.Bytes(), handle)
+	return postWith(h, "/api/auth/reauth/finish?ceremony="+begin.CeremonyID, body, authorize)
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	app := newTestApp(t)
+	h := serveReauth(app)
+	passkeyUser, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	passwordUser := seedPasswordUser(t, app, "carol@example.com", "password")
+
+	tests := []struct {
+		name string
+		user *User
+		amr  string
+		age  time.Duration
+		ok   bool
+	}{
+		{"fresh passkey login", passkeyUser, amrHardwareKey, time.Minute, true},
+		{"stale passkey login", passkeyUser, amrHardwareKey, time.Hour, false},
+		{"password login of a passkey user", passkeyUser, amrPassword, time.Minute, false},
+		{"fresh password login without passkeys", passwordUser, amrPassword, time.Minute, true},
+		{"stale password login without passkeys", passwordUser, amrPassword, time.Hour, false},
+	}
+	for _, tt := range tests {
+		cookie, _ := sessionCookie(t, app, tt.user, tt.amr, tt.age)
+		w := postWith(h, "/sensitive", nil, func(r *http.Request) { r.AddCookie(cookie) })
+		if tt.ok {
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: expected 200, got %d", tt.name, w.Code)
+			}
+			continue
+		}
+		var body map[string]string
+		json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != http.StatusUnauthorized || body["code"] != codeReauthRequired {
+			t.Errorf("%s: expected reauth_required, got %d %v", tt.name, w.Code, body)
+		}
+		if !strings.Contains(w.Header().Get("WWW-Authenticate"), "insufficient_user_authentication") {
+			t.Errorf("%s: expected a step-up challenge, got %q", tt.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestReauthWithLegacyHandle(t *testing.T) {
+	app := newTestApp(t)
+	h := serveReauth(app)
+	user, authenticator, legacy := seedLegacyAuthenticatorUser(t, app, "alice")
+	cookie, _ := sessionCookie(t, app, user, amrHardwareKey, time.Hour)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	if w := stepUp(t, h, legacy, authenticator, withCookie); w.Code != http.StatusOK {
+		t.Fatalf("reauth finish: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := postWith(h, "/sensitive", nil, withCookie); w.Code != http.StatusOK {
+		t.Fatalf("expected the step-up to satisfy RequireRecentAuth, got %d", w.Code)
+	}
+}
+
+func TestReauthWithSessionCookie(t *testing.T) {
+	app := newTestApp(t)
+	h := serveReauth(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	cookie, sessionID := sessionCookie(t, app, user, amrHardwareKey, time.Hour)
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+
+	if w := postWith(h, "/sensitive", nil, withCookie); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the stale session to need reauth, got %d", w.Code)
+	}
+
+	w := stepUp(t, h, user.Handle, authenticator, withCookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reauth finish: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	claims, err := app.tokens.Verify(resp["token"].(string))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if time.Since(claims.AuthTime.Time) > time.Minute || claims.SessionID != sessionID {
+		t.Fatalf("expected a token carrying the step-up, got %+v", claims)
+	}
+
+	var (
+		method string
+		credID []byte
+	)
+	app.db.QueryRow("SELECT auth_method, credential_id FROM sessions WHERE id = ?", sessionID).Scan(&method, &credID)
+	if method != amrHardwareKey || string(credID) != "cred-alice" {
+		t.Fatalf("expected the session to record the step-up, got %s %q", method, credID)
+	}
+	if w := postWith(h, "/sensitive", nil, withCookie); w.Code != http.StatusOK {
+		t.Fatalf("expected the session to be fresh after reauth, got %d", w.Code)
+	}
+}
+
+func TestReauthWithBearerToken(t *testing.T) {
+	app := newTestApp(t)
+	h := serveReauth(app)
+	user, authenticator := seedAuthenticatorUser(t, app, "alice")
+	_, sessionID := sessionCookie(t, app, user, amrHardwareKey, time.Hour)
+	stale, _, _ := app.tokens.Issue(user, AuthContext{Method: amrHardwareKey, Time: time.Now().Add(-time.Hour), SessionID: sessionID})
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	w := stepUp(t, h, user.Handle, authenticator, bearer(stale))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reauth finish: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	if w := postWith(h, "/sensitive", nil, bearer(stale)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the old token to stay stale, got %d", w.Code)
+	}
+	if w := postWith(h, "/sensitive", nil, bearer(resp["token"].(string))); w.Code != http.StatusOK {
+		t.Fatalf("expected the new token to be fresh, got %d", w.Code)
+	}
+}
+
+func TestReauthRejectsOtherUsersCeremony(t *testing.T) {
+	app := newTestApp(t)
+	h := serveReauth(app)
+	alice, authenticator := seedAuthenticatorUser(t, app, "alice")
+	bob, _ := seedAuthenticatorUser(t, app, "bob")
+	aliceCookie, _ := sessionCookie(t, app, alice, amrHardwareKey, time.Hour)
+	bobCookie, _ := sessionCookie(t, app, bob, amrHardwareKey, time.Hour)
+
+	w := postWith(h, "/api/auth/reauth/begin", nil, func(r *http.Request) { r.AddCookie(aliceCookie) })
+	var begin loginOptions
+	json.Unmarshal(w.Body.Bytes(), &begin)
+	body := authenticator.assert(t, w.Body.Bytes(), alice.Handle)
+
+	w = postWith(h, "/api/auth/reauth/finish?ceremony="+begin.CeremonyID, body, func(r *http.Request) { r.AddCookie(bobCookie) })
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestReauthBeginWithoutPasskeys(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "carol@example.com", "password")
+	cookie, _ := sessionCookie(t, app, user, amrPassword, time.Hour)
+
+	w := postWith(serveReauth(app), "/api/auth/reauth/begin", nil, func(r *http.Request) { r.AddCookie(cookie) })
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultRefreshTokenTTL matches defaultSessionTTL: refreshing stops when the
+// session expires anyway, and sessions are not extended by refreshing.
+const defaultRefreshTokenTTL = defaultSessionTTL
+
+var (
+	// ErrRefreshTokenInvalid is returned for refresh tokens that do not
+	// exist, have expired or have been revoked.
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid")
+
+	// ErrRefreshTokenReused is returned when a refresh token that was already
+	// rotated is presented again. Its whole family is revoked, since either
+	// the client or an attacker holds a stolen copy.
+	ErrRefreshTokenReused = errors.New("refresh token already used")
+
+	// ErrLoginMethodRemoved is returned when the passkey or password the
+	// login was made with has since been deleted or changed.
+	ErrLoginMethodRemoved = errors.New("login method no longer available")
+)
+
+// refreshFamily describes the login a chain of refresh tokens descends from.
+type refreshFamily struct {
+	ID           string
+	UserID       int
+	SessionID    string
+	AuthMethod   string
+	CredentialID []byte // the passkey used, or nil for a password login
+	AuthTime     time.Time
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// issueRefreshToken starts a new refresh token family for the login that
+// created session and returns the token to hand to the client.
+func (a *App) issueRefreshToken(session *LoginSession) (string, error) {
+	familyID, err := randomID(16)
+	if err != nil {
+		return "", err
+	}
+	return a.insertRefreshToken(a.db, refreshFamily{
+		ID:           familyID,
+		UserID:       session.UserID,
+		SessionID:    session.ID,
+		AuthMethod:   session.AuthMethod,
+		CredentialID: session.CredentialID,
+		AuthTime:     session.AuthTime,
+	})
+}
+
+func (a *App) insertRefreshToken(db execer, f refreshFamily) (string, error) {
+	token, err := randomID(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(`INSERT INTO refresh_tokens
+		(id, family_id, user_id, session_id, auth_method, credential_id, auth_time, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), f.ID, f.UserID, f.SessionID, f.AuthMethod, f.CredentialID, f.AuthTime, now, now.Add(a.refreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// rotateRefreshToken redeems token and returns its successor. The family is
+// returned along with ErrRefreshTokenReused and ErrLoginMethodRemoved, after
+// it has been revoked, so the caller can record who was affected.
+func (a *App) rotateRefreshToken(token string) (*refreshFamily, string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		f                 refreshFamily
+		expiresAt         time.Time
+		usedAt, revokedAt sql.NullTime
+	)
+	id := hashToken(token)
+	err = tx.QueryRow(`SELECT family_id, user_id, session_id, auth_method, credential_id, auth_time, expires_at, used_at, revoked_at
+		FROM refresh_tokens WHERE id = ?`, id).
+		Scan(&f.ID, &f.UserID, &f.SessionID, &f.AuthMethod, &f.CredentialID, &f.AuthTime, &expiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case revokedAt.Valid || !now.Before(expiresAt):
+		return nil, "", ErrRefreshTokenInvalid
+	case usedAt.Valid:
+		return a.revokeRefreshFamily(tx, &f, ErrRefreshTokenReused)
+	}
+	if err := loadSessionAuth(tx, &f, now); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return a.revokeRefreshFamily(tx, &f, err)
+		}
+		return nil, "", err
+	}
+	if err := checkLoginMethod(tx, &f); err != nil {
+		if errors.Is(err, ErrLoginMethodRemoved) {
+			return a.revokeRefreshFamily(tx, &f, err)
+		}
+		return nil, "", err
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now, id); err != nil {
+		return nil, "", err
+	}
+	next, err := a.insertRefreshToken(tx, f)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return &f, next, nil
+}
+
+// revokeRefreshFamily revokes every token of f, commits tx and returns
+// reason as the error of rotateRefreshToken.
+func (a *App) revokeRefreshFamily(tx *sql.Tx, f *refreshFamily, reason error) (*refreshFamily, string, error) {
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), f.ID); err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return f, "", reason
+}
+
+// loadSessionAuth replaces the auth context of f with the current one of its
+// session, which a step-up re-authentication may have renewed since the
+// family was issued. It returns ErrSessionNotFound once the session has been
+// logged out, revoked by a password reset or has expired.
+func loadSessionAuth(db queryRower, f *refreshFamily, now time.Time) error {
+	var (
+		method    string
+		credID    []byte
+		authTime  time.Time
+		expiresAt time.Time
+		revokedAt sql.NullTime
+	)
+	err := db.QueryRow("SELECT auth_method, credential_id, auth_time, expires_at, revoked_at FROM sessions WHERE id = ?", f.SessionID).
+		Scan(&method, &credID, &authTime, &expiresAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if revokedAt.Valid || !now.Before(expiresAt) {
+		return ErrSessionNotFound
+	}
+	f.AuthMethod, f.CredentialID, f.AuthTime = method, credID, authTime
+	return nil
+}
+
+// checkLoginMethod reports whether the login behind f still stands: the
+// passkey it used still exists and is not locked, or the password it used
+// has not been changed since.
+func checkLoginMethod(db queryRower, f *refreshFamily) error {
+	switch f.AuthMethod {
+	case amrHardwareKey:
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM credentials WHERE user_id = ? AND credential_id = ? AND locked_at IS NULL",
+			f.UserID, f.CredentialID).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrLoginMethodRemoved
+		}
+	case amrPassword:
+		var (
+			hash      sql.NullString
+			changedAt sql.NullTime
+		)
+		err := db.QueryRow("SELECT password_hash, password_changed_at FROM users WHERE id = ?", f.UserID).Scan(&hash, &changedAt)
+		if err != nil {
+			return err
+		}
+		if !hash.Valid || (changedAt.Valid && changedAt.Time.After(f.AuthTime)) {
+			return ErrLoginMethodRemoved
+		}
+	default:
+		return ErrLoginMethodRemoved
+	}
+	return nil
+}
+
+// refreshTokenHandler exchanges a refresh token for a new access token and
+// the next refresh token of its family.
+func (a *App) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		jsonError(w, "Refresh token required", http.StatusBadRequest)
+		return
+	}
+
+	family, next, err := a.rotateRefreshToken(req.RefreshToken)
+	switch {
+	case errors.Is(err, ErrRefreshTokenReused):
+		log.Printf("refresh token reuse: user %d family %s revoked", family.UserID, family.ID)
+		a.recordAudit(r, auditEvent{Event: auditRefreshRejected, Reason: codeRefreshTokenReused, UserID: family.UserID})
+		jsonErrorCode(w, codeRefreshTokenReused, "Refresh token already used; please log in again", http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrLoginMethodRemoved), errors.Is(err, ErrSessionNotFound):
+		jsonErrorCode(w, codeLoginMethodRemoved, "Login no longer valid; please log in again", http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrRefreshTokenInvalid):
+		jsonErrorCode(w, codeInvalidRefreshToken, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("rotateRefreshToken error: %v", err)
+		jsonError(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := a.getUserByID(family.UserID)
+	if err != nil {
+		jsonErrorCode(w, codeInvalidRefreshToken, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	token, claims, err := a.tokens.Issue(user, AuthContext{
+		Method:       family.AuthMethod,
+		Time:         family.AuthTime,
+		CredentialID: family.CredentialID,
+		SessionID:    family.SessionID,
+	})
+	if err != nil {
+		log.Printf("Issue token error: %v", err)
+		jsonError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]any{
+		"token":         token,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		"refresh_token": next,
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// loginWithRefresh starts a login session for user as the login handlers do
+// and returns its refresh token.
+func loginWithRefresh(t *testing.T, app *App, user *User, amr string, credID []byte) (string, *LoginSession) {
+	t.Helper()
+	_, session, err := app.createLoginSession(user.ID, amr, credID, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatalf("createLoginSession: %v", err)
+	}
+	token, err := app.issueRefreshToken(session)
+	if err != nil {
+		t.Fatalf("issueRefreshToken: %v", err)
+	}
+	return token, session
+}
+
+// refresh posts token to the refresh endpoint and returns the status and body.
+func refresh(t *testing.T, app *App, token string) (int, map[string]any) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"refresh_token": token})
+	w := httptest.NewRecorder()
+	app.refreshTokenHandler(w, httptest.NewRequest("POST", "/api/auth/token/refresh", bytes.NewReader(body)))
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func TestRefreshTokenRotates(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	token, _ := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+
+	var stored int
+	app.db.QueryRow("SELECT COUNT(*) FROM refresh_tokens WHERE id = ?", token).Scan(&stored)
+	if stored != 0 {
+		t.Fatal("expected refresh tokens to be stored hashed")
+	}
+
+	code, resp := refresh(t, app, token)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp)
+	}
+	next, _ := resp["refresh_token"].(string)
+	if next == "" || next == token {
+		t.Fatalf("expected a new refresh token, got %q", next)
+	}
+	claims, err := app.tokens.Verify(resp["token"].(string))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Subject != user.Subject() || claims.AMR[0] != amrHardwareKey {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	if code, resp := refresh(t, app, next); code != http.StatusOK {
+		t.Fatalf("expected the rotated token to work, got %d: %v", code, resp)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	token, _ := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+	other, _ := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+
+	_, resp := refresh(t, app, token)
+	next := resp["refresh_token"].(string)
+
+	code, resp := refresh(t, app, token)
+	if code != http.StatusUnauthorized || resp["code"] != codeRefreshTokenReused {
+		t.Fatalf("expected reuse to be detected, got %d: %v", code, resp)
+	}
+	if code, resp := refresh(t, app, next); code != http.StatusUnauthorized || resp["code"] != codeInvalidRefreshToken {
+		t.Fatalf("expected the family to be revoked, got %d: %v", code, resp)
+	}
+	if code, _ := refresh(t, app, other); code != http.StatusOK {
+		t.Fatalf("expected other logins to keep working, got %d", code)
+	}
+
+	var n int
+	app.db.QueryRow("SELECT COUNT(*) FROM audit_events WHERE event = ? AND user_id = ?", auditRefreshRejected, user.ID).Scan(&n)
+	if n != 1 {
+		t.Fatalf("expected the reuse to be audited, got %d events", n)
+	}
+}
+
+func TestRefreshTokenFailsAfterPasskeyDeleted(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1", "cred-2")
+	token, _ := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+	kept, _ := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-2"))
+
+	if err := app.deletePasskey(user.ID, []byte("cred-1")); err != nil {
+		t.Fatalf("deletePasskey: %v", err)
+	}
+
+	if code, resp := refresh(t, app, token); code != http.StatusUnauthorized || resp["code"] != codeLoginMethodRemoved {
+		t.Fatalf("expected refresh to fail, got %d: %v", code, resp)
+	}
+	if code, _ := refresh(t, app, kept); code != http.StatusOK {
+		t.Fatalf("expected logins with the other passkey to keep working, got %d", code)
+	}
+}
+
+func TestRefreshTokenFailsAfterPasswordChanged(t *testing.T) {
+	app := newTestApp(t)
+	user, err := app.saveUser("carol@example.com", "Carol")
+	if err != nil {
+		t.Fatalf("saveUser: %v", err)
+	}
+	if err := app.setPassword(user.ID, "old-password"); err != nil {
+		t.Fatalf("setPassword: %v", err)
+	}
+	token, _ := loginWithRefresh(t, app, user, amrPassword, nil)
+
+	// Upgrading the hash keeps the password, and so the refresh token.
+	if err := app.rehashPassword(user.ID, "old-password"); err != nil {
+		t.Fatalf("rehashPassword: %v", err)
+	}
+	code, resp := refresh(t, app, token)
+	if code != http.StatusOK {
+		t.Fatalf("expected refresh after a rehash to work, got %d: %v", code, resp)
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := app.setPassword(user.ID, "new-password"); err != nil {
+		t.Fatalf("setPassword: %v", err)
+	}
+	if code, resp := refresh(t, app, resp["refresh_token"].(string)); code != http.StatusUnauthorized || resp["code"] != codeLoginMethodRemoved {
+		t.Fatalf("expected refresh to fail after a password change, got %d: %v", code, resp)
+	}
+}
+
+func TestRefreshTokenFailsAfterLogout(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	token, session := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+
+	if _, err := app.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ?", time.Now().UTC(), session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := refresh(t, app, token); code != http.StatusUnauthorized {
+		t.Fatalf("expected refresh to fail after logout, got %d", code)
+	}
+}
+
+func TestRefreshTokenFailsAfterSessionExpired(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	token, session := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+
+	app.db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Minute), session.ID)
+	if code, resp := refresh(t, app, token); code != http.StatusUnauthorized || resp["code"] != codeLoginMethodRemoved {
+		t.Fatalf("expected refresh to fail once the session expired, got %d: %v", code, resp)
+	}
+}
+
+func TestRefreshTokenCarriesSessionStepUp(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	if err := app.setPassword(user.ID, "password"); err != nil {
+		t.Fatalf("setPassword: %v", err)
+	}
+	token, session := loginWithRefresh(t, app, user, amrPassword, nil)
+
+	// The user confirms with a passkey after the refresh token was issued.
+	stepped := time.Now().UTC().Add(time.Minute).Truncate(time.Second)
+	if err := app.recordReauth(AuthContext{Method: amrHardwareKey, Time: stepped, CredentialID: []byte("cred-1"), SessionID: session.ID}); err != nil {
+		t.Fatalf("recordReauth: %v", err)
+	}
+
+	code, resp := refresh(t, app, token)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", code, resp)
+	}
+	claims, err := app.tokens.Verify(resp["token"].(string))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.AMR[0] != amrHardwareKey || !claims.AuthTime.Time.Equal(stepped) ||
+		claims.CredentialID != encodeCredentialID([]byte("cred-1")) {
+		t.Fatalf("expected the step-up to be reflected, got %+v", claims)
+	}
+}
+
+func TestNewAppRejectsRefreshTokensOutlivingSessions(t *testing.T) {
+	_, err := NewApp(":memory:", &webauthn.Config{
+		RPDisplayName: "Passkey Demo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:3000"},
+	}, WithSessionTTL(time.Hour), WithRefreshTokenTTL(2*time.Hour))
+	if err == nil {
+		t.Fatal("expected NewApp to reject a refresh token lifetime longer than the session's")
+	}
+}
+
+func TestRefreshTokenInvalid(t *testing.T) {
+	app := newTestApp(t, WithRefreshTokenTTL(time.Millisecond))
+	user, _ := seedPasskeyUser(t, app, "alice", "cred-1")
+	token, _ := loginWithRefresh(t, app, user, amrHardwareKey, []byte("cred-1"))
+
+	time.Sleep(5 * time.Millisecond)
+	if code, resp := refresh(t, app, token); code != http.StatusUnauthorized || resp["code"] != codeInvalidRefreshToken {
+		t.Fatalf("expected an expired token to be rejected, got %d: %v", code, resp)
+	}
+	if code, _ := refresh(t, app, "not-a-token"); code != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown token to be rejected, got %d", code)
+	}
+	if code, _ := refresh(t, app, ""); code != http.StatusBadRequest {
+		t.Fatalf("expected a missing token to be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// RegistrationPolicy controls the options registerBegin asks the browser for
+// when creating a passkey, and what registerFinish accepts in return.
+type RegistrationPolicy struct {
+	ResidentKey      protocol.ResidentKeyRequirement
+	UserVerification protocol.UserVerificationRequirement
+	// Attachment restricts registration to platform or cross-platform
+	// authenticators; empty allows both.
+	Attachment  protocol.AuthenticatorAttachment
+	Attestation protocol.ConveyancePreference
+	// Algorithms lists the accepted COSE algorithms, most preferred first.
+	Algorithms []webauthncose.COSEAlgorithmIdentifier
+	// Timeout is how long the browser gives the user to complete the
+	// ceremony; zero leaves it to the library default.
+	Timeout time.Duration
+	Hints   []protocol.PublicKeyCredentialHints
+}
+
+// DefaultRegistrationPolicy requires discoverable credentials and otherwise
+// keeps the WebAuthn and library defaults.
+func DefaultRegistrationPolicy() RegistrationPolicy {
+	p := RegistrationPolicy{
+		ResidentKey:      protocol.ResidentKeyRequirementRequired,
+		UserVerification: protocol.VerificationPreferred,
+		Attestation:      protocol.PreferNoAttestation,
+	}
+	for _, param := range webauthn.CredentialParametersDefault() {
+		p.Algorithms = append(p.Algorithms, param.Algorithm)
+	}
+	return p
+}
+
+// coseAlgorithms maps the algorithm names accepted in configuration to their
+// COSE identifiers.
+var coseAlgorithms = map[string]webauthncose.COSEAlgorithmIdentifier{
+	"EdDSA": webauthncose.AlgEdDSA,
+	"ES256": webauthncose.AlgES256,
+	"ES384": webauthncose.AlgES384,
+	"ES512": webauthncose.AlgES512,
+	"RS256": webauthncose.AlgRS256,
+	"RS384": webauthncose.AlgRS384,
+	"RS512": webauthncose.AlgRS512,
+	"PS256": webauthncose.AlgPS256,
+	"PS384": webauthncose.AlgPS384,
+	"PS512": webauthncose.AlgPS512,
+}
+
+// ParseCOSEAlgorithms parses a comma-separated list of algorithm names such
+// as "EdDSA,ES256".
+func ParseCOSEAlgorithms(s string) ([]webauthncose.COSEAlgorithmIdentifier, error) {
+	var algs []webauthncose.COSEAlgorithmIdentifier
+	for _, name := range splitList(s) {
+		alg, ok := coseAlgorithms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown COSE algorithm %q", name)
+		}
+		algs = append(algs, alg)
+	}
+	return algs, nil
+}
+
+// ParsePublicKeyCredentialHints parses a comma-separated list of hints such
+// as "security-key,hybrid".
+func ParsePublicKeyCredentialHints(s string) []protocol.PublicKeyCredentialHints {
+	var hints []protocol.PublicKeyCredentialHints
+	for _, h := range splitList(s) {
+		hints = append(hints, protocol.PublicKeyCredentialHints(h))
+	}
+	return hints
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate reports settings that are not valid WebAuthn values.
+func (p RegistrationPolicy) Validate() error {
+	switch p.ResidentKey {
+	case protocol.ResidentKeyRequirementRequired, protocol.ResidentKeyRequirementPreferred, protocol.ResidentKeyRequirementDiscouraged:
+	default:
+		return fmt.Errorf("unknown resident key requirement %q: want required, preferred or discouraged", p.ResidentKey)
+	}
+	switch p.UserVerification {
+	case protocol.VerificationRequired, protocol.VerificationPreferred, protocol.VerificationDiscouraged:
+	default:
+		return fmt.Errorf("unknown user verification requirement %q: want required, preferred or discouraged", p.UserVerification)
+	}
+	switch p.Attachment {
+	case "", protocol.Platform, protocol.CrossPlatform:
+	default:
+		return fmt.Errorf("unknown authenticator attachment %q: want platform or cross-platform", p.Attachment)
+	}
+	switch p.Attestation {
+	case protocol.PreferNoAttestation, protocol.PreferIndirectAttestation, protocol.PreferDirectAttestation, protocol.PreferEnterpriseAttestation:
+	default:
+		return fmt.Errorf("unknown attestation conveyance %q: want none, indirect, direct or enterprise", p.Attestation)
+	}
+	if len(p.Algorithms) == 0 {
+		return errors.New("no COSE algorithms allowed")
+	}
+	if p.Timeout < 0 {
+		return errors.New("negative registration timeout")
+	}
+	for _, h := range p.Hints {
+		switch h {
+		case protocol.PublicKeyCredentialHintSecurityKey, protocol.PublicKeyCredentialHintClientDevice, protocol.PublicKeyCredentialHintHybrid:
+		default:
+			return fmt.Errorf("unknown hint %q: want security-key, client-device or hybrid", h)
+		}
+	}
+	return nil
+}
+
+// registrationOptions returns the library options that apply p. Conditional
+// create happens without a prompt, so it cannot require user verification.
+func (p RegistrationPolicy) registrationOptions(mediation protocol.CredentialMediationRequirement) []webauthn.RegistrationOption {
+	uv := p.UserVerification
+	if mediation == protocol.MediationConditional && uv == protocol.VerificationRequired {
+		uv = protocol.VerificationPreferred
+	}
+
+	params := make([]protocol.CredentialParameter, len(p.Algorithms))
+	for i, alg := range p.Algorithms {
+		params[i] = protocol.CredentialParameter{Type: protocol.PublicKeyCredentialType, Algorithm: alg}
+	}
+
+	opts := []webauthn.RegistrationOption{
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			AuthenticatorAttachment: p.Attachment,
+			UserVerification:        uv,
+		}),
+		webauthn.WithResidentKeyRequirement(p.ResidentKey),
+		webauthn.WithCredentialParameters(params),
+		webauthn.WithConveyancePreference(p.Attestation),
+		webauthn.WithExtensions(protocol.AuthenticationExtensions{"credProps": true}),
+	}
+	if len(p.Hints) > 0 {
+		opts = append(opts, webauthn.WithPublicKeyCredentialHints(p.Hints))
+	}
+	if p.Timeout > 0 {
+		opts = append(opts, func(o *protocol.PublicKeyCredentialCreationOptions) {
+			o.Timeout = int(p.Timeout.Milliseconds())
+		})
+	}
+	return opts
+}
+
+// Registration policy violations found by checkRegistration.
+var (
+	ErrAttachmentNotAllowed = errors.New("authenticator attachment not allowed")
+	ErrAttestationRequired  = errors.New("attestation statement required")
+	ErrNotDiscoverable      = errors.New("credential is not discoverable")
+)
+
+// checkRegistration verifies the parts of a new credential that the library
+// does not check against the session; the algorithm and user verification
+// are already enforced by CreateCredential.
+func (p RegistrationPolicy) checkRegistration(parsed *protocol.ParsedCredentialCreationData, cred *webauthn.Credential) error {
+	if p.Attachment != "" && cred.Authenticator.Attachment != p.Attachment {
+		return ErrAttachmentNotAllowed
+	}
+	if (p.Attestation == protocol.PreferDirectAttestation || p.Attestation == protocol.PreferEnterpriseAttestation) &&
+		(cred.AttestationType == "" || cred.AttestationType == string(protocol.AttestationFormatNone)) {
+		return ErrAttestationRequired
+	}
+	// Clients report whether the credential is discoverable through the
+	// credProps extension; absent that, the authenticator is trusted to have
+	// honoured the requirement.
+	if p.ResidentKey == protocol.ResidentKeyRequirementRequired {
+		if props, ok := parsed.ClientExtensionResults["credProps"].(map[string]any); ok {
+			if rk, ok := props["rk"].(bool); ok && !rk {
+				return ErrNotDiscoverable
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestDefaultRegistrationPolicyIsValid(t *testing.T) {
+	if err := DefaultRegistrationPolicy().Validate(); err != nil {
+		t.Fatalf("default policy invalid: %v", err)
+	}
+}
+
+func TestRegistrationPolicyValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*RegistrationPolicy){
+		"resident key":      func(p *RegistrationPolicy) { p.ResidentKey = "always" },
+		"user verification": func(p *RegistrationPolicy) { p.UserVerification = "sometimes" },
+		"attachment":        func(p *RegistrationPolicy) { p.Attachment = "usb" },
+		"attestation":       func(p *RegistrationPolicy) { p.Attestation = "full" },
+		"no algorithms":     func(p *RegistrationPolicy) { p.Algorithms = nil },
+		"negative timeout":  func(p *RegistrationPolicy) { p.Timeout = -time.Second },
+		"hint":              func(p *RegistrationPolicy) { p.Hints = []protocol.PublicKeyCredentialHints{"phone"} },
+	} {
+		p := DefaultRegistrationPolicy()
+		mutate(&p)
+		if err := p.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
+
+func TestParseCOSEAlgorithms(t *testing.T) {
+	algs, err := ParseCOSEAlgorithms("EdDSA, ES256,,RS256")
+	if err != nil {
+		t.Fatalf("ParseCOSEAlgorithms: %v", err)
+	}
+	want := []webauthncose.COSEAlgorithmIdentifier{webauthncose.AlgEdDSA, webauthncose.AlgES256, webauthncose.AlgRS256}
+	if !slices.Equal(algs, want) {
+		t.Fatalf("expected %v, got %v", want, algs)
+	}
+
+	if _, err := ParseCOSEAlgorithms("ES256,HS256"); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+}
+
+func TestNewAppRejectsInvalidRegistrationPolicy(t *testing.T) {
+	p := DefaultRegistrationPolicy()
+	p.Attestation = "full"
+	_, err := NewApp(":memory:", &webauthn.Config{
+		RPDisplayName: "Passkey Demo",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:3000"},
+	}, WithRegistrationPolicy(p))
+	if err == nil {
+		t.Fatal("expected NewApp to reject the policy")
+	}
+}
+
+func TestRegisterBeginAppliesPolicy(t *testing.T) {
+	policy := RegistrationPolicy{
+		ResidentKey:      protocol.ResidentKeyRequirementDiscouraged,
+		UserVerification: protocol.VerificationRequired,
+		Attachment:       protocol.CrossPlatform,
+		Attestation:      protocol.PreferDirectAttestation,
+		Algorithms:       []webauthncose.COSEAlgorithmIdentifier{webauthncose.AlgES256},
+		Timeout:          10 * time.Minute,
+		Hints:            []protocol.PublicKeyCredentialHints{protocol.PublicKeyCredentialHintSecurityKey},
+	}
+	app := newTestApp(t, WithRegistrationPolicy(policy))
+
+	w := httptest.NewRecorder()
+	app.registerBegin(w, httptest.NewRequest("POST", "/api/auth/register/begin?username=alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var opts registrationOptions
+	if err := json.NewDecoder(w.Body).Decode(&opts); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	pk := opts.Response
+	sel := pk.AuthenticatorSelection
+	if sel.AuthenticatorAttachment != protocol.CrossPlatform ||
+		sel.ResidentKey != protocol.ResidentKeyRequirementDiscouraged ||
+		sel.UserVerification != protocol.VerificationRequired {
+		t.Fatalf("unexpected authenticator selection %+v", sel)
+	}
+	if pk.Attestation != protocol.PreferDirectAttestation {
+		t.Fatalf("expected direct attestation, got %q", pk.Attestation)
+	}
+	if len(pk.Parameters) != 1 || pk.Parameters[0].Algorithm != webauthncose.AlgES256 {
+		t.Fatalf("expected only ES256, got %+v", pk.Parameters)
+	}
+	if pk.Timeout != int((10 * time.Minute).Milliseconds()) {
+		t.Fatalf("expected a 10 minute timeout, got %dms", pk.Timeout)
+	}
+	if !slices.Equal(pk.Hints, policy.Hints) {
+		t.Fatalf("expected hints %v, got %v", policy.Hints, pk.Hints)
+	}
+
+	ceremony, err := app.ceremonies.Get(opts.CeremonyID)
+	if err != nil {
+		t.Fatalf("expected stored ceremony: %v", err)
+	}
+	if ceremony.Session.UserVerification != protocol.VerificationRequired {
+		t.Fatalf("expected the session to require user verification, got %q", ceremony.Session.UserVerification)
+	}
+}
+
+func TestConditionalCreateDoesNotRequireUserVerification(t *testing.T) {
+	policy := DefaultRegistrationPolicy()
+	policy.UserVerification = protocol.VerificationRequired
+
+	creation := &protocol.PublicKeyCredentialCreationOptions{}
+	for _, opt := range policy.registrationOptions(protocol.MediationConditional) {
+		opt(creation)
+	}
+	if creation.AuthenticatorSelection.UserVerification != protocol.VerificationPreferred {
+		t.Fatalf("expected preferred user verification, got %q", creation.AuthenticatorSelection.UserVerification)
+	}
+}
+
+func TestCheckRegistration(t *testing.T) {
+	credProps := func(rk bool) *protocol.ParsedCredentialCreationData {
+		parsed := &protocol.ParsedCredentialCreationData{}
+		parsed.ClientExtensionResults = map[string]any{"credProps": map[string]any{"rk": rk}}
+		return parsed
+	}
+	cred := func(attachment protocol.AuthenticatorAttachment, format string) *webauthn.Credential {
+		return &webauthn.Credential{
+			AttestationType: format,
+			Authenticator:   webauthn.Authenticator{Attachment: attachment},
+		}
+	}
+
+	internal := DefaultRegistrationPolicy()
+	internal.Attachment = protocol.CrossPlatform
+	internal.Attestation = protocol.PreferDirectAttestation
+
+	tests := []struct {
+		name   string
+		policy RegistrationPolicy
+		parsed *protocol.ParsedCredentialCreationData
+		cred   *webauthn.Credential
+		want   error
+	}{
+		{"default accepts none attestation", DefaultRegistrationPolicy(), credProps(true), cred(protocol.Platform, "none"), nil},
+		{"missing credProps is trusted", DefaultRegistrationPolicy(), &protocol.ParsedCredentialCreationData{}, cred(protocol.Platform, "none"), nil},
+		{"non-discoverable", DefaultRegistrationPolicy(), credProps(false), cred(protocol.Platform, "none"), ErrNotDiscoverable},
+		{"wrong attachment", internal, credProps(true), cred(protocol.Platform, "packed"), ErrAttachmentNotAllowed},
+		{"missing attestation", internal, credProps(true), cred(protocol.CrossPlatform, "none"), ErrAttestationRequired},
+		{"attested security key", internal, credProps(true), cred(protocol.CrossPlatform, "packed"), nil},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.checkRegistration(tt.parsed, tt.cred); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
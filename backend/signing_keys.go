@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningAlgorithm is a JWS algorithm access tokens can be signed with.
+type SigningAlgorithm string
+
+const (
+	SigningEdDSA SigningAlgorithm = "EdDSA" // Ed25519
+	SigningES256 SigningAlgorithm = "ES256" // ECDSA P-256 with SHA-256
+)
+
+// ParseSigningAlgorithm validates an algorithm name from configuration.
+func ParseSigningAlgorithm(s string) (SigningAlgorithm, error) {
+	switch alg := SigningAlgorithm(s); alg {
+	case SigningEdDSA, SigningES256:
+		return alg, nil
+	}
+	return "", fmt.Errorf("unknown signing algorithm %q: want EdDSA or ES256", s)
+}
+
+// method returns the jwt signing method for alg.
+func (alg SigningAlgorithm) method() jwt.SigningMethod {
+	if alg == SigningES256 {
+		return jwt.SigningMethodES256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// SigningKey is one key pair of a KeyRing. It is published in the JWKS from
+// CreatedAt, signs tokens from ActivatesAt until the next key activates, and
+// stays published for the rotation's retention period after that.
+type SigningKey struct {
+	ID          string // kid, the RFC 7638 thumbprint of the public key
+	Algorithm   SigningAlgorithm
+	Private     crypto.Signer // ed25519.PrivateKey or *ecdsa.PrivateKey
+	CreatedAt   time.Time
+	ActivatesAt time.Time
+}
+
+// generateSigningKey creates a key for alg that starts signing at activatesAt.
+func generateSigningKey(alg SigningAlgorithm, now, activatesAt time.Time) (*SigningKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch alg {
+	case SigningEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case SigningES256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = fmt.Errorf("unknown signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(alg, priv, now, activatesAt)
+}
+
+// newSigningKey wraps an existing private key, deriving its key ID.
+func newSigningKey(alg SigningAlgorithm, priv crypto.Signer, createdAt, activatesAt time.Time) (*SigningKey, error) {
+	k := &SigningKey{Algorithm: alg, Private: priv, CreatedAt: createdAt.UTC(), ActivatesAt: activatesAt.UTC()}
+	jwk, err := k.publicJWK()
+	if err != nil {
+		return nil, err
+	}
+	k.ID = jwk.thumbprint()
+	return k, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *SigningKey) publicJWK() (JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := k.Private.Public().(type) {
+	case ed25519.PublicKey:
+		if k.Algorithm != SigningEdDSA {
+			break
+		}
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub), Kid: k.ID, Alg: string(k.Algorithm), Use: "sig"}, nil
+	case *ecdsa.PublicKey:
+		if k.Algorithm != SigningES256 || pub.Curve != elliptic.P256() {
+			break
+		}
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return JWK{}, err
+		}
+		// Uncompressed point: 0x04 || X || Y, 32 bytes each.
+		point := ecdhPub.Bytes()
+		return JWK{Kty: "EC", Crv: "P-256", X: b64(point[1:33]), Y: b64(point[33:]), Kid: k.ID, Alg: string(k.Algorithm), Use: "sig"}, nil
+	}
+	return JWK{}, fmt.Errorf("%T is not a %s key", k.Private, k.Algorithm)
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of the key: a hash over its
+// required members in lexicographic order.
+func (j JWK) thumbprint() string {
+	var canonical string
+	if j.Kty == "EC" {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, j.Crv, j.Kty, j.X, j.Y)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, j.Crv, j.Kty, j.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwksMaxAge is how long verifiers may cache the JWKS. New keys are published
+// at least this long before they sign anything.
+const jwksMaxAge = 5 * time.Minute
+
+// defaultKeyRotationCheck is how often the App checks whether a new signing
+// key is due, and so how often it picks up keys other replicas published.
+const defaultKeyRotationCheck = time.Hour
+
+// KeyRotation controls how often signing keys are replaced.
+type KeyRotation struct {
+	// Algorithm is used for new keys; existing keys keep theirs until they
+	// are rotated out.
+	Algorithm SigningAlgorithm
+	// Interval is how long each key signs tokens before the next one takes
+	// over.
+	Interval time.Duration
+	// PrePublish is how long a new key is published before it signs, so
+	// verifiers that cache the JWKS know it in time.
+	PrePublish time.Duration
+	// Retention is how long a replaced key stays published. It must be at
+	// least the access token lifetime.
+	Retention time.Duration
+}
+
+// DefaultKeyRotation rotates Ed25519 keys every 30 days, publishing each a
+// day ahead and keeping it a day after it is replaced.
+func DefaultKeyRotation() KeyRotation {
+	return KeyRotation{
+		Algorithm:  SigningEdDSA,
+		Interval:   30 * 24 * time.Hour,
+		PrePublish: 24 * time.Hour,
+		Retention:  24 * time.Hour,
+	}
+}
+
+// Validate reports settings that could get a token signed by a key that
+// verifiers cannot know yet.
+func (r KeyRotation) Validate() error {
+	if _, err := ParseSigningAlgorithm(string(r.Algorithm)); err != nil {
+		return err
+	}
+	if r.PrePublish < jwksMaxAge {
+		return fmt.Errorf("keys must be published at least %s before use", jwksMaxAge)
+	}
+	if r.Interval <= r.PrePublish {
+		return errors.New("rotation interval must be longer than the pre-publish period")
+	}
+	if r.Retention < 0 {
+		return errors.New("negative key retention")
+	}
+	return nil
+}
+
+// KeyRing holds the signing keys of a TokenService and rotates them. Keys
+// are kept in a KeyStore so they survive restarts and can be shared by
+// replicas. It is safe for concurrent use.
+type KeyRing struct {
+	store    KeyStore
+	rotation KeyRotation
+
+	mu   sync.RWMutex
+	keys []*SigningKey // ordered by ActivatesAt
+}
+
+// NewKeyRing loads the keys in store and creates whatever keys are due.
+func NewKeyRing(store KeyStore, rotation KeyRotation) (*KeyRing, error) {
+	if err := rotation.Validate(); err != nil {
+		return nil, err
+	}
+	r := &KeyRing{store: store, rotation: rotation}
+	if err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate brings the ring up to date: it makes sure a key is active, publishes
+// the next key PrePublish before the current one's interval ends, and drops
+// keys replaced more than Retention ago. It works from the keys in the store
+// merged with its own, holding the store's lock, so replicas sharing a store
+// adopt each other's keys instead of each publishing their own. Changes are
+// saved to the store before they take effect.
+func (r *KeyRing) Rotate() error {
+	return r.rotate(time.Now())
+}
+
+func (r *KeyRing) rotate(now time.Time) error {
+	unlock, err := r.store.Lock()
+	if err != nil {
+		return fmt.Errorf("lock signing keys: %w", err)
+	}
+	defer unlock()
+	stored, err := r.store.Load()
+	if err != nil {
+		return fmt.Errorf("load signing keys: %w", err)
+	}
+	slices.SortFunc(stored, func(a, b *SigningKey) int { return a.ActivatesAt.Compare(b.ActivatesAt) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := mergeSigningKeys(stored, r.keys)
+	for len(keys) > 1 && !now.Before(keys[1].ActivatesAt.Add(r.rotation.Retention)) {
+		keys = keys[1:]
+	}
+
+	var next *SigningKey
+	if len(keys) == 0 {
+		// Nothing can have cached a key yet, so the first one signs at once.
+		next, err = generateSigningKey(r.rotation.Algorithm, now, now)
+	} else {
+		newest := keys[len(keys)-1]
+		due := newest.ActivatesAt.Add(r.rotation.Interval)
+		if newest.Algorithm != r.rotation.Algorithm {
+			due = now
+		}
+		if !now.Before(due.Add(-r.rotation.PrePublish)) {
+			next, err = generateSigningKey(r.rotation.Algorithm, now, later(due, now.Add(r.rotation.PrePublish)))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("generate signing key: %w", err)
+	}
+	if next != nil {
+		keys = append(keys, next)
+	}
+
+	if slices.EqualFunc(keys, stored, func(a, b *SigningKey) bool { return a.ID == b.ID }) {
+		r.keys = keys
+		return nil
+	}
+	if err := r.store.Save(keys); err != nil {
+		return fmt.Errorf("save signing keys: %w", err)
+	}
+	if next != nil {
+		log.Printf("published signing key %s (%s), signing from %s", next.ID, next.Algorithm, next.ActivatesAt.Format(time.RFC3339))
+	}
+	r.keys = keys
+	return nil
+}
+
+// mergeSigningKeys returns the keys of both sets, each once, ordered by
+// ActivatesAt.
+func mergeSigningKeys(a, b []*SigningKey) []*SigningKey {
+	keys := slices.Clone(a)
+	for _, k := range b {
+		if !slices.ContainsFunc(keys, func(o *SigningKey) bool { return o.ID == k.ID }) {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, func(a, b *SigningKey) int { return a.ActivatesAt.Compare(b.ActivatesAt) })
+	return keys
+}
+
+// checkInterval is how often Rotate should run. Besides creating keys on
+// time, it must pick up a key another replica published early enough that
+// verifiers caching this replica's JWKS know the key before it signs.
+func (r *KeyRing) checkInterval() time.Duration {
+	return max(min(defaultKeyRotationCheck, r.rotation.PrePublish-jwksMaxAge), time.Minute)
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// signingKey returns the key that signs tokens at now: the most recent one
+// that has activated.
+func (r *KeyRing) signingKey(now time.Time) (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		if !now.Before(r.keys[i].ActivatesAt) {
+			return r.keys[i], nil
+		}
+	}
+	return nil, errors.New("no active signing key")
+}
+
+// key returns the published key with the given ID.
+func (r *KeyRing) key(kid string) (*SigningKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.ID == kid {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns the public half of every published key.
+func (r *KeyRing) JWKS() JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set := JWKS{Keys: make([]JWK, 0, len(r.keys))}
+	for _, k := range r.keys {
+		jwk, err := k.publicJWK()
+		if err != nil {
+			log.Printf("signing key %s: %v", k.ID, err)
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// jwksHandler serves the public signing keys so other services can verify
+// access tokens.
+func (a *App) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	jsonResponse(w, a.tokens.keys.JWKS())
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// publicKeyFromJWK rebuilds a public key the way a verifying service would.
+func publicKeyFromJWK(t *testing.T, jwk JWK) any {
+	t.Helper()
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decode JWK member: %v", err)
+		}
+		return b
+	}
+	switch jwk.Kty {
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	case "EC":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decode(jwk.X)), Y: new(big.Int).SetBytes(decode(jwk.Y))}
+	}
+	t.Fatalf("unexpected key type %q", jwk.Kty)
+	return nil
+}
+
+func TestTokensVerifyAgainstJWKS(t *testing.T) {
+	for _, alg := range []SigningAlgorithm{SigningEdDSA, SigningES256} {
+		t.Run(string(alg), func(t *testing.T) {
+			ts, err := NewTokenService(newTestKeyRing(t, alg), "http://localhost:3000", time.Minute)
+			if err != nil {
+				t.Fatalf("NewTokenService: %v", err)
+			}
+			token, _, err := ts.Issue(&User{ID: 1, Handle: []byte("handle-1")}, AuthContext{Method: amrHardwareKey})
+			if err != nil {
+				t.Fatalf("Issue: %v", err)
+			}
+
+			set := ts.keys.JWKS()
+			if len(set.Keys) != 1 {
+				t.Fatalf("expected 1 published key, got %d", len(set.Keys))
+			}
+			jwk := set.Keys[0]
+			if jwk.Alg != string(alg) || jwk.Use != "sig" || jwk.Kid == "" {
+				t.Fatalf("unexpected JWK %+v", jwk)
+			}
+
+			parsed, err := jwt.Parse(token, func(token *jwt.Token) (any, error) {
+				if token.Header["kid"] != jwk.Kid {
+					t.Fatalf("expected kid %q, got %v", jwk.Kid, token.Header["kid"])
+				}
+				return publicKeyFromJWK(t, jwk), nil
+			}, jwt.WithValidMethods([]string{string(alg)}))
+			if err != nil || !parsed.Valid {
+				t.Fatalf("expected the token to verify against the JWKS: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyIDIsThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3.
+	jwk := JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	if got := jwk.thumbprint(); got != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Fatalf("unexpected thumbprint %q", got)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	rotation := KeyRotation{
+		Algorithm:  SigningEdDSA,
+		Interval:   10 * time.Hour,
+		PrePublish: time.Hour,
+		Retention:  2 * time.Hour,
+	}
+	store := NewMemoryKeyStore()
+	keys, err := NewKeyRing(store, rotation)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	first, err := keys.signingKey(time.Now())
+	if err != nil {
+		t.Fatalf("signingKey: %v", err)
+	}
+	start := first.ActivatesAt
+	published := func() int { return len(keys.JWKS().Keys) }
+
+	// Nothing is due before the pre-publish period.
+	if err := keys.rotate(start.Add(8 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if published() != 1 {
+		t.Fatalf("expected 1 key, got %d", published())
+	}
+
+	// The next key is published an hour early but does not sign yet.
+	if err := keys.rotate(start.Add(9 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if published() != 2 {
+		t.Fatalf("expected the next key to be published, got %d keys", published())
+	}
+	if k, _ := keys.signingKey(start.Add(9*time.Hour + 30*time.Minute)); k.ID != first.ID {
+		t.Fatal("expected the current key to sign until the interval ends")
+	}
+	second, _ := keys.signingKey(start.Add(10 * time.Hour))
+	if second.ID == first.ID {
+		t.Fatal("expected the new key to sign once the interval ends")
+	}
+	if !second.ActivatesAt.Equal(start.Add(10 * time.Hour)) {
+		t.Fatalf("expected the new key to activate at the end of the interval, got %s", second.ActivatesAt)
+	}
+
+	// The replaced key stays published for the retention period.
+	if err := keys.rotate(start.Add(11 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.key(first.ID); !ok {
+		t.Fatal("expected the replaced key to stay published")
+	}
+	if err := keys.rotate(start.Add(12 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.key(first.ID); ok {
+		t.Fatal("expected the replaced key to be dropped after the retention period")
+	}
+
+	saved, _ := store.Load()
+	if len(saved) != 1 || saved[0].ID != second.ID {
+		t.Fatalf("expected the store to hold only the current key, got %d keys", len(saved))
+	}
+}
+
+func TestKeyRingReplicasShareKeys(t *testing.T) {
+	rotation := KeyRotation{
+		Algorithm:  SigningEdDSA,
+		Interval:   10 * time.Hour,
+		PrePublish: time.Hour,
+		Retention:  2 * time.Hour,
+	}
+	store := NewMemoryKeyStore()
+	a, err := NewKeyRing(store, rotation)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	b, err := NewKeyRing(store, rotation)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	first, _ := a.signingKey(time.Now())
+	if k, _ := b.signingKey(time.Now()); k.ID != first.ID {
+		t.Fatal("expected the second replica to adopt the stored key")
+	}
+
+	due := first.ActivatesAt.Add(9 * time.Hour)
+	if err := a.rotate(due); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.rotate(due); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := store.Load()
+	if len(saved) != 2 {
+		t.Fatalf("expected one next key for both replicas, got %d keys", len(saved))
+	}
+	next := saved[1]
+	for _, ring := range []*KeyRing{a, b} {
+		if _, ok := ring.key(next.ID); !ok || len(ring.JWKS().Keys) != 2 {
+			t.Fatal("expected both replicas to publish the same keys")
+		}
+	}
+}
+
+func TestKeyRingPublishesNewAlgorithmBeforeUse(t *testing.T) {
+	store := NewMemoryKeyStore()
+	if _, err := NewKeyRing(store, DefaultKeyRotation()); err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+
+	rotation := DefaultKeyRotation()
+	rotation.Algorithm = SigningES256
+	keys, err := NewKeyRing(store, rotation)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	now := time.Now()
+	if k, _ := keys.signingKey(now); k.Algorithm != SigningEdDSA {
+		t.Fatal("expected the existing key to keep signing until the new one is published long enough")
+	}
+	if k, _ := keys.signingKey(now.Add(rotation.PrePublish)); k.Algorithm != SigningES256 {
+		t.Fatal("expected the ES256 key to take over after the pre-publish period")
+	}
+}
+
+func TestKeyRotationValidate(t *testing.T) {
+	if err := DefaultKeyRotation().Validate(); err != nil {
+		t.Fatalf("expected the default rotation to be valid: %v", err)
+	}
+	for name, mutate := range map[string]func(*KeyRotation){
+		"algorithm":   func(r *KeyRotation) { r.Algorithm = "HS256" },
+		"pre-publish": func(r *KeyRotation) { r.PrePublish = time.Minute },
+		"interval":    func(r *KeyRotation) { r.Interval = r.PrePublish },
+		"retention":   func(r *KeyRotation) { r.Retention = -time.Hour },
+	} {
+		r := DefaultKeyRotation()
+		mutate(&r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	app := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	app.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	if w.Header().Get("Cache-Control") == "" {
+		t.Fatal("expected the JWKS to be cacheable")
+	}
+	var set JWKS
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatalf("decode JWKS: %v", err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Kty != "OKP" {
+		t.Fatalf("unexpected JWKS %+v", set)
+	}
+}
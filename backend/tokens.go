@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Authentication method references (RFC 8176) recorded in the amr claim.
+const (
+	amrHardwareKey = "hwk"
+	amrPassword    = "pwd"
+)
+
+const defaultAccessTokenTTL = 15 * time.Minute
+
+// accessTokenType is the typ header of access tokens. Other records signed
+// with the same keys carry their own type, so they cannot pass as one.
+const accessTokenType = "JWT"
+
+// AccessClaims are the claims carried by an access token issued by TokenService.
+type AccessClaims struct {
+	AMR []string `json:"amr"`
+	// AuthTime is when the user authenticated, which for a refreshed token is
+	// earlier than its iat.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// SessionID names the login session the token was issued for, and
+	// CredentialID (base64url) the passkey used.
+	SessionID    string `json:"sid,omitempty"`
+	CredentialID string `json:"cid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// TokenService issues and verifies signed JWT access tokens. Tokens carry
+// the kid of the key in keys that signed them, and other services can verify
+// them against the published JWKS.
+type TokenService struct {
+	keys   *KeyRing
+	issuer string
+	ttl    time.Duration
+}
+
+// NewTokenService creates a TokenService that signs tokens with the active
+// key of keys. Replaced keys must stay published for as long as the tokens
+// they signed are valid.
+func NewTokenService(keys *KeyRing, issuer string, ttl time.Duration) (*TokenService, error) {
+	if ttl <= 0 {
+		ttl = defaultAccessTokenTTL
+	}
+	if keys.rotation.Retention < ttl {
+		return nil, fmt.Errorf("signing keys must stay published for at least the token lifetime (%s)", ttl)
+	}
+	return &TokenService{keys: keys, issuer: issuer, ttl: ttl}, nil
+}
+
+// newEphemeralTokenService creates a TokenService with keys kept in memory.
+// Tokens it issues become invalid when the process restarts.
+func newEphemeralTokenService(issuer string) (*TokenService, error) {
+	keys, err := NewKeyRing(NewMemoryKeyStore(), DefaultKeyRotation())
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenService(keys, issuer, defaultAccessTokenTTL)
+}
+
+// Issue creates a signed access token for user, recording how they
+// authenticated. A zero auth.Time means now.
+func (t *TokenService) Issue(user *User, auth AuthContext) (string, *AccessClaims, error) {
+	jti, err := randomID(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	key, err := t.keys.signingKey(now)
+	if err != nil {
+		return "", nil, err
+	}
+	authTime := auth.Time
+	if authTime.IsZero() {
+		authTime = now
+	}
+	claims := &AccessClaims{
+		AMR:       []string{auth.Method},
+		AuthTime:  jwt.NewNumericDate(authTime),
+		SessionID: auth.SessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.issuer,
+			Subject:   user.Subject(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.ttl)),
+			ID:        jti,
+		},
+	}
+
+	if auth.CredentialID != nil {
+		claims.CredentialID = encodeCredentialID(auth.CredentialID)
+	}
+	signed, err := sign(key, accessTokenType, claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// sign signs claims as a JWS of type typ with key.
+func sign(key *SigningKey, typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(key.Algorithm.method(), claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", fmt.Errorf("sign token: %w", err)
+	}
+	return signed, nil
+}
+
+// keyFunc resolves the published key that signed a JWS of type typ.
+func (t *TokenService) keyFunc(typ string) jwt.Keyfunc {
+	return func(token *jwt.Token) (any, error) {
+		if got, _ := token.Header["typ"].(string); got != typ {
+			return nil, fmt.Errorf("token type %q is not %q", got, typ)
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, ok := t.keys.key(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != string(key.Algorithm) {
+			return nil, fmt.Errorf("signing key %q is not for %s", kid, token.Method.Alg())
+		}
+		return key.Private.Public(), nil
+	}
+}
+
+// Verify parses an access token and checks its type, its signature against
+// the published key named by its kid, and its issuer and expiry.
+func (t *TokenService) Verify(token string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, t.keyFunc(accessTokenType),
+		jwt.WithValidMethods([]string{string(SigningEdDSA), string(SigningES256)}),
+		jwt.WithIssuer(t.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// bearerToken returns the access token of an Authorization: Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// randomID returns n random bytes encoded as unpadded base64url.
+func randomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestKeyRing(t *testing.T, alg SigningAlgorithm) *KeyRing {
+	t.Helper()
+	rotation := DefaultKeyRotation()
+	rotation.Algorithm = alg
+	keys, err := NewKeyRing(NewMemoryKeyStore(), rotation)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	return keys
+}
+
+func newTestTokenService(t *testing.T, ttl time.Duration) *TokenService {
+	t.Helper()
+	ts, err := NewTokenService(newTestKeyRing(t, SigningEdDSA), "http://localhost:3000", ttl)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	return ts
+}
+
+func TestNewTokenServiceRequiresKeyRetention(t *testing.T) {
+	if _, err := NewTokenService(newTestKeyRing(t, SigningEdDSA), "issuer", 48*time.Hour); err == nil {
+		t.Fatal("expected error for tokens outliving their signing key")
+	}
+}
+
+func TestTokenIssueAndVerify(t *testing.T) {
+	ts := newTestTokenService(t, time.Minute)
+	user := &User{ID: 42, Handle: []byte("handle-42"), Name: "alice"}
+
+	token, issued, err := ts.Issue(user, AuthContext{Method: amrHardwareKey})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if issued.ID == "" {
+		t.Fatal("expected jti to be set")
+	}
+
+	claims, err := ts.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Subject != user.Subject() {
+		t.Fatalf("expected sub %q, got %q", user.Subject(), claims.Subject)
+	}
+	if len(claims.AMR) != 1 || claims.AMR[0] != amrHardwareKey {
+		t.Fatalf("expected amr [hwk], got %v", claims.AMR)
+	}
+	if claims.ID != issued.ID {
+		t.Fatalf("expected jti %q, got %q", issued.ID, claims.ID)
+	}
+}
+
+func TestTokenVerifyRejectsOtherKey(t *testing.T) {
+	ts := newTestTokenService(t, time.Minute)
+	other, err := NewTokenService(newTestKeyRing(t, SigningEdDSA), "http://localhost:3000", time.Minute)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+
+	token, _, err := other.Issue(&User{ID: 1, Handle: []byte("handle-1")}, AuthContext{Method: amrPassword})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if _, err := ts.Verify(token); err == nil {
+		t.Fatal("expected token signed with another key to be rejected")
+	}
+}
+
+func TestTokenVerifyRejectsExpired(t *testing.T) {
+	ts := newTestTokenService(t, time.Nanosecond)
+
+	token, _, err := ts.Issue(&User{ID: 1, Handle: []byte("handle-1")}, AuthContext{Method: amrPassword})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	time.Sleep(time.Second)
+	if _, err := ts.Verify(token); err == nil {
+		t.Fatal("expected expired token to be rejected")
+	}
+}
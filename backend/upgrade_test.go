@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordLoginOffersPasskeyUpgrade(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "alice@example.com", "password")
+
+	w := httptest.NewRecorder()
+	app.passwordLoginHandler(w, httptest.NewRequest("POST", "/api/login",
+		strings.NewReader(`{"email":"alice@example.com","password":"password"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		PasskeyUpgrade PasskeyUpgrade `json:"passkeyUpgrade"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if !body.PasskeyUpgrade.Eligible || body.PasskeyUpgrade.Mediation != "conditional" {
+		t.Fatalf("expected an upgrade offer, got %+v", body.PasskeyUpgrade)
+	}
+
+	var offered sql.NullTime
+	app.db.QueryRow("SELECT passkey_offered_at FROM users WHERE id = ?", user.ID).Scan(&offered)
+	if !offered.Valid {
+		t.Fatal("expected the offer to be recorded")
+	}
+}
+
+func TestPasswordLoginNoUpgradeWithPasskey(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := seedPasskeyUser(t, app, "bob@example.com", "cred-1")
+	app.setPassword(user.ID, "password")
+
+	user, _ = app.getUserByID(user.ID)
+	upgrade, err := app.offerPasskeyUpgrade(user)
+	if err != nil {
+		t.Fatalf("offerPasskeyUpgrade: %v", err)
+	}
+	if upgrade.Eligible {
+		t.Fatal("expected no offer for a user who already has a passkey")
+	}
+}
+
+func TestUpgradeStats(t *testing.T) {
+	app := newTestApp(t)
+	alice := seedPasswordUser(t, app, "alice@example.com", "password")
+	seedPasswordUser(t, app, "bob@example.com", "password")
+	seedPasswordUser(t, app, "carol@example.com", "password")
+
+	passwordLogin(t, app, "alice@example.com")
+	passwordLogin(t, app, "bob@example.com")
+	app.markPasskeyUpgraded(alice.ID)
+
+	stats, err := app.upgradeStats()
+	if err != nil {
+		t.Fatalf("upgradeStats: %v", err)
+	}
+	if stats != (UpgradeStats{Offered: 2, Upgraded: 1}) {
+		t.Fatalf("expected 2 offered and 1 upgraded, got %+v", stats)
+	}
+}
+
+func upgradeBeginRequest(app *App, prepare func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/auth/register/begin?mediation=conditional", nil)
+	prepare(req)
+	w := httptest.NewRecorder()
+	app.registerBegin(w, req)
+	return w
+}
+
+func TestUpgradeBeginAfterFreshPasswordLogin(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "alice@example.com", "password")
+	cookie := passwordLogin(t, app, "alice@example.com")
+
+	w := upgradeBeginRequest(app, func(r *http.Request) { r.AddCookie(cookie) })
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Mediation  string `json:"mediation"`
+		CeremonyID string `json:"ceremonyId"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if body.Mediation != "conditional" {
+		t.Fatalf("expected conditional mediation, got %q", body.Mediation)
+	}
+	ceremony, err := app.ceremonies.Get(body.CeremonyID)
+	if err != nil {
+		t.Fatalf("expected stored ceremony: %v", err)
+	}
+	if !ceremony.Upgrade || string(ceremony.Session.UserID) != string(user.Handle) {
+		t.Fatalf("expected an upgrade ceremony for alice, got %+v", ceremony)
+	}
+}
+
+func TestUpgradeBeginWithBearerToken(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "alice@example.com", "password")
+	_, sessionID := sessionCookie(t, app, user, amrPassword, 0)
+	token, _, _ := app.tokens.Issue(user, AuthContext{Method: amrPassword, SessionID: sessionID})
+
+	w := upgradeBeginRequest(app, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) })
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	passkeyToken, _, _ := app.tokens.Issue(user, AuthContext{Method: amrHardwareKey, SessionID: sessionID})
+	w = upgradeBeginRequest(app, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+passkeyToken) })
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a passkey token, got %d", w.Code)
+	}
+}
+
+func TestUpgradeBeginRequiresFreshPasswordLogin(t *testing.T) {
+	app := newTestApp(t)
+	seedPasswordUser(t, app, "alice@example.com", "password")
+
+	if w := upgradeBeginRequest(app, func(*http.Request) {}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %d", w.Code)
+	}
+
+	cookie := passwordLogin(t, app, "alice@example.com")
+	app.db.Exec("UPDATE sessions SET auth_time = ?", time.Now().UTC().Add(-time.Hour))
+	if w := upgradeBeginRequest(app, func(r *http.Request) { r.AddCookie(cookie) }); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a stale login, got %d", w.Code)
+	}
+
+	_, passkeyCookie := seedPasskeyUser(t, app, "bob@example.com", "cred-1")
+	if w := upgradeBeginRequest(app, func(r *http.Request) { r.AddCookie(passkeyCookie) }); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a passkey session, got %d", w.Code)
+	}
+}
+
+func TestRegisterBeginRejectsUnknownMediation(t *testing.T) {
+	app := newTestApp(t)
+	w := httptest.NewRecorder()
+	app.registerBegin(w, httptest.NewRequest("POST", "/api/auth/register/begin?username=x&mediation=silent", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestMarkPasskeyUpgraded(t *testing.T) {
+	app := newTestApp(t)
+	user := seedPasswordUser(t, app, "alice@example.com", "password")
+
+	if err := app.markPasskeyUpgraded(user.ID); err != nil {
+		t.Fatalf("markPasskeyUpgraded: %v", err)
+	}
+	var first time.Time
+	app.db.QueryRow("SELECT passkey_upgraded_at FROM users WHERE id = ?", user.ID).Scan(&first)
+
+	// Later registrations keep the original upgrade time.
+	time.Sleep(10 * time.Millisecond)
+	app.markPasskeyUpgraded(user.ID)
+	var second time.Time
+	app.db.QueryRow("SELECT passkey_upgraded_at FROM users WHERE id = ?", user.ID).Scan(&second)
+	if first.IsZero() || !first.Equal(second) {
+		t.Fatalf("expected upgrade time to be kept, got %v then %v", first, second)
+	}
+}
@@ -1,11 +1,20 @@
 import { describe, it, expect, vi, beforeEach, type Mock } from 'vitest'
-import { startAuthentication, startRegistration } from '@simplewebauthn/browser'
+import {
+  browserSupportsWebAuthnAutofill,
+  startAuthentication,
+  startRegistration,
+} from '@simplewebauthn/browser'
 import { renderHook, act } from '@testing-library/react'
 import { usePasskeyLogin } from '@/hooks/usePasskeyLogin'
 import { usePasskeyRegistration } from '@/hooks/usePasskeyRegistration'
+import { usePasswordLogin } from '@/hooks/usePasswordLogin'
+import { fetchMe } from '@/lib/me'
+import { fetchWithReauth } from '@/lib/reauth'
+import { approveAction } from '@/lib/approval'
 
 // Mock @simplewebauthn/browser
 vi.mock('@simplewebauthn/browser', () => ({
+  browserSupportsWebAuthnAutofill: vi.fn(),
   startAuthentication: vi.fn(),
   startRegistration: vi.fn(),
 }))
@@ -40,6 +49,7 @@ describe('usePasskeyLogin', () => {
             timeout: 300000,
             userVerification: 'required',
           },
+          ceremonyId: 'login-ceremony',
         }),
       })
       .mockResolvedValueOnce({
@@ -76,6 +86,11 @@ describe('usePasskeyLogin', () => {
       'http://localhost:8080/api/auth/login/begin',
       { method: 'POST' },
     )
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      2,
+      'http://localhost:8080/api/auth/login/finish?ceremony=login-ceremony',
+      expect.objectContaining({ method: 'POST' }),
+    )
     expect(startAuthentication).toHaveBeenCalledWith({
       optionsJSON: expect.objectContaining({
         challenge: 'dGVzdC1jaGFsbGVuZ2U',
@@ -84,6 +99,129 @@ describe('usePasskeyLogin', () => {
     })
   })
 
+  it('sends the username for username-first login', async () => {
+    mockFetch
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({
+          publicKey: {
+            challenge: 'dGVzdC1jaGFsbGVuZ2U',
+            allowCredentials: [{ id: 'Y3JlZC0x', type: 'public-key', transports: ['usb'] }],
+          },
+          ceremonyId: 'login-ceremony',
+        }),
+      })
+      .mockResolvedValueOnce({
+        ok: true,
+        text: () => Promise.resolve(JSON.stringify({ status: 'ok', message: 'Passkey login successful!' })),
+      })
+
+    ;(startAuthentication as Mock).mockResolvedValueOnce({
+      id: 'Y3JlZC0x',
+      rawId: 'Y3JlZC0x',
+      type: 'public-key',
+      response: { authenticatorData: 'a', clientDataJSON: 'c', signature: 's' },
+    })
+
+    const { result } = renderHook(() => usePasskeyLogin())
+
+    await act(async () => {
+      await result.current.loginWithPasskey('alice')
+    })
+
+    expect(result.current.status).toBe('success')
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      1,
+      'http://localhost:8080/api/auth/login/begin',
+      {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ username: 'alice' }),
+      },
+    )
+    expect(startAuthentication).toHaveBeenCalledWith({
+      optionsJSON: expect.objectContaining({
+        allowCredentials: [expect.objectContaining({ id: 'Y3JlZC0x' })],
+      }),
+    })
+  })
+
+  it('offers passkeys in autofill with a conditional login', async () => {
+    ;(browserSupportsWebAuthnAutofill as Mock).mockResolvedValueOnce(true)
+    mockFetch
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({
+          publicKey: { challenge: 'dGVzdC1jaGFsbGVuZ2U', rpId: 'localhost' },
+          mediation: 'conditional',
+          ceremonyId: 'conditional-ceremony',
+        }),
+      })
+      .mockResolvedValueOnce({
+        ok: true,
+        text: () => Promise.resolve(JSON.stringify({ status: 'ok', message: 'Passkey login successful!' })),
+      })
+    ;(startAuthentication as Mock).mockResolvedValueOnce({
+      id: 'credential-id',
+      rawId: 'credential-id',
+      type: 'public-key',
+      response: { authenticatorData: 'a', clientDataJSON: 'c', signature: 's' },
+    })
+
+    const { result } = renderHook(() => usePasskeyLogin())
+
+    await act(async () => {
+      await result.current.startConditionalLogin()
+    })
+
+    expect(result.current.status).toBe('success')
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      1,
+      'http://localhost:8080/api/auth/login/begin?mediation=conditional',
+      { method: 'POST' },
+    )
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      2,
+      'http://localhost:8080/api/auth/login/finish?ceremony=conditional-ceremony',
+      expect.objectContaining({ method: 'POST' }),
+    )
+    expect(startAuthentication).toHaveBeenCalledWith({
+      optionsJSON: expect.objectContaining({ challenge: 'dGVzdC1jaGFsbGVuZ2U' }),
+      useBrowserAutofill: true,
+    })
+  })
+
+  it('skips conditional login when autofill is unsupported', async () => {
+    ;(browserSupportsWebAuthnAutofill as Mock).mockResolvedValueOnce(false)
+
+    const { result } = renderHook(() => usePasskeyLogin())
+
+    await act(async () => {
+      await result.current.startConditionalLogin()
+    })
+
+    expect(mockFetch).not.toHaveBeenCalled()
+    expect(result.current.status).toBe('idle')
+  })
+
+  it('stays idle when a conditional login is abandoned', async () => {
+    ;(browserSupportsWebAuthnAutofill as Mock).mockResolvedValueOnce(true)
+    mockFetch.mockResolvedValueOnce({
+      ok: true,
+      json: () => Promise.resolve({ publicKey: { challenge: 'test' }, ceremonyId: 'c' }),
+    })
+    ;(startAuthentication as Mock).mockRejectedValueOnce(new Error('AbortError'))
+
+    const { result } = renderHook(() => usePasskeyLogin())
+
+    await act(async () => {
+      await result.current.startConditionalLogin()
+    })
+
+    expect(result.current.status).toBe('idle')
+    expect(result.current.message).toBe('')
+  })
+
   it('handles passkey login error when user cancels authenticator dialog', async () => {
     mockFetch.mockResolvedValueOnce({
       ok: true,
@@ -157,6 +295,132 @@ describe('usePasskeyLogin', () => {
   })
 })
 
+// ---------------------------------------------------------------
+// usePasswordLogin Hook Tests
+// ---------------------------------------------------------------
+
+describe('usePasswordLogin', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  it('creates a passkey through conditional create when offered', async () => {
+    mockFetch
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({
+          status: 'ok',
+          message: 'Login successful',
+          passkeyUpgrade: { eligible: true, mediation: 'conditional' },
+        }),
+      })
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({
+          publicKey: { challenge: 'dGVzdC1jaGFsbGVuZ2U' },
+          ceremonyId: 'upgrade-ceremony',
+        }),
+      })
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({ status: 'ok' }),
+      })
+
+    ;(startRegistration as Mock).mockResolvedValueOnce({ id: 'new-credential' })
+
+    const { result } = renderHook(() => usePasswordLogin())
+
+    await act(async () => {
+      await result.current.loginWithPassword('alice@example.com', 'password')
+    })
+
+    expect(result.current.status).toBe('success')
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      1,
+      'http://localhost:8080/api/login',
+      expect.objectContaining({
+        method: 'POST',
+        body: JSON.stringify({ email: 'alice@example.com', password: 'password' }),
+        credentials: 'include',
+      }),
+    )
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      2,
+      'http://localhost:8080/api/auth/register/begin?mediation=conditional',
+      { method: 'POST', credentials: 'include' },
+    )
+    expect(startRegistration).toHaveBeenCalledWith({
+      optionsJSON: { challenge: 'dGVzdC1jaGFsbGVuZ2U' },
+      useAutoRegister: true,
+    })
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      3,
+      'http://localhost:8080/api/auth/register/finish?ceremony=upgrade-ceremony',
+      expect.objectContaining({ body: JSON.stringify({ id: 'new-credential' }) }),
+    )
+  })
+
+  it('still logs in when the browser declines the passkey', async () => {
+    mockFetch
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({
+          status: 'ok',
+          message: 'Login successful',
+          passkeyUpgrade: { eligible: true, mediation: 'conditional' },
+        }),
+      })
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({ publicKey: {}, ceremonyId: 'upgrade-ceremony' }),
+      })
+
+    ;(startRegistration as Mock).mockRejectedValueOnce(new Error('NotAllowedError'))
+
+    const { result } = renderHook(() => usePasswordLogin())
+
+    await act(async () => {
+      await result.current.loginWithPassword('alice@example.com', 'password')
+    })
+
+    expect(result.current.status).toBe('success')
+    expect(mockFetch).toHaveBeenCalledTimes(2)
+  })
+
+  it('skips the upgrade when not eligible', async () => {
+    mockFetch.mockResolvedValueOnce({
+      ok: true,
+      json: () => Promise.resolve({ status: 'ok', message: 'Login successful' }),
+    })
+
+    const { result } = renderHook(() => usePasswordLogin())
+
+    await act(async () => {
+      await result.current.loginWithPassword('bob@example.com', 'password')
+    })
+
+    expect(result.current.status).toBe('success')
+    expect(mockFetch).toHaveBeenCalledTimes(1)
+    expect(startRegistration).not.toHaveBeenCalled()
+  })
+
+  it('reports invalid credentials', async () => {
+    mockFetch.mockResolvedValueOnce({
+      ok: false,
+      json: () => Promise.resolve({ error: 'Invalid credentials' }),
+    })
+
+    const { result } = renderHook(() => usePasswordLogin())
+
+    await act(async () => {
+      await result.current.loginWithPassword('alice@example.com', 'wrong')
+    })
+
+    expect(result.current.status).toBe('error')
+    expect(result.current.message).toBe('Invalid credentials')
+  })
+})
+
 // ---------------------------------------------------------------
 // usePasskeyRegistration Hook Tests
 // ---------------------------------------------------------------
@@ -184,6 +448,7 @@ describe('usePasskeyRegistration', () => {
             pubKeyCredParams: [{ alg: -7, type: 'public-key' }],
             authenticatorSelection: { residentKey: 'required', userVerification: 'preferred' },
           },
+          ceremonyId: 'register-ceremony',
         }),
       })
       .mockResolvedValueOnce({
@@ -212,7 +477,12 @@ describe('usePasskeyRegistration', () => {
     expect(mockFetch).toHaveBeenNthCalledWith(
       1,
       'http://localhost:8080/api/auth/register/begin?username=testuser',
-      { method: 'POST' },
+      { method: 'POST', credentials: 'include' },
+    )
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      2,
+      'http://localhost:8080/api/auth/register/finish?ceremony=register-ceremony',
+      expect.objectContaining({ method: 'POST' }),
     )
     expect(startRegistration).toHaveBeenCalledWith({
       optionsJSON: expect.objectContaining({
@@ -237,6 +507,23 @@ describe('usePasskeyRegistration', () => {
     expect(result.current.message).toBe('Failed to start registration')
   })
 
+  it('shows the server error when the username is taken', async () => {
+    mockFetch.mockResolvedValueOnce({
+      ok: false,
+      json: () => Promise.resolve({ error: 'Username already taken' }),
+    })
+
+    const { result } = renderHook(() => usePasskeyRegistration())
+
+    await act(async () => {
+      await result.current.register('testuser')
+    })
+
+    expect(result.current.status).toBe('error')
+    expect(result.current.message).toBe('Username already taken')
+    expect(startRegistration).not.toHaveBeenCalled()
+  })
+
   it('handles registration finish failure', async () => {
     mockFetch
       .mockResolvedValueOnce({
@@ -341,7 +628,172 @@ describe('usePasskeyRegistration', () => {
 
     expect(mockFetch).toHaveBeenCalledWith(
       'http://localhost:8080/api/auth/register/begin?username=user%20name%20with%20spaces',
-      { method: 'POST' },
+      { method: 'POST', credentials: 'include' },
     )
   })
 })
+
+// ---------------------------------------------------------------
+// fetchMe Tests
+// ---------------------------------------------------------------
+
+describe('fetchMe', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  it('returns the current user', async () => {
+    const me = {
+      user: { username: 'alice', displayName: 'Alice', hasPassword: false },
+      passkeys: [],
+      auth: { method: 'hwk', time: '2026-01-01T00:00:00Z', via: 'session', credentialId: 'Y3JlZA' },
+    }
+    mockFetch.mockResolvedValueOnce({
+      ok: true,
+      status: 200,
+      json: () => Promise.resolve(me),
+    })
+
+    await expect(fetchMe()).resolves.toEqual(me)
+    expect(mockFetch).toHaveBeenCalledWith('http://localhost:8080/api/me', {
+      credentials: 'include',
+    })
+  })
+
+  it('returns null when not logged in', async () => {
+    mockFetch.mockResolvedValueOnce({ ok: false, status: 401 })
+
+    await expect(fetchMe()).resolves.toBeNull()
+  })
+
+  it('throws on server errors', async () => {
+    mockFetch.mockResolvedValueOnce({ ok: false, status: 500 })
+
+    await expect(fetchMe()).rejects.toThrow('Failed to load account')
+  })
+})
+
+// ---------------------------------------------------------------
+// fetchWithReauth Tests
+// ---------------------------------------------------------------
+
+describe('fetchWithReauth', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  const reauthRequired = () => {
+    const body = { error: 'Please confirm it', code: 'reauth_required' }
+    const resp = { ok: false, status: 401, json: () => Promise.resolve(body) }
+    return { ...resp, clone: () => resp }
+  }
+
+  it('passes through responses that need no step-up', async () => {
+    mockFetch.mockResolvedValueOnce({ ok: true, status: 204 })
+
+    const resp = await fetchWithReauth('http://localhost:8080/api/passkeys/abc', { method: 'DELETE' })
+
+    expect(resp.status).toBe(204)
+    expect(mockFetch).toHaveBeenCalledTimes(1)
+    expect(startAuthentication).not.toHaveBeenCalled()
+  })
+
+  it('re-authenticates and retries on reauth_required', async () => {
+    mockFetch
+      .mockResolvedValueOnce(reauthRequired())
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({ publicKey: { challenge: 'c' }, ceremonyId: 'cer-1' }),
+      })
+      .mockResolvedValueOnce({ ok: true, json: () => Promise.resolve({ status: 'ok' }) })
+      .mockResolvedValueOnce({ ok: true, status: 204 })
+    ;(startAuthentication as Mock).mockResolvedValueOnce({ id: 'cred' })
+
+    const resp = await fetchWithReauth('http://localhost:8080/api/passkeys/abc', { method: 'DELETE' })
+
+    expect(resp.status).toBe(204)
+    expect(startAuthentication).toHaveBeenCalledWith({ optionsJSON: { challenge: 'c' } })
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      3,
+      'http://localhost:8080/api/auth/reauth/finish?ceremony=cer-1',
+      expect.objectContaining({ method: 'POST', body: JSON.stringify({ id: 'cred' }) }),
+    )
+    expect(mockFetch).toHaveBeenLastCalledWith('http://localhost:8080/api/passkeys/abc', {
+      credentials: 'include',
+      method: 'DELETE',
+    })
+  })
+
+  it('fails when the step-up is not verified', async () => {
+    mockFetch
+      .mockResolvedValueOnce(reauthRequired())
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({ publicKey: { challenge: 'c' }, ceremonyId: 'cer-1' }),
+      })
+      .mockResolvedValueOnce({
+        ok: false,
+        json: () => Promise.resolve({ error: 'Passkey verification failed' }),
+      })
+    ;(startAuthentication as Mock).mockResolvedValueOnce({ id: 'cred' })
+
+    await expect(
+      fetchWithReauth('http://localhost:8080/api/passkeys/abc', { method: 'DELETE' }),
+    ).rejects.toThrow('Passkey verification failed')
+    expect(mockFetch).toHaveBeenCalledTimes(3)
+  })
+})
+
+// ---------------------------------------------------------------
+// approveAction Tests
+// ---------------------------------------------------------------
+
+describe('approveAction', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  it('signs the approval challenge and returns the record', async () => {
+    mockFetch
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () =>
+          Promise.resolve({
+            publicKey: { challenge: 'doc-hash' },
+            ceremonyId: 'cer-1',
+            approval: { id: 'nonce', document: '{}', hash: 'doc-hash' },
+          }),
+      })
+      .mockResolvedValueOnce({
+        ok: true,
+        json: () => Promise.resolve({ id: 'nonce', approval: 'jws', expiresAt: '2026-01-01T00:05:00Z' }),
+      })
+    ;(startAuthentication as Mock).mockResolvedValueOnce({ id: 'cred' })
+
+    const approval = await approveAction('payment', { amount: '10.00', recipient: 'bob' })
+
+    expect(approval.approval).toBe('jws')
+    expect(mockFetch).toHaveBeenNthCalledWith(1, 'http://localhost:8080/api/approvals/begin', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ action: 'payment', payload: { amount: '10.00', recipient: 'bob' } }),
+      credentials: 'include',
+    })
+    expect(startAuthentication).toHaveBeenCalledWith({ optionsJSON: { challenge: 'doc-hash' } })
+    expect(mockFetch).toHaveBeenNthCalledWith(
+      2,
+      'http://localhost:8080/api/approvals/finish?ceremony=cer-1',
+      expect.objectContaining({ method: 'POST', body: JSON.stringify({ id: 'cred' }) }),
+    )
+  })
+
+  it('throws the server error when the approval cannot start', async () => {
+    mockFetch.mockResolvedValueOnce({
+      ok: false,
+      json: () => Promise.resolve({ error: 'A passkey is required to approve actions' }),
+    })
+
+    await expect(approveAction('payment', {})).rejects.toThrow('A passkey is required to approve actions')
+    expect(startAuthentication).not.toHaveBeenCalled()
+  })
+})
@@ -1,21 +1,68 @@
 import { useState } from "react";
-import { startAuthentication } from "@simplewebauthn/browser";
+import {
+  browserSupportsWebAuthnAutofill,
+  startAuthentication,
+} from "@simplewebauthn/browser";
 import { API_BASE_URL } from "@/config";
 
 export type AuthStatus = "idle" | "loading" | "success" | "error";
 
+type LoginOptions = {
+  publicKey?: Record<string, unknown>;
+  ceremonyId?: string;
+};
+
+// finishLogin sends the authenticator's assertion to the server and returns
+// the success message.
+async function finishLogin(options: LoginOptions, authResp: unknown) {
+  const verifyResp = await fetch(
+    `${API_BASE_URL}/api/auth/login/finish?ceremony=${encodeURIComponent(options.ceremonyId ?? "")}`,
+    {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(authResp),
+      credentials: "include",
+    },
+  );
+
+  const text = await verifyResp.text();
+  let data: Record<string, string>;
+  try {
+    data = JSON.parse(text);
+  } catch {
+    throw new Error(
+      "Server returned invalid response: " + text.substring(0, 100),
+    );
+  }
+
+  if (!verifyResp.ok) {
+    throw new Error(data.error || "Passkey verification failed");
+  }
+  return data.message || "Passkey login successful!";
+}
+
 export function usePasskeyLogin() {
   const [status, setStatus] = useState<AuthStatus>("idle");
   const [message, setMessage] = useState("");
 
-  const loginWithPasskey = async () => {
+  // Without a username the authenticator chooses the account (discoverable
+  // login). With one, the server lists that user's credentials, which
+  // security keys without resident credentials need.
+  const loginWithPasskey = async (username?: string) => {
     setStatus("loading");
     setMessage("");
 
     try {
-      const resp = await fetch(`${API_BASE_URL}/api/auth/login/begin`, {
-        method: "POST",
-      });
+      const resp = await fetch(
+        `${API_BASE_URL}/api/auth/login/begin`,
+        username
+          ? {
+              method: "POST",
+              headers: { "Content-Type": "application/json" },
+              body: JSON.stringify({ username }),
+            }
+          : { method: "POST" },
+      );
       if (!resp.ok) {
         const text = await resp.text();
         throw new Error(text || "Failed to start login");
@@ -25,31 +72,47 @@ export function usePasskeyLogin() {
 
       const authResp = await startAuthentication({ optionsJSON });
 
-      const verifyResp = await fetch(
-        `${API_BASE_URL}/api/auth/login/finish`,
-        {
-          method: "POST",
-          headers: { "Content-Type": "application/json" },
-          body: JSON.stringify(authResp),
-        },
+      setMessage(await finishLogin(options, authResp));
+      setStatus("success");
+    } catch (err: unknown) {
+      setStatus("error");
+      setMessage(
+        err instanceof Error ? err.message : "Passkey login failed",
+      );
+    }
+  };
+
+  // startConditionalLogin offers passkeys in the browser's autofill for an
+  // input with autocomplete="username webauthn". It waits in the background
+  // until the user picks a passkey; starting a modal login cancels it.
+  const startConditionalLogin = async () => {
+    if (!(await browserSupportsWebAuthnAutofill())) return;
+
+    let options: LoginOptions;
+    let authResp: unknown;
+    try {
+      const resp = await fetch(
+        `${API_BASE_URL}/api/auth/login/begin?mediation=conditional`,
+        { method: "POST" },
       );
+      if (!resp.ok) return;
+      const json = await resp.json();
+      options = json;
 
-      const text = await verifyResp.text();
-      let data: Record<string, string>;
-      try {
-        data = JSON.parse(text);
-      } catch {
-        throw new Error(
-          "Server returned invalid response: " + text.substring(0, 100),
-        );
-      }
+      authResp = await startAuthentication({
+        optionsJSON: json.publicKey ? json.publicKey : json,
+        useBrowserAutofill: true,
+      });
+    } catch {
+      // Cancelled or superseded by a modal login; nothing to report.
+      return;
+    }
 
-      if (verifyResp.ok) {
-        setStatus("success");
-        setMessage(data.message || "Passkey login successful!");
-      } else {
-        throw new Error(data.error || "Passkey verification failed");
-      }
+    setStatus("loading");
+    setMessage("");
+    try {
+      setMessage(await finishLogin(options, authResp));
+      setStatus("success");
     } catch (err: unknown) {
       setStatus("error");
       setMessage(
@@ -58,5 +121,5 @@ export function usePasskeyLogin() {
     }
   };
 
-  return { status, message, loginWithPasskey };
+  return { status, message, loginWithPasskey, startConditionalLogin };
 }
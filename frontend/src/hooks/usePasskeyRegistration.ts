@@ -4,6 +4,15 @@ import { API_BASE_URL } from "@/config";
 
 export type AuthStatus = "idle" | "loading" | "success" | "error";
 
+async function errorMessage(resp: Response, fallback: string) {
+  try {
+    const errData = await resp.json();
+    return errData.error || fallback;
+  } catch {
+    return fallback;
+  }
+}
+
 export function usePasskeyRegistration() {
   const [status, setStatus] = useState<AuthStatus>("idle");
   const [message, setMessage] = useState("");
@@ -15,9 +24,11 @@ export function usePasskeyRegistration() {
     try {
       const resp = await fetch(
         `${API_BASE_URL}/api/auth/register/begin?username=${encodeURIComponent(username)}`,
-        { method: "POST" },
+        { method: "POST", credentials: "include" },
       );
-      if (!resp.ok) throw new Error("Failed to start registration");
+      if (!resp.ok) {
+        throw new Error(await errorMessage(resp, "Failed to start registration"));
+      }
 
       const options = await resp.json();
       const optionsJSON = options.publicKey ? options.publicKey : options;
@@ -25,11 +36,12 @@ export function usePasskeyRegistration() {
       const attResp = await startRegistration({ optionsJSON });
 
       const verificationResp = await fetch(
-        `${API_BASE_URL}/api/auth/register/finish?username=${encodeURIComponent(username)}`,
+        `${API_BASE_URL}/api/auth/register/finish?ceremony=${encodeURIComponent(options.ceremonyId ?? "")}`,
         {
           method: "POST",
           headers: { "Content-Type": "application/json" },
           body: JSON.stringify(attResp),
+          credentials: "include",
         },
       );
 
@@ -0,0 +1,77 @@
+import { useState } from "react";
+import { startRegistration } from "@simplewebauthn/browser";
+import { API_BASE_URL } from "@/config";
+
+export type AuthStatus = "idle" | "loading" | "success" | "error";
+
+type PasskeyUpgrade = {
+  eligible: boolean;
+  mediation?: string;
+};
+
+// upgradeToPasskey asks the browser to create a passkey for the user who just
+// logged in with a password. With conditional mediation the browser decides
+// whether to do so without a prompt, e.g. when its password manager filled in
+// the password, so any failure here is silent.
+async function upgradeToPasskey(upgrade: PasskeyUpgrade) {
+  try {
+    const beginResp = await fetch(
+      `${API_BASE_URL}/api/auth/register/begin?mediation=${encodeURIComponent(upgrade.mediation ?? "conditional")}`,
+      { method: "POST", credentials: "include" },
+    );
+    if (!beginResp.ok) return;
+    const options = await beginResp.json();
+
+    const attResp = await startRegistration({
+      optionsJSON: options.publicKey ? options.publicKey : options,
+      useAutoRegister: true,
+    });
+
+    await fetch(
+      `${API_BASE_URL}/api/auth/register/finish?ceremony=${encodeURIComponent(options.ceremonyId ?? "")}`,
+      {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(attResp),
+        credentials: "include",
+      },
+    );
+  } catch {
+    // Not supported, declined or refused; the user keeps their password.
+  }
+}
+
+export function usePasswordLogin() {
+  const [status, setStatus] = useState<AuthStatus>("idle");
+  const [message, setMessage] = useState("");
+
+  const loginWithPassword = async (email: string, password: string) => {
+    setStatus("loading");
+    setMessage("");
+
+    try {
+      const resp = await fetch(`${API_BASE_URL}/api/login`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ email, password }),
+        credentials: "include",
+      });
+      const data = await resp.json().catch(() => ({}));
+      if (!resp.ok) {
+        throw new Error(data.error || "Login failed");
+      }
+
+      if (data.passkeyUpgrade?.eligible) {
+        await upgradeToPasskey(data.passkeyUpgrade);
+      }
+
+      setMessage(data.message || "Login successful");
+      setStatus("success");
+    } catch (err: unknown) {
+      setStatus("error");
+      setMessage(err instanceof Error ? err.message : "Login failed");
+    }
+  };
+
+  return { status, message, loginWithPassword };
+}
@@ -0,0 +1,45 @@
+import { startAuthentication } from "@simplewebauthn/browser";
+import { API_BASE_URL } from "@/config";
+
+export type Approval = {
+  id: string;
+  // Signed approval record (JWS) to hand to the service performing the action.
+  approval: string;
+  expiresAt: string;
+};
+
+// approveAction asks the user to approve action with payload using a
+// passkey. The passkey signs a hash of the canonical action document, so the
+// returned approval covers exactly this action and payload.
+export async function approveAction(
+  action: string,
+  payload: Record<string, unknown>,
+): Promise<Approval> {
+  const beginResp = await fetch(`${API_BASE_URL}/api/approvals/begin`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ action, payload }),
+    credentials: "include",
+  });
+  const options = await beginResp.json();
+  if (!beginResp.ok) {
+    throw new Error(options.error || "Failed to start approval");
+  }
+
+  const authResp = await startAuthentication({ optionsJSON: options.publicKey });
+
+  const finishResp = await fetch(
+    `${API_BASE_URL}/api/approvals/finish?ceremony=${encodeURIComponent(options.ceremonyId ?? "")}`,
+    {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(authResp),
+      credentials: "include",
+    },
+  );
+  const data = await finishResp.json().catch(() => ({}));
+  if (!finishResp.ok) {
+    throw new Error(data.error || "Approval failed");
+  }
+  return data;
+}
@@ -0,0 +1,42 @@
+import { API_BASE_URL } from "@/config";
+
+export type Passkey = {
+  id: string;
+  name: string;
+  createdAt: string | null;
+  lastUsedAt: string | null;
+  authenticatorName: string;
+  backupEligible: boolean;
+  backupState: boolean;
+  locked: boolean;
+};
+
+export type Me = {
+  user: {
+    username: string;
+    displayName: string;
+    hasPassword: boolean;
+  };
+  passkeys: Passkey[];
+  auth: {
+    method: "hwk" | "pwd";
+    time: string;
+    via: "session" | "bearer";
+    credentialId?: string;
+  };
+};
+
+// fetchMe loads the logged-in user from /api/me. It returns null when the
+// request is not authenticated.
+export async function fetchMe(): Promise<Me | null> {
+  const resp = await fetch(`${API_BASE_URL}/api/me`, {
+    credentials: "include",
+  });
+  if (resp.status === 401) {
+    return null;
+  }
+  if (!resp.ok) {
+    throw new Error("Failed to load account");
+  }
+  return resp.json();
+}
@@ -0,0 +1,50 @@
+import { startAuthentication } from "@simplewebauthn/browser";
+import { API_BASE_URL } from "@/config";
+
+// reauthenticate confirms the user with one of their passkeys, refreshing
+// the session's authentication time for sensitive operations.
+export async function reauthenticate() {
+  const beginResp = await fetch(`${API_BASE_URL}/api/auth/reauth/begin`, {
+    method: "POST",
+    credentials: "include",
+  });
+  const options = await beginResp.json();
+  if (!beginResp.ok) {
+    throw new Error(options.error || "Failed to start re-authentication");
+  }
+
+  const authResp = await startAuthentication({ optionsJSON: options.publicKey });
+
+  const finishResp = await fetch(
+    `${API_BASE_URL}/api/auth/reauth/finish?ceremony=${encodeURIComponent(options.ceremonyId ?? "")}`,
+    {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(authResp),
+      credentials: "include",
+    },
+  );
+  if (!finishResp.ok) {
+    const data = await finishResp.json().catch(() => ({}));
+    throw new Error(data.error || "Passkey verification failed");
+  }
+}
+
+// fetchWithReauth sends a request to an endpoint behind RequireRecentAuth.
+// When the server answers reauth_required, it confirms the user with a
+// passkey and sends the request once more.
+export async function fetchWithReauth(url: string, init: RequestInit = {}) {
+  const send = () => fetch(url, { credentials: "include", ...init });
+
+  const resp = await send();
+  if (resp.status !== 401) {
+    return resp;
+  }
+  const data = await resp.clone().json().catch(() => ({}));
+  if (data.code !== "reauth_required") {
+    return resp;
+  }
+
+  await reauthenticate();
+  return send();
+}
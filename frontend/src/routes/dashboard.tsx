@@ -1,4 +1,8 @@
-import { createFileRoute, useNavigate } from '@tanstack/react-router'
+import { useState } from 'react'
+import { createFileRoute, redirect, useNavigate, useRouter } from '@tanstack/react-router'
+import { API_BASE_URL } from "@/config"
+import { fetchMe } from "@/lib/me"
+import { fetchWithReauth } from "@/lib/reauth"
 import { Button } from "@/components/ui/button"
 import {
   Card,
@@ -8,18 +12,63 @@ import {
   CardTitle,
 } from "@/components/ui/card"
 
+const authMethodLabels: Record<string, string> = {
+  hwk: 'Passkey',
+  pwd: 'Password',
+}
+
 export const Route = createFileRoute('/dashboard')({
+  // The session cookie belongs to the API origin, so the check has to run
+  // in the browser.
+  ssr: false,
+  beforeLoad: async () => {
+    const me = await fetchMe().catch(() => null)
+    if (!me) {
+      throw redirect({ to: '/' })
+    }
+    return { me }
+  },
   component: Dashboard,
 })
 
 function Dashboard() {
   const navigate = useNavigate()
+  const router = useRouter()
+  const { me } = Route.useRouteContext()
+  const [error, setError] = useState('')
+
+  const handleLogout = async () => {
+    try {
+      await fetch(`${API_BASE_URL}/api/auth/logout`, {
+        method: 'POST',
+        credentials: 'include',
+      })
+    } finally {
+      navigate({ to: '/' })
+    }
+  }
 
-  const handleLogout = () => {
-    // In a real app, clear tokens/state here
-    navigate({ to: '/' })
+  // Deleting a passkey needs a recent passkey assertion; fetchWithReauth
+  // asks for one when the login is too old.
+  const handleDeletePasskey = async (id: string) => {
+    setError('')
+    try {
+      const resp = await fetchWithReauth(
+        `${API_BASE_URL}/api/passkeys/${encodeURIComponent(id)}`,
+        { method: 'DELETE' },
+      )
+      if (!resp.ok) {
+        const data = await resp.json().catch(() => ({}))
+        throw new Error(data.error || 'Failed to delete passkey')
+      }
+      await router.invalidate()
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Failed to delete passkey')
+    }
   }
 
+  const currentPasskey = me.passkeys.find((p) => p.id === me.auth.credentialId)
+
   return (
     <div className="min-h-screen bg-gray-100 p-8 dark:bg-gray-900">
       <div className="mx-auto max-w-4xl space-y-8">
@@ -35,25 +84,43 @@ function Dashboard() {
         <div className="grid gap-4 md:grid-cols-2 lg:grid-cols-3">
           <Card>
             <CardHeader>
-              <CardTitle>Welcome Back!</CardTitle>
+              <CardTitle>Welcome Back, {me.user.displayName || me.user.username}!</CardTitle>
               <CardDescription>It's great to see you again.</CardDescription>
             </CardHeader>
             <CardContent>
               <p className="text-sm text-gray-500 dark:text-gray-400">
-                You have successfully logged in. This is a protected area of the application.
+                Signed in with {authMethodLabels[me.auth.method] ?? me.auth.method}
+                {currentPasskey ? ` (${currentPasskey.name})` : ''} at{' '}
+                {new Date(me.auth.time).toLocaleString()}.
               </p>
             </CardContent>
           </Card>
 
           <Card>
             <CardHeader>
-              <CardTitle>Recent Activity</CardTitle>
-              <CardDescription>Your latest actions.</CardDescription>
+              <CardTitle>Passkeys</CardTitle>
+              <CardDescription>Passkeys registered to your account.</CardDescription>
             </CardHeader>
             <CardContent>
-              <p className="text-sm text-gray-500 dark:text-gray-400">
-                No recent activity to report.
-              </p>
+              {me.passkeys.length === 0 ? (
+                <p className="text-sm text-gray-500 dark:text-gray-400">
+                  No passkeys yet.
+                </p>
+              ) : (
+                <ul className="space-y-1 text-sm text-gray-700 dark:text-gray-300">
+                  {me.passkeys.map((p) => (
+                    <li key={p.id} className="flex items-center justify-between gap-2">
+                      <span>{p.name}</span>
+                      <Button variant="ghost" size="sm" onClick={() => handleDeletePasskey(p.id)}>
+                        Delete
+                      </Button>
+                    </li>
+                  ))}
+                </ul>
+              )}
+              {error && (
+                <p className="mt-2 text-sm text-red-600 dark:text-red-400">{error}</p>
+              )}
             </CardContent>
           </Card>
 
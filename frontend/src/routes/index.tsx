@@ -1,7 +1,10 @@
 import { createFileRoute, useNavigate, Link } from '@tanstack/react-router'
-import { useEffect } from 'react'
+import { useEffect, useState } from 'react'
 import { usePasskeyLogin } from '@/hooks/usePasskeyLogin'
+import { usePasswordLogin } from '@/hooks/usePasswordLogin'
 import { Button } from "@/components/ui/button"
+import { Input } from "@/components/ui/input"
+import { Label } from "@/components/ui/label"
 import {
   Card,
   CardContent,
@@ -34,33 +37,83 @@ function LandingPage() {
 
 export function LoginForm() {
   const navigate = useNavigate()
-  const { status, message, loginWithPasskey } = usePasskeyLogin()
+  const [username, setUsername] = useState('')
+  const [password, setPassword] = useState('')
+  const [method, setMethod] = useState<'passkey' | 'password'>('passkey')
+  const passkeyLogin = usePasskeyLogin()
+  const passwordLogin = usePasswordLogin()
+  const { startConditionalLogin } = passkeyLogin
+  const { status, message } = method === 'password' ? passwordLogin : passkeyLogin
 
   const handlePasskeyLogin = async () => {
-    await loginWithPasskey()
+    setMethod('passkey')
+    await passkeyLogin.loginWithPasskey(username || undefined)
   }
 
+  // A password login offers to create a passkey before moving on, so the
+  // next login can use it.
+  const handlePasswordLogin = async () => {
+    setMethod('password')
+    await passwordLogin.loginWithPassword(username, password)
+  }
+
+  // Offer saved passkeys in the username field's autofill.
+  useEffect(() => {
+    startConditionalLogin()
+  }, [])
+
+  // An autofill passkey login can finish whichever button was used last.
+  const loggedIn = passkeyLogin.status === 'success' || passwordLogin.status === 'success'
   useEffect(() => {
-    if (status !== 'success') return
+    if (!loggedIn) return
     const timer = setTimeout(() => navigate({ to: '/dashboard' }), 800)
     return () => clearTimeout(timer)
-  }, [status, navigate])
+  }, [loggedIn, navigate])
 
   return (
     <Card className="w-full max-w-md">
       <CardHeader>
         <CardTitle className="text-2xl">Login</CardTitle>
         <CardDescription>
-          Sign in using your passkey.
+          Sign in using your passkey, or your password if you have not created one yet.
         </CardDescription>
       </CardHeader>
       <CardContent className="space-y-4">
+          <div className="space-y-2">
+            <Label htmlFor="username">Username</Label>
+            <Input
+              id="username"
+              placeholder="Optional for passkeys"
+              autoComplete="username webauthn"
+              value={username}
+              onChange={(e) => setUsername(e.target.value)}
+            />
+          </div>
           <Button 
               className="w-full h-12 text-lg font-medium"
               onClick={handlePasskeyLogin}
               disabled={status === 'loading'}
           >
-              {status === 'loading' ? 'Signing in...' : 'Sign in with Passkey'}
+              {status === 'loading' && method === 'passkey' ? 'Signing in...' : 'Sign in with Passkey'}
+          </Button>
+
+          <div className="space-y-2">
+            <Label htmlFor="password">Password</Label>
+            <Input
+              id="password"
+              type="password"
+              autoComplete="current-password"
+              value={password}
+              onChange={(e) => setPassword(e.target.value)}
+            />
+          </div>
+          <Button
+              variant="outline"
+              className="w-full"
+              onClick={handlePasswordLogin}
+              disabled={status === 'loading' || !username || !password}
+          >
+              {status === 'loading' && method === 'password' ? 'Signing in...' : 'Sign in with Password'}
           </Button>
 
           {message && (